@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/postgres"
@@ -10,8 +15,11 @@ import (
 	"github.com/qs-lzh/flash-sale/config"
 	"github.com/qs-lzh/flash-sale/internal/app"
 	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/challenge"
 	"github.com/qs-lzh/flash-sale/internal/handler"
+	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
 )
 
 func main() {
@@ -19,6 +27,24 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if cfg.AuthJWTSecret == "" {
+		log.Fatalf("AUTH_JWT_SECRET is not set, access tokens can't be signed")
+	}
+	switch cfg.ChallengeMode {
+	case "":
+	case domain.ChallengeModeProofOfWork, domain.ChallengeModeCaptcha, domain.ChallengeModeCaptchaLocal:
+		if cfg.ChallengeMode == domain.ChallengeModeCaptcha && cfg.CaptchaVerifyURL == "" {
+			log.Fatalf("CAPTCHA_VERIFY_URL is not set, captchas can't be checked; use CHALLENGE_MODE=captcha-local for the local stand-in")
+		}
+		if cfg.ChallengeSecret == "" {
+			log.Fatalf("CHALLENGE_SECRET is not set, challenges can't be signed")
+		}
+		if cfg.ChallengeDifficulty < 0 || cfg.ChallengeDifficulty > challenge.MaxDifficulty {
+			log.Fatalf("CHALLENGE_DIFFICULTY must be between 0 and %d", challenge.MaxDifficulty)
+		}
+	default:
+		log.Fatalf("Unknown CHALLENGE_MODE %q", cfg.ChallengeMode)
+	}
 
 	db, err := gorm.Open(postgres.Open(cfg.DatabaseDSN), &gorm.Config{})
 	if err != nil {
@@ -30,33 +56,128 @@ func main() {
 		log.Fatalf("Failed to create cache: %v", err)
 	}
 
-	mqConn, err := mq.NewMQConn(cfg.MQURL)
+	broker, err := mq.NewBroker(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create rabbit mq: %v", err)
+		log.Fatalf("Failed to create mq broker: %v", err)
 	}
 
-	app := app.New(cfg, db, cache, mqConn)
-	defer app.Close()
+	app := app.New(cfg, db, cache, broker)
 
 	if err := app.Init(); err != nil {
+		app.Close()
 		log.Fatalf("Failed to init app: %v", err)
 	}
 
 	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		app.Close()
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
 	reserveHandler := handler.NewReserveHandler(app)
+	paymentHandler := handler.NewPaymentHandler(app)
+	orderHandler := handler.NewOrderHandler(app)
+	eventsHandler := handler.NewEventsHandler(app)
+	authHandler := handler.NewAuthHandler(app)
+	userHandler := handler.NewUserHandler(app)
+	adminHandler := handler.NewAdminHandler(app)
+	catalogHandler := handler.NewCatalogHandler(app)
+
+	requireAuth := handler.RequireAuth(app.Tokens)
+	requireStreamAuth := handler.RequireStreamAuth(app.Tokens)
 
-	r.POST("/reserve", reserveHandler.HandleReserve)
+	r.GET("/movies", catalogHandler.HandleListMovies)
+	r.GET("/movies/:id", catalogHandler.HandleGetMovie)
+	r.GET("/movies/:id/showtimes", catalogHandler.HandleListMovieShowtimes)
+	r.GET("/showtimes", catalogHandler.HandleListShowtimes)
+	r.GET("/showtimes/:id", catalogHandler.HandleGetShowtime)
 
-	r.Run(cfg.Addr)
+	r.POST("/auth/register", authHandler.HandleRegister)
+	r.POST("/auth/login", handler.RateLimit(app, "login"), authHandler.HandleLogin)
+	r.POST("/auth/refresh", authHandler.HandleRefresh)
+	r.GET("/me/notification-preferences", requireAuth, userHandler.HandleGetNotificationPreference)
+	r.PUT("/me/notification-preferences", requireAuth, userHandler.HandleSetNotificationPreference)
+	r.GET("/me/events", requireStreamAuth, eventsHandler.HandleUserEvents)
+	r.GET("/me/orders", requireAuth, orderHandler.HandleListMyOrders)
+	r.POST("/orders/:id/refund", requireAuth, orderHandler.HandleRefund)
+
+	r.GET("/challenges", requireAuth, handler.RateLimit(app, "challenge"), reserveHandler.HandleGetChallenge)
+	r.POST("/reserve", requireAuth, handler.RateLimit(app, "reserve"), handler.Idempotent(app, "reserve"),
+		reserveHandler.HandleReserve)
+	r.GET("/reservations/:id", requireAuth, reserveHandler.HandleGetReservation)
+	r.GET("/reservations/:id/events", requireStreamAuth, eventsHandler.HandleReservationEvents)
+	// the reservation token authorizes these
+	r.POST("/reservations/:id/pay", handler.RateLimit(app, "pay"), handler.Idempotent(app, "pay"), reserveHandler.HandlePay)
+	r.POST("/reservations/:id/cancel", reserveHandler.HandleCancel)
+	r.POST("/payments/webhook", paymentHandler.HandleWebhook)
+
+	staff := r.Group("/admin", requireAuth)
+	staff.GET("/showtimes/:id/orders",
+		handler.RequirePermission(app.AuditService, model.PermissionViewOrders), adminHandler.HandleListShowtimeOrders)
+	admin := staff.Group("", handler.RequireRole(app.AuditService, model.RoleAdmin))
+	catalog := admin.Group("", handler.RequirePermission(app.AuditService, model.PermissionManageCatalog))
+	catalog.POST("/movies", adminHandler.HandleCreateMovie)
+	catalog.PUT("/movies/:id", adminHandler.HandleUpdateMovie)
+	catalog.DELETE("/movies/:id", adminHandler.HandleDeleteMovie)
+	catalog.POST("/showtimes", adminHandler.HandleCreateShowtime)
+	catalog.PUT("/showtimes/:id", adminHandler.HandleUpdateShowtime)
+	catalog.DELETE("/showtimes/:id", adminHandler.HandleDeleteShowtime)
+	catalog.PUT("/showtimes/:id/prices", adminHandler.HandleSetPrice)
+	catalog.POST("/promo-codes", adminHandler.HandleCreatePromoCode)
+	inventory := admin.Group("", handler.RequirePermission(app.AuditService, model.PermissionAdjustInventory))
+	inventory.POST("/showtimes/:id/inventory", adminHandler.HandleAdjustInventory)
+	inventory.PUT("/showtimes/:id/challenge-difficulty", adminHandler.HandleSetChallengeDifficulty)
+	reconciliation := admin.Group("", handler.RequirePermission(app.AuditService, model.PermissionReconcile))
+	reconciliation.GET("/showtimes/:id/reconciliation", adminHandler.HandleReconcile)
+	reconciliation.POST("/showtimes/:id/reconciliation/repair", adminHandler.HandleRepair)
+
+	srv := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: r,
+	}
+	// event streams never finish by themselves, end them so Shutdown doesn't wait for them
+	srv.RegisterOnShutdown(app.ReservationEvents.Close)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %v", cfg.ShutdownTimeout)
+	case err := <-serverErr:
+		log.Printf("Server stopped: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting requests and let in-flight reservations finish first,
+	// they publish to the mq which is closed by app.Shutdown
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down http server: %v", err)
+	}
+	if err := app.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down app: %v", err)
+	}
 }
 
 // func initDB(db *gorm.DB) error {
 // 	if err := db.Migrator().DropTable(
+// 		&model.AuditLog{},
 // 		&model.Order{},
+// 		&model.NotificationPreference{},
+// 		&model.PromoCode{},
+// 		&model.ShowtimePrice{},
 // 		&model.Showtime{},
 // 		&model.Movie{},
+// 		&model.RefreshToken{},
 // 		&model.User{},
 // 	); err != nil {
 // 		return err
@@ -64,9 +185,14 @@ func main() {
 //
 // 	if err := db.Migrator().AutoMigrate(
 // 		&model.User{},
+// 		&model.RefreshToken{},
 // 		&model.Movie{},
 // 		&model.Showtime{},
+// 		&model.ShowtimePrice{},
+// 		&model.PromoCode{},
 // 		&model.Order{},
+// 		&model.NotificationPreference{},
+// 		&model.AuditLog{},
 // 	); err != nil {
 // 		return err
 // 	}
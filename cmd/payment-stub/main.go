@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+
+	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/paystub"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// a local payment provider, run the flash-sale server with PAYMENT_PROVIDER=local to use it
+func main() {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	srv := paystub.NewServer(cfg.PaymentWebhookURL, cfg.PaymentWebhookSecrets[domain.PaymentProviderLocal])
+
+	log.Printf("Payment stub listening on %s, reporting to %s", cfg.PaymentStubAddr, cfg.PaymentWebhookURL)
+	if err := srv.Router().Run(cfg.PaymentStubAddr); err != nil {
+		log.Fatalf("Payment stub stopped: %v", err)
+	}
+}
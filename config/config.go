@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/qs-lzh/flash-sale/internal/util"
 )
@@ -10,9 +14,121 @@ type Config struct {
 	DatabaseDSN string
 	Addr        string
 	CacheURL    string
-	MQURL       string
+
+	// message transport, "rabbitmq" (default) or "nats"
+	MQBackend string
+	MQURL     string
+	// empty NATSURL means an embedded nats server is started
+	NATSURL      string
+	NATSStoreDir string
+
+	// payment provider, "mock" (default) or "local" for the http stand-in in cmd/payment-stub
+	PaymentProvider    string
+	PaymentProviderURL string
+	// behaviour of the mock provider
+	MockPaymentDeclineRate float64
+	MockPaymentMinLatency  time.Duration
+	MockPaymentMaxLatency  time.Duration
+	// address the stand-in listens on, and the webhook it reports results to
+	PaymentStubAddr   string
+	PaymentWebhookURL string
+	// webhook signing secret of each provider, keyed by provider name
+	PaymentWebhookSecrets map[string]string
+	// how far the signed timestamp of a webhook may be from now
+	PaymentWebhookTolerance time.Duration
+
+	// file that rejected webhooks and other security events are written to
+	SecurityLogPath string
+
+	// how long a reservation is held for payment before the tickets are released
+	ReservationHoldTimeout time.Duration
+	// standard price of showtimes nobody priced, in the smallest currency unit
+	DefaultTicketPrice int
+
+	// orders are written in batches of up to OrderBatchSize messages,
+	// a batch is written at the latest OrderBatchInterval after its first message arrived
+	OrderBatchSize     int
+	OrderBatchInterval time.Duration
+
+	// notifications: email goes through "file" (default, written to NotificationSinkPath) or "smtp",
+	// sms is always written to the sink for now
+	NotificationEmailTransport string
+	NotificationSMTPAddr       string
+	NotificationEmailFrom      string
+	NotificationSinkPath       string
+	// a notification is tried NotificationMaxAttempts times, NotificationRetryDelay apart
+	NotificationMaxAttempts int
+	NotificationRetryDelay  time.Duration
+
+	// secret the access tokens are signed with (HS256), the server refuses to start without one
+	AuthJWTSecret string
+	// how long an access token and a refresh token are valid
+	AuthAccessTokenTTL  time.Duration
+	AuthRefreshTokenTTL time.Duration
+
+	// how long the public catalog queries stay cached, the remaining tickets are always read live
+	CatalogCacheTTL time.Duration
+
+	// rate limits keyed by "route.scope", scope is "user" or "ip", see RateLimit
+	RateLimits map[string]RateLimit
+	// whether requests are let through when redis can't be asked, otherwise they get 503
+	RateLimitFailOpen bool
+	// proxies whose X-Forwarded-For is trusted for the client ip, none by default
+	TrustedProxies []string
+
+	// how long the response to an Idempotency-Key is kept for replays,
+	// and how long a duplicate waits for the first request with the key to finish
+	IdempotencyKeyTTL      time.Duration
+	IdempotencyWaitTimeout time.Duration
+
+	// challenge solved before reserving, "" (default, off), "pow", "captcha" or "captcha-local".
+	// Challenges are signed with ChallengeSecret and valid for ChallengeTTL,
+	// ChallengeDifficulty is the proof-of-work difficulty of showtimes it wasn't raised for
+	ChallengeMode       string
+	ChallengeSecret     string
+	ChallengeDifficulty int
+	ChallengeTTL        time.Duration
+	// captcha responses are checked at CaptchaVerifyURL, a siteverify style api, it's required by the captcha mode.
+	// The captcha-local mode uses the local stand-in instead, which accepts domain.LocalCaptchaResponse
+	CaptchaVerifyURL string
+	CaptchaSecret    string
+
+	// how long a graceful shutdown may take before connections are closed anyway
+	ShutdownTimeout time.Duration
 }
 
+// RateLimit lets Limit requests through per Period, as a token bucket refilled evenly over the period
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+const (
+	defaultShutdownTimeout         = 30 * time.Second
+	defaultReservationHoldTimeout  = 15 * time.Minute
+	defaultTicketPrice             = 4500
+	defaultPaymentWebhookTolerance = 5 * time.Minute
+	defaultSecurityLogPath         = "security.log"
+	defaultMockPaymentMinLatency   = 100 * time.Millisecond
+	defaultMockPaymentMaxLatency   = time.Second
+	defaultOrderBatchSize          = 100
+	defaultOrderBatchInterval      = 50 * time.Millisecond
+	defaultNotificationSMTPAddr    = "localhost:1025"
+	defaultNotificationEmailFrom   = "no-reply@flash-sale.local"
+	defaultNotificationSinkPath    = "notifications.log"
+	defaultNotificationMaxAttempts = 5
+	defaultNotificationRetryDelay  = 30 * time.Second
+	defaultAuthAccessTokenTTL      = 15 * time.Minute
+	defaultAuthRefreshTokenTTL     = 30 * 24 * time.Hour
+	defaultCatalogCacheTTL         = 5 * time.Second
+	defaultIdempotencyKeyTTL       = 24 * time.Hour
+	defaultIdempotencyWaitTimeout  = 10 * time.Second
+	defaultChallengeDifficulty     = 20
+	defaultChallengeTTL            = 2 * time.Minute
+	// the concurrency tests fire reserve from one ip, they run the server with reserve unlimited (make run-concurrency)
+	defaultRateLimits = "reserve.user=5/1s,reserve.ip=50/1s,login.ip=10/1m"
+)
+
 func LoadConfig() (*Config, error) {
 	if err := util.LoadEnv(); err != nil {
 		return nil, err
@@ -20,11 +136,267 @@ func LoadConfig() (*Config, error) {
 	databaseDSN := os.Getenv("DATABASE_DSN")
 	addr := os.Getenv("ADDR")
 	cacheURL := os.Getenv("CACHE_URL")
+	mqBackend := os.Getenv("MQ_BACKEND")
 	mqURL := os.Getenv("RABBIT_MQ_URL")
+	natsURL := os.Getenv("NATS_URL")
+	natsStoreDir := os.Getenv("NATS_STORE_DIR")
+	paymentProvider := os.Getenv("PAYMENT_PROVIDER")
+	paymentProviderURL := os.Getenv("PAYMENT_PROVIDER_URL")
+	mockPaymentDeclineRate, err := getFloat("MOCK_PAYMENT_DECLINE_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+	mockPaymentMinLatency, err := getDuration("MOCK_PAYMENT_MIN_LATENCY", defaultMockPaymentMinLatency)
+	if err != nil {
+		return nil, err
+	}
+	mockPaymentMaxLatency, err := getDuration("MOCK_PAYMENT_MAX_LATENCY", defaultMockPaymentMaxLatency)
+	if err != nil {
+		return nil, err
+	}
+	paymentStubAddr := os.Getenv("PAYMENT_STUB_ADDR")
+	paymentWebhookURL := os.Getenv("PAYMENT_WEBHOOK_URL")
+	paymentWebhookSecrets, err := getMap("PAYMENT_WEBHOOK_SECRETS")
+	if err != nil {
+		return nil, err
+	}
+	paymentWebhookTolerance, err := getDuration("PAYMENT_WEBHOOK_TOLERANCE", defaultPaymentWebhookTolerance)
+	if err != nil {
+		return nil, err
+	}
+	securityLogPath := getString("SECURITY_LOG_PATH", defaultSecurityLogPath)
+	reservationHoldTimeout, err := getDuration("RESERVATION_HOLD_TIMEOUT", defaultReservationHoldTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ticketPrice, err := getInt("DEFAULT_TICKET_PRICE", defaultTicketPrice)
+	if err != nil {
+		return nil, err
+	}
+	if ticketPrice < 0 {
+		return nil, fmt.Errorf("invalid DEFAULT_TICKET_PRICE: %d is negative", ticketPrice)
+	}
+	orderBatchSize, err := getInt("ORDER_BATCH_SIZE", defaultOrderBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	orderBatchInterval, err := getDuration("ORDER_BATCH_INTERVAL", defaultOrderBatchInterval)
+	if err != nil {
+		return nil, err
+	}
+	notificationEmailTransport := os.Getenv("NOTIFICATION_EMAIL_TRANSPORT")
+	notificationSMTPAddr := getString("NOTIFICATION_SMTP_ADDR", defaultNotificationSMTPAddr)
+	notificationEmailFrom := getString("NOTIFICATION_EMAIL_FROM", defaultNotificationEmailFrom)
+	notificationSinkPath := getString("NOTIFICATION_SINK_PATH", defaultNotificationSinkPath)
+	notificationMaxAttempts, err := getInt("NOTIFICATION_MAX_ATTEMPTS", defaultNotificationMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	notificationRetryDelay, err := getDuration("NOTIFICATION_RETRY_DELAY", defaultNotificationRetryDelay)
+	if err != nil {
+		return nil, err
+	}
+	authJWTSecret := os.Getenv("AUTH_JWT_SECRET")
+	authAccessTokenTTL, err := getDuration("AUTH_ACCESS_TOKEN_TTL", defaultAuthAccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	authRefreshTokenTTL, err := getDuration("AUTH_REFRESH_TOKEN_TTL", defaultAuthRefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	catalogCacheTTL, err := getDuration("CATALOG_CACHE_TTL", defaultCatalogCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := getRateLimits("RATE_LIMITS", defaultRateLimits)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitFailOpen := getString("RATE_LIMIT_FAIL_OPEN", "true") == "true"
+	trustedProxies := getList("TRUSTED_PROXIES")
+	idempotencyKeyTTL, err := getDuration("IDEMPOTENCY_KEY_TTL", defaultIdempotencyKeyTTL)
+	if err != nil {
+		return nil, err
+	}
+	idempotencyWaitTimeout, err := getDuration("IDEMPOTENCY_WAIT_TIMEOUT", defaultIdempotencyWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	challengeMode := os.Getenv("CHALLENGE_MODE")
+	challengeSecret := os.Getenv("CHALLENGE_SECRET")
+	challengeDifficulty, err := getInt("CHALLENGE_DIFFICULTY", defaultChallengeDifficulty)
+	if err != nil {
+		return nil, err
+	}
+	challengeTTL, err := getDuration("CHALLENGE_TTL", defaultChallengeTTL)
+	if err != nil {
+		return nil, err
+	}
+	captchaVerifyURL := os.Getenv("CAPTCHA_VERIFY_URL")
+	captchaSecret := os.Getenv("CAPTCHA_SECRET")
+	shutdownTimeout, err := getDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+	if err != nil {
+		return nil, err
+	}
 	return &Config{
-		DatabaseDSN: databaseDSN,
-		Addr:        addr,
-		CacheURL:    cacheURL,
-		MQURL:       mqURL,
+		DatabaseDSN:  databaseDSN,
+		Addr:         addr,
+		CacheURL:     cacheURL,
+		MQBackend:    mqBackend,
+		MQURL:        mqURL,
+		NATSURL:      natsURL,
+		NATSStoreDir: natsStoreDir,
+
+		PaymentProvider:        paymentProvider,
+		PaymentProviderURL:     paymentProviderURL,
+		MockPaymentDeclineRate: mockPaymentDeclineRate,
+		MockPaymentMinLatency:  mockPaymentMinLatency,
+		MockPaymentMaxLatency:  mockPaymentMaxLatency,
+		PaymentStubAddr:        paymentStubAddr,
+		PaymentWebhookURL:      paymentWebhookURL,
+
+		PaymentWebhookSecrets:   paymentWebhookSecrets,
+		PaymentWebhookTolerance: paymentWebhookTolerance,
+		SecurityLogPath:         securityLogPath,
+
+		ReservationHoldTimeout: reservationHoldTimeout,
+		DefaultTicketPrice:     ticketPrice,
+
+		OrderBatchSize:     orderBatchSize,
+		OrderBatchInterval: orderBatchInterval,
+
+		NotificationEmailTransport: notificationEmailTransport,
+		NotificationSMTPAddr:       notificationSMTPAddr,
+		NotificationEmailFrom:      notificationEmailFrom,
+		NotificationSinkPath:       notificationSinkPath,
+		NotificationMaxAttempts:    notificationMaxAttempts,
+		NotificationRetryDelay:     notificationRetryDelay,
+
+		AuthJWTSecret:       authJWTSecret,
+		AuthAccessTokenTTL:  authAccessTokenTTL,
+		AuthRefreshTokenTTL: authRefreshTokenTTL,
+
+		CatalogCacheTTL: catalogCacheTTL,
+
+		RateLimits:        rateLimits,
+		RateLimitFailOpen: rateLimitFailOpen,
+		TrustedProxies:    trustedProxies,
+
+		IdempotencyKeyTTL:      idempotencyKeyTTL,
+		IdempotencyWaitTimeout: idempotencyWaitTimeout,
+
+		ChallengeMode:       challengeMode,
+		ChallengeSecret:     challengeSecret,
+		ChallengeDifficulty: challengeDifficulty,
+		ChallengeTTL:        challengeTTL,
+		CaptchaVerifyURL:    captchaVerifyURL,
+		CaptchaSecret:       captchaSecret,
+
+		ShutdownTimeout: shutdownTimeout,
 	}, nil
 }
+
+// getDuration parses an env like "30s" or "1m", returning def if it's not set
+func getDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func getFloat(key string, def float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func getInt(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func getString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// getMap parses an env like "a=1,b=2"
+func getMap(key string) (map[string]string, error) {
+	return parseMap(key, os.Getenv(key))
+}
+
+func parseMap(key string, value string) (map[string]string, error) {
+	m := make(map[string]string)
+	if value == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid %s: %q is not key=value", key, pair)
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// getRateLimits parses an env like "reserve.user=5/1s,reserve.ip=50/1s", returning the limits of def if it's not set
+func getRateLimits(key string, def string) (map[string]RateLimit, error) {
+	m, err := parseMap(key, getString(key, def))
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make(map[string]RateLimit, len(m))
+	for name, value := range m {
+		count, period, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %q is not count/period", key, value)
+		}
+		limit, err := strconv.Atoi(count)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid %s: count of %s must be a positive integer", key, name)
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s: period of %s must be a positive duration", key, name)
+		}
+		limits[name] = RateLimit{
+			Limit:  limit,
+			Period: d,
+		}
+	}
+	return limits, nil
+}
+
+// getList parses an env like "a,b"
+func getList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetRateLimits(t *testing.T) {
+	t.Setenv("RATE_LIMITS", "reserve.user=5/1s, login.ip=10/1m")
+
+	limits, err := getRateLimits("RATE_LIMITS", "")
+	if err != nil {
+		t.Fatalf("Failed to parse rate limits: %v", err)
+	}
+	if limits["reserve.user"] != (RateLimit{Limit: 5, Period: time.Second}) {
+		t.Errorf("Unexpected reserve.user limit %+v", limits["reserve.user"])
+	}
+	if limits["login.ip"] != (RateLimit{Limit: 10, Period: time.Minute}) {
+		t.Errorf("Unexpected login.ip limit %+v", limits["login.ip"])
+	}
+}
+
+func TestGetRateLimits_Default(t *testing.T) {
+	t.Setenv("RATE_LIMITS", "")
+
+	limits, err := getRateLimits("RATE_LIMITS", "login.ip=10/1m")
+	if err != nil {
+		t.Fatalf("Failed to parse rate limits: %v", err)
+	}
+	if len(limits) != 1 || limits["login.ip"].Limit != 10 {
+		t.Errorf("Expected the default limits, got %+v", limits)
+	}
+}
+
+func TestDefaultRateLimits(t *testing.T) {
+	t.Setenv("RATE_LIMITS", "")
+
+	limits, err := getRateLimits("RATE_LIMITS", defaultRateLimits)
+	if err != nil {
+		t.Fatalf("Failed to parse the default rate limits: %v", err)
+	}
+	for _, name := range []string{"reserve.user", "reserve.ip", "login.ip"} {
+		if _, ok := limits[name]; !ok {
+			t.Errorf("Expected %s to be limited by default, got %+v", name, limits)
+		}
+	}
+}
+
+func TestGetRateLimits_Invalid(t *testing.T) {
+	for _, value := range []string{"reserve.user=5", "reserve.user=0/1s", "reserve.user=5/soon", "reserve.user=5/-1s"} {
+		t.Setenv("RATE_LIMITS", value)
+		if _, err := getRateLimits("RATE_LIMITS", ""); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
@@ -1,14 +1,21 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"log"
+
 	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/auth"
 	"github.com/qs-lzh/flash-sale/internal/cache"
 	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
 	"github.com/qs-lzh/flash-sale/internal/repository"
 	"github.com/qs-lzh/flash-sale/internal/service/domain"
 	"github.com/qs-lzh/flash-sale/internal/service/workflow"
+	"github.com/qs-lzh/flash-sale/internal/util"
 
-	amqp "github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
@@ -19,51 +26,149 @@ type App struct {
 	DB     *gorm.DB
 	Cache  *cache.RedisCache
 	Logger *zap.Logger
-	MQConn *amqp.Connection
+	// rejected webhooks and other security events
+	SecurityLogger *zap.Logger
+	Broker         mq.Broker
+	// reservation state changes pushed to the customers' open streams
+	ReservationEvents *realtime.Hub
 
 	UserRepo     *repository.UserRepo
 	MovieRepo    *repository.MovieRepo
 	ShowtimeRepo *repository.ShowtimeRepo
 
-	MovieService       domain.MovieService
-	ShowtimeService    domain.ShowtimeService
-	ReservationService domain.ReservationService
-	OrderService       domain.OrderService
-	PaymentService     domain.PaymentService
+	// signs and verifies the access tokens
+	Tokens *auth.TokenManager
+
+	UserService         domain.UserService
+	MovieService        domain.MovieService
+	ShowtimeService     domain.ShowtimeService
+	ReservationService  domain.ReservationService
+	OrderService        domain.OrderService
+	PaymentService      domain.PaymentService
+	PriceService        domain.PriceService
+	PromoService        domain.PromoService
+	PaymentProvider     domain.PaymentProvider
+	NotificationService domain.NotificationService
+	AuditService        domain.AuditService
+	InventoryService    domain.InventoryService
+	// compares redis with the orders, for admins
+	ReconciliationService domain.ReconciliationService
+	// public listings of movies and showtimes
+	CatalogService domain.CatalogService
+	// orders with the reservations still pending in redis
+	OrderHistoryService domain.OrderHistoryService
+	// challenges solved before reserving, when they're turned on
+	ChallengeService domain.ChallengeService
 
-	ReservationWorkflow *workflow.ReservationWorkflow
-	PaymentWorkflow     *workflow.PaymentWorkflow
-	OrderWorkflow       *workflow.OrderWorkflow
+	MessageDeduplicator  *workflow.MessageDeduplicator
+	ReservationWorkflow  *workflow.ReservationWorkflow
+	PaymentWorkflow      *workflow.PaymentWorkflow
+	OrderWorkflow        *workflow.OrderWorkflow
+	NotificationWorkflow *workflow.NotificationWorkflow
 }
 
-func New(config *config.Config, db *gorm.DB, cache *cache.RedisCache, mqConn *amqp.Connection) *App {
+func New(config *config.Config, db *gorm.DB, cache *cache.RedisCache, broker mq.Broker) *App {
+	userRepo := repository.NewUserRepoGorm(db)
 	movieRepo := repository.NewMovieRepoGorm(db)
 	showtimeRepo := repository.NewShowtimeRepoGorm(db)
 	orderRepo := repository.NewOrderRepoGorm(db)
+	priceRepo := repository.NewShowtimePriceRepoGorm(db)
+	promoRepo := repository.NewPromoCodeRepoGorm(db)
+	notificationPreferenceRepo := repository.NewNotificationPreferenceRepoGorm(db)
+	auditLogRepo := repository.NewAuditLogRepoGorm(db)
+	refreshTokenRepo := repository.NewRefreshTokenRepoGorm(db)
+
+	tokens := auth.NewTokenManager(config.AuthJWTSecret, config.AuthAccessTokenTTL)
+	userService := domain.NewUserService(db, userRepo, refreshTokenRepo, tokens, config.AuthRefreshTokenTTL)
+	showtimeService := domain.NewShowtimeService(db, cache, showtimeRepo, movieRepo, orderRepo, priceRepo,
+		config.DefaultTicketPrice)
+	priceService := domain.NewPriceService(db, cache, priceRepo, config.DefaultTicketPrice)
+	promoService := domain.NewPromoService(db, cache, promoRepo, orderRepo, showtimeService)
+	reservationService := domain.NewReservationService(cache, priceService, promoService, orderRepo, config.ReservationHoldTimeout)
+	movieService := domain.NewMovieService(db, movieRepo, orderRepo, showtimeService)
+	auditService := domain.NewAuditService(auditLogRepo)
+	inventoryService := domain.NewInventoryService(cache, showtimeService)
+	catalogService := domain.NewCatalogService(cache, movieRepo, showtimeRepo, config.CatalogCacheTTL)
+	orderHistoryService := domain.NewOrderHistoryService(cache, orderRepo, showtimeRepo, movieRepo)
+
+	var challengeVerifier domain.ChallengeVerifier = domain.NewProofOfWorkVerifier()
+	switch config.ChallengeMode {
+	case domain.ChallengeModeCaptcha:
+		challengeVerifier = domain.NewHTTPCaptchaVerifier(config.CaptchaVerifyURL, config.CaptchaSecret)
+	case domain.ChallengeModeCaptchaLocal:
+		challengeVerifier = domain.NewLocalCaptchaVerifier()
+	}
+	challengeService := domain.NewChallengeService(cache, showtimeService, config.ChallengeMode, config.ChallengeSecret,
+		challengeVerifier, config.ChallengeDifficulty, config.ChallengeTTL)
+
+	// the mock provider reports results in the process, straight to the payment workflow
+	var paymentWorkflow *workflow.PaymentWorkflow
+	var paymentProvider domain.PaymentProvider
+	switch config.PaymentProvider {
+	case domain.PaymentProviderLocal:
+		paymentProvider = domain.NewHTTPPaymentProvider(domain.PaymentProviderLocal, config.PaymentProviderURL)
+	default:
+		paymentProvider = domain.NewMockPaymentProvider(func(event domain.PaymentEvent) error {
+			return paymentWorkflow.HandlePaymentEvent(event)
+		}, domain.MockPaymentOptions{
+			DeclineRate: config.MockPaymentDeclineRate,
+			MinLatency:  config.MockPaymentMinLatency,
+			MaxLatency:  config.MockPaymentMaxLatency,
+		})
+	}
+	paymentService := domain.NewPaymentService(cache, paymentProvider)
+	orderService := domain.NewOrderService(db, cache, orderRepo, showtimeService, paymentProvider)
+	reconciliationService := domain.NewReconciliationService(cache, orderRepo, showtimeService, orderService)
+
+	// sms has no real provider yet, it always goes to the sink
+	sink := notification.NewFileSink(config.NotificationSinkPath)
+	emailChannel := sink.Channel(notification.ChannelEmail)
+	if config.NotificationEmailTransport == notification.EmailTransportSMTP {
+		emailChannel = notification.NewSMTPEmailChannel(config.NotificationSMTPAddr, config.NotificationEmailFrom)
+	}
+	notificationService := domain.NewNotificationService(db, notificationPreferenceRepo,
+		emailChannel, sink.Channel(notification.ChannelSMS))
 
-	showtimeService := domain.NewShowtimeService(db, showtimeRepo)
-	reservationService := domain.NewReservationService(cache)
-	orderService := domain.NewOrderService(db, cache, orderRepo)
-	movieService := domain.NewMovieService(db, movieRepo, showtimeService)
-	paymentService := domain.NewPaymentService(cache)
+	dedup := workflow.NewMessageDeduplicator(cache, workflow.DefaultProcessedMessageTTL)
+	reservationEvents := realtime.NewHub(cache)
 
-	reservationWorkflow := workflow.NewReservationWorkflow(reservationService, mqConn)
-	paymentWorkflow := workflow.NewPaymentWorkflow(paymentService, mqConn)
-	orderWorkflow := workflow.NewOrderWorkflow(cache, orderService)
+	notificationWorkflow := workflow.NewNotificationWorkflow(notificationService, broker, dedup, config.NotificationMaxAttempts)
+	reservationWorkflow := workflow.NewReservationWorkflow(reservationService, broker, notificationWorkflow)
+	paymentWorkflow = workflow.NewPaymentWorkflow(paymentService, broker, dedup, notificationWorkflow, reservationEvents)
+	orderWorkflow := workflow.NewOrderWorkflow(cache, orderService, broker, dedup, workflow.OrderBatchOptions{
+		Size:     config.OrderBatchSize,
+		Interval: config.OrderBatchInterval,
+	}, notificationWorkflow, reservationEvents)
 
 	return &App{
-		Config:              config,
-		DB:                  db,
-		Cache:               cache,
-		MQConn:              mqConn,
-		MovieService:        movieService,
-		ShowtimeService:     showtimeService,
-		ReservationService:  reservationService,
-		OrderService:        orderService,
-		PaymentService:      paymentService,
-		ReservationWorkflow: reservationWorkflow,
-		PaymentWorkflow:     paymentWorkflow,
-		OrderWorkflow:       orderWorkflow,
+		Config:                config,
+		SecurityLogger:        newSecurityLogger(config.SecurityLogPath),
+		DB:                    db,
+		Cache:                 cache,
+		Broker:                broker,
+		ReservationEvents:     reservationEvents,
+		Tokens:                tokens,
+		UserService:           userService,
+		MovieService:          movieService,
+		ShowtimeService:       showtimeService,
+		ReservationService:    reservationService,
+		OrderService:          orderService,
+		PaymentService:        paymentService,
+		PriceService:          priceService,
+		PromoService:          promoService,
+		PaymentProvider:       paymentProvider,
+		NotificationService:   notificationService,
+		AuditService:          auditService,
+		InventoryService:      inventoryService,
+		ReconciliationService: reconciliationService,
+		CatalogService:        catalogService,
+		OrderHistoryService:   orderHistoryService,
+		ChallengeService:      challengeService,
+		MessageDeduplicator:   dedup,
+		ReservationWorkflow:   reservationWorkflow,
+		PaymentWorkflow:       paymentWorkflow,
+		OrderWorkflow:         orderWorkflow,
+		NotificationWorkflow:  notificationWorkflow,
 	}
 }
 
@@ -75,25 +180,112 @@ func (app *App) Init() error {
 		return err
 	}
 	for _, showtime := range showtimes {
-		showtimeIDTicketsMap[showtime.ID] = 100 // 100 tickets
+		showtimeIDTicketsMap[showtime.ID] = showtime.Capacity
 	}
 	if err := app.Cache.Init(showtimeIDTicketsMap); err != nil {
 		return err
 	}
+	if err := app.PriceService.LoadPrices(); err != nil {
+		return err
+	}
+	if err := app.PromoService.LoadUsage(); err != nil {
+		return err
+	}
 
-	// init rabbit mq
-	mq.InitQueues(app.MQConn)
+	// init message queues
+	if err := app.Broker.Setup(); err != nil {
+		return err
+	}
 
-	app.PaymentWorkflow.Start(app.MQConn)
-	app.OrderWorkflow.Start(app.MQConn)
+	if err := app.ReservationEvents.Start(); err != nil {
+		return err
+	}
+
+	if err := app.PaymentWorkflow.Start(); err != nil {
+		return err
+	}
+	if err := app.OrderWorkflow.Start(); err != nil {
+		return err
+	}
+	if err := app.NotificationWorkflow.Start(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// Shutdown drains the workflows and then releases every connection.
+// The http server must have stopped accepting requests before it's called.
+// If ctx expires while draining, the connections are closed anyway.
+func (app *App) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	// stop receiving new messages, and wait for the handlers to ack the ones they got.
+	// handlers publish their follow-up messages synchronously before returning,
+	// so nothing is left to flush once they are done
+	if err := app.Broker.StopConsuming(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := app.PaymentWorkflow.Wait(ctx); err != nil {
+		log.Printf("Payment workflow not drained: %v", err)
+		errs = append(errs, err)
+	}
+	// payments reported in the process must reach the payment workflow before the mq is closed
+	if provider, ok := app.PaymentProvider.(interface{ Wait() }); ok {
+		if err := util.WaitContext(ctx, provider.Wait); err != nil {
+			log.Printf("Payments in progress not finished: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	if err := app.OrderWorkflow.Wait(ctx); err != nil {
+		log.Printf("Order workflow not drained: %v", err)
+		errs = append(errs, err)
+	}
+	if err := app.NotificationWorkflow.Wait(ctx); err != nil {
+		log.Printf("Notification workflow not drained: %v", err)
+		errs = append(errs, err)
+	}
+
+	if err := app.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Close ends the event streams and closes redis, the mq broker and postgres in order
 func (app *App) Close() error {
+	var errs []error
+
+	app.SecurityLogger.Sync()
+	app.ReservationEvents.Close()
+
+	if err := app.Cache.Client.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := app.Broker.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
 	sqlDB, err := app.DB.DB()
 	if err != nil {
-		return err
+		errs = append(errs, err)
+	} else if err := sqlDB.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// newSecurityLogger writes json lines to path, falling back to stderr if the file can't be opened
+func newSecurityLogger(path string) *zap.Logger {
+	cfg := zap.NewProductionConfig()
+	cfg.OutputPaths = []string{path}
+	cfg.Sampling = nil
+	logger, err := cfg.Build()
+	if err != nil {
+		log.Printf("Failed to open security log %s, logging to stderr: %v", path, err)
+		cfg.OutputPaths = []string{"stderr"}
+		logger, _ = cfg.Build()
 	}
-	return sqlDB.Close()
+	return logger.Named("security")
 }
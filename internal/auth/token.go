@@ -0,0 +1,106 @@
+// Package auth issues and verifies the tokens users authenticate with.
+// Access tokens are short-lived JWTs signed with HS256, refresh tokens are random strings
+// the server keeps a hash of, so they can be rotated and revoked.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+// issuer of the access tokens
+const issuer = "flash-sale"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of an access token, the subject is the user id
+type Claims struct {
+	Role model.UserRole `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user the token was issued to
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%w: bad subject %q", ErrInvalidToken, c.Subject)
+	}
+	return uint(id), nil
+}
+
+// TokenManager signs and verifies access tokens
+type TokenManager struct {
+	secret    []byte
+	accessTTL time.Duration
+}
+
+func NewTokenManager(secret string, accessTTL time.Duration) *TokenManager {
+	return &TokenManager{
+		secret:    []byte(secret),
+		accessTTL: accessTTL,
+	}
+}
+
+// IssueAccessToken returns a signed access token for the user and when it expires
+func (m *TokenManager) IssueAccessToken(userID uint, role model.UserRole) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.accessTTL)
+	claims := Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// ParseAccessToken verifies the signature, issuer and expiry of an access token
+func (m *TokenManager) ParseAccessToken(token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return m.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// NewRefreshToken returns a random refresh token, only its hash is stored
+func NewRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashRefreshToken returns the hex sha-256 of a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+func TestTokenManager_IssueAndParse(t *testing.T) {
+	m := NewTokenManager("secret", time.Minute)
+
+	token, expiresAt, err := m.IssueAccessToken(42, model.RoleAdmin)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if time.Until(expiresAt) > time.Minute {
+		t.Errorf("Expected expiry within a minute, got %v", expiresAt)
+	}
+
+	claims, err := m.ParseAccessToken(token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	userID, err := claims.UserID()
+	if err != nil || userID != 42 {
+		t.Errorf("Expected user 42, got %d (%v)", userID, err)
+	}
+	if claims.Role != model.RoleAdmin {
+		t.Errorf("Expected role %s, got %s", model.RoleAdmin, claims.Role)
+	}
+}
+
+func TestTokenManager_RejectsInvalidTokens(t *testing.T) {
+	m := NewTokenManager("secret", time.Minute)
+
+	otherSecret, _, _ := NewTokenManager("other", time.Minute).IssueAccessToken(1, model.RoleUser)
+	expired, _, _ := NewTokenManager("secret", -time.Minute).IssueAccessToken(1, model.RoleUser)
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   "1",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	noSubject, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}).SignedString([]byte("secret"))
+
+	for name, token := range map[string]string{
+		"other secret": otherSecret,
+		"expired":      expired,
+		"unsigned":     unsigned,
+		"no subject":   noSubject,
+		"garbage":      "not.a.token",
+	} {
+		if _, err := m.ParseAccessToken(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+}
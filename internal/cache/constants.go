@@ -15,7 +15,31 @@ const (
 
 	ShowtimeRemainingTicketsKey = "showtime:%d:ticket:remain" // key of remaining tickets of a showtime, '%d' is showtime id
 
+	ShowtimePriceKey = "showtime:%d:price:%s" // key of the price of a ticket category, '%d' is showtime id, '%s' is the category
+
 	UserShowtimeOrderedKey = "user:%d:showtime:%d:ordered" // key of a user's reservation to a showtime, first '%d' is user id, second '%d' is showtime id
+
+	PromoCodeKey     = "promo:%s"              // key of a cached promo code, '%s' is the code
+	PromoUsedKey     = "promo:%s:used"         // key of how often a promo code is used, '%s' is the code
+	PromoUserUsedKey = "promo:%s:user:%d:used" // key of how often a user used a promo code, '%s' is the code, '%d' is user id
+
+	ProcessedMessageKey = "mq:processed:%s:%s" // key of a handled mq message, first '%s' is queue name, second '%s' is message id
+
+	PaymentWebhookEventKey = "payment:webhook:%s:%s" // key of a received payment webhook event, first '%s' is provider name, second '%s' is event id
+
+	ReservationEventsChannel = "reservation:events" // pub/sub channel of reservation state changes, a constant
+
+	UserReservationsKey     = "user:%d:reservations"     // sorted set of a user's reservation ids scored by id, '%d' is user id
+	ShowtimeReservationsKey = "showtime:%d:reservations" // sorted set of a showtime's reservation ids scored by id, '%d' is showtime id
+
+	RateLimitKey = "ratelimit:%s:%s" // key of a rate limit token bucket, first '%s' is the route and scope, second '%s' is the user id or ip
+
+	IdempotencyKey = "idempotency:%s:%s" // key of the response to an Idempotency-Key, first '%s' is the route and owner, second '%s' is the client's key
+
+	CatalogQueryKey = "catalog:%s" // key of a cached public catalog query, '%s' identifies the query and its parameters
+
+	ChallengeUsedKey               = "challenge:%s:used"                // key of a reserve challenge that was solved, '%s' is the challenge id
+	ShowtimeChallengeDifficultyKey = "showtime:%d:challenge:difficulty" // key of the proof-of-work difficulty raised for a showtime, '%d' is showtime id
 )
 
 func MakeReservationKey(reservationID uint) string {
@@ -26,31 +50,136 @@ func MakeShowtimeRemainingTicketsKey(showtimeID uint) string {
 	return fmt.Sprintf("showtime:%d:ticket:remain", showtimeID)
 }
 
+func MakeShowtimePriceKey(showtimeID uint, category string) string {
+	return fmt.Sprintf("showtime:%d:price:%s", showtimeID, category)
+}
+
 func MakeUserShowtimeOrderedKey(userID uint, showtimeID uint) string {
 	return fmt.Sprintf("user:%d:showtime:%d:ordered", userID, showtimeID)
 }
 
+func MakePromoCodeKey(code string) string {
+	return fmt.Sprintf("promo:%s", code)
+}
+
+func MakePromoUsedKey(code string) string {
+	return fmt.Sprintf("promo:%s:used", code)
+}
+
+func MakePromoUserUsedKey(code string, userID uint) string {
+	return fmt.Sprintf("promo:%s:user:%d:used", code, userID)
+}
+
+func MakePaymentWebhookEventKey(provider string, eventID string) string {
+	return fmt.Sprintf("payment:webhook:%s:%s", provider, eventID)
+}
+
+func MakeProcessedMessageKey(queueName string, messageID string) string {
+	return fmt.Sprintf("mq:processed:%s:%s", queueName, messageID)
+}
+
+func MakeUserReservationsKey(userID uint) string {
+	return fmt.Sprintf("user:%d:reservations", userID)
+}
+
+func MakeShowtimeReservationsKey(showtimeID uint) string {
+	return fmt.Sprintf("showtime:%d:reservations", showtimeID)
+}
+
+func MakeRateLimitKey(route string, subject string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", route, subject)
+}
+
+func MakeIdempotencyKey(scope string, key string) string {
+	return fmt.Sprintf("idempotency:%s:%s", scope, key)
+}
+
+func MakeCatalogQueryKey(query string) string {
+	return fmt.Sprintf("catalog:%s", query)
+}
+
+func MakeChallengeUsedKey(challengeID string) string {
+	return fmt.Sprintf("challenge:%s:used", challengeID)
+}
+
+func MakeShowtimeChallengeDifficultyKey(showtimeID uint) string {
+	return fmt.Sprintf("showtime:%d:challenge:difficulty", showtimeID)
+}
+
 // struct definitions
 // the data put into redis in lua script should follow the struct
 type ReservationCacheValue struct {
-	ShowtimeID uint              `redis:"showtime_id"`
-	SeatID     uint              `redis:"seat_id"`
-	UserID     uint              `redis:"user_id"`
-	Status     ReservationStatus `redis:"status"`
+	ShowtimeID      uint              `redis:"showtime_id"`
+	SeatID          uint              `redis:"seat_id"`
+	UserID          uint              `redis:"user_id"`
+	Status          ReservationStatus `redis:"status"`
+	Token           string            `redis:"token"`             // secret the customer pays the reservation with
+	ReservedAt      int64             `redis:"reserved_at"`       // unix seconds when the ticket was reserved
+	ExpiresAt       int64             `redis:"expires_at"`        // unix seconds when the hold times out
+	Category        string            `redis:"category"`          // ticket category
+	Amount          int               `redis:"amount"`            // price locked at reserve time, in the smallest currency unit
+	Currency        string            `redis:"currency"`          // currency of the locked price
+	PromoCode       string            `redis:"promo_code"`        // promo code claimed with the reservation
+	Discount        int               `redis:"discount"`          // amount the promo code took off, Amount is what's left to pay
+	PaymentPending  bool              `redis:"payment_pending"`   // set when the customer asks to pay, the reservation can't be cancelled anymore
+	PaymentClaimed  bool              `redis:"payment_claimed"`   // set by the payment message that creates the intent
+	PaymentIntentID string            `redis:"payment_intent_id"` // set once the payment is started
+	PaidAt          int64             `redis:"paid_at"`           // unix seconds when the payment was confirmed
+	LatePayment     bool              `redis:"late_payment"`      // the payment succeeded after the hold expired
+}
+
+// IdempotencyRecord is the request made with an Idempotency-Key and, once it's finished, its response
+type IdempotencyRecord struct {
+	// hash of the request, the key can't be reused for another request
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// PromoClaim is the use of a promo code claimed together with a reservation
+type PromoClaim struct {
+	Code     string
+	Discount int
+	// caps checked by the claim, 0 means unlimited
+	MaxUses        int
+	MaxUsesPerUser int
+}
+
+// ShowtimePriceCacheValue is the cached price of a ticket category of a showtime
+type ShowtimePriceCacheValue struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+	// the showtime doesn't sell the category, cached so unpriced showtimes don't hit the database
+	NotFound bool `json:"not_found,omitempty"`
 }
 
 type ReservationStatus string
 
 var (
-	ReservationStatusReserved ReservationStatus = "RESERVED"
-	ReservationStatusPaid     ReservationStatus = "PAID"
-	ReservationStatusTimeout  ReservationStatus = "TIMEOUT"
+	ReservationStatusReserved  ReservationStatus = "RESERVED"
+	ReservationStatusPaid      ReservationStatus = "PAID"
+	ReservationStatusTimeout   ReservationStatus = "TIMEOUT"
+	ReservationStatusFailed    ReservationStatus = "FAILED"
+	ReservationStatusRefunded  ReservationStatus = "REFUNDED"
+	ReservationStatusCancelled ReservationStatus = "CANCELLED"
 )
 
 // errors
 var (
 	ErrSoldOut        = errors.New("Tickets sold out")
 	ErrAlreadyOrdered = errors.New("User already ordered this showtime")
+
+	ErrPromoExhausted     = errors.New("promo code is used up")
+	ErrPromoUserExhausted = errors.New("user used up the promo code")
+
+	ErrCacheMiss = errors.New("cache miss")
+
+	ErrNotEnoughTickets = errors.New("fewer tickets remain than would be removed")
+
+	ErrReservationNotFound      = errors.New("reservation not found")
+	ErrInvalidReservationStatus = errors.New("invalid reservation status")
 )
 
 // lua scripts
@@ -68,9 +197,21 @@ var reserveTicketScript = redis.NewScript(`
 	-- KEYS[1] = showtime:{showtime_id}:ticket:remain
 	-- KEYS[2] = reservation:id:seq
 	-- KEYS[3] = user:{user_id}:showtime:{showtime_id}:ordered
+	-- KEYS[4] = user:{user_id}:reservations
+	-- KEYS[5] = showtime:{showtime_id}:reservations
 
 	-- ARGV[1] = showtime_id
 	-- ARGV[2] = user_id
+	-- ARGV[3] = token
+	-- ARGV[4] = expires_at
+	-- ARGV[5] = reserved_at
+	-- ARGV[6] = category
+	-- ARGV[7] = amount
+	-- ARGV[8] = currency
+	-- ARGV[9] = promo_code, empty if none
+	-- ARGV[10] = discount
+	-- ARGV[11] = max uses of the promo code, 0 is unlimited
+	-- ARGV[12] = max uses of the promo code per user, 0 is unlimited
 
 	-- 检查用户是否已经订过该场次的票
 	local userOrderedKey = KEYS[3]
@@ -85,9 +226,31 @@ var reserveTicketScript = redis.NewScript(`
 		return -1  -- 表示售罄
 	end
 
+	-- 检查优惠码剩余次数
+	local promo = ARGV[9]
+	local promoUsedKey, promoUserUsedKey
+	if promo ~= "" then
+		promoUsedKey = "promo:" .. promo .. ":used"
+		promoUserUsedKey = "promo:" .. promo .. ":user:" .. ARGV[2] .. ":used"
+		local maxUses = tonumber(ARGV[11])
+		if maxUses > 0 and (tonumber(redis.call("GET", promoUsedKey)) or 0) >= maxUses then
+			return -4  -- 表示优惠码已用完
+		end
+		local maxUsesPerUser = tonumber(ARGV[12])
+		if maxUsesPerUser > 0 and (tonumber(redis.call("GET", promoUserUsedKey)) or 0) >= maxUsesPerUser then
+			return -5  -- 表示用户已用完优惠码
+		end
+	end
+
 	-- 扣库存
 	redis.call("DECR", KEYS[1])
 
+	-- 占用优惠码
+	if promo ~= "" then
+		redis.call("INCR", promoUsedKey)
+		redis.call("INCR", promoUserUsedKey)
+	end
+
 	-- 生成 reservation_id
 	local id = redis.call("INCR", KEYS[2])
 
@@ -97,38 +260,119 @@ var reserveTicketScript = redis.NewScript(`
 	redis.call("HSET", resKey,
 		"showtime_id", ARGV[1],
 		"user_id", ARGV[2],
-		"status", "RESERVED"
+		"status", "RESERVED",
+		"token", ARGV[3],
+		"expires_at", ARGV[4],
+		"reserved_at", ARGV[5],
+		"category", ARGV[6],
+		"amount", ARGV[7],
+		"currency", ARGV[8],
+		"promo_code", promo,
+		"discount", ARGV[10]
 	)
 
 	-- 标记用户已订单 (无过期时间，永久有效)
 	redis.call("SET", userOrderedKey, "true")
 
+	-- 加入用户和场次的 reservation 索引
+	redis.call("ZADD", KEYS[4], id, id)
+	redis.call("ZADD", KEYS[5], id, id)
+
 	return id
 `)
 
 var markTicketAsPaidScript = redis.NewScript(`
 	-- KEYS[1] = reservation:{reservation_id}
 
+	-- ARGV[1] = paid_at
+
+	-- returns 1 paid, 2 paid after the hold expired or the reservation was cancelled, 0 or 3 if it was already paid (late for 3),
+	-- -1 if the ticket was released and the showtime is sold out, -2 for any other status
+
 	local resKey = KEYS[1]
 	local status = redis.call("HGET", resKey, "status")
-	if not status or status ~= "RESERVED" then
+	-- 重复消息：已经支付过
+	if status == "PAID" then
+		if redis.call("HGET", resKey, "late_payment") == "1" then
+			return 3
+		end
+		return 0
+	end
+	if status == "RESERVED" then
+		redis.call("HSET", resKey, "status", "PAID", "paid_at", ARGV[1])
+		return 1
+	end
+	if status ~= "TIMEOUT" and status ~= "CANCELLED" then
 		return -2
 	end
 
-	redis.call("HSET", resKey, "status", "PAID")
+	-- 超时或取消后才支付成功：还有票时重新占用库存
+	local showtime_id = redis.call("HGET", resKey, "showtime_id")
+	local user_id = redis.call("HGET", resKey, "user_id")
+	local remainKey = "showtime:" .. showtime_id .. ":ticket:remain"
+	local remain = tonumber(redis.call("GET", remainKey))
+	if (not remain) or remain <= 0 then
+		return -1
+	end
+	redis.call("DECR", remainKey)
+
+	-- 客户已经按优惠价付款，重新占用优惠码时不再检查次数上限
+	local promo = redis.call("HGET", resKey, "promo_code")
+	if promo and promo ~= "" then
+		redis.call("INCR", "promo:" .. promo .. ":used")
+		redis.call("INCR", "promo:" .. promo .. ":user:" .. user_id .. ":used")
+	end
+
+	redis.call("SET", "user:" .. user_id .. ":showtime:" .. showtime_id .. ":ordered", "true")
+	redis.call("HSET", resKey, "status", "PAID", "paid_at", ARGV[1], "late_payment", "1")
+	return 2
+`)
+
+var refundLatePaymentScript = redis.NewScript(`
+	-- KEYS[1] = reservation:{reservation_id}
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	-- 重复消息：已经退款过
+	if status == "REFUNDED" then
+		return 0
+	end
+	if status ~= "TIMEOUT" and status ~= "CANCELLED" then
+		return -2
+	end
+
+	-- 库存和优惠码在超时或取消时已经返还
+	redis.call("HSET", resKey, "status", "REFUNDED", "late_payment", "1")
 	return 1
 `)
 
-var markTicketAsTimeoutScript = redis.NewScript(`
+// lua function returning the promo code use of a released reservation, prepended to the scripts releasing tickets
+const releasePromoFunc = `
+	local function release_promo(resKey)
+		local promo = redis.call("HGET", resKey, "promo_code")
+		if (not promo) or promo == "" then
+			return
+		end
+		local user_id = redis.call("HGET", resKey, "user_id")
+		redis.call("DECR", "promo:" .. promo .. ":used")
+		redis.call("DECR", "promo:" .. promo .. ":user:" .. user_id .. ":used")
+	end
+`
+
+var markTicketAsTimeoutScript = redis.NewScript(releasePromoFunc + `
 	-- KEYS[1] = reservation:{reservation_id}
 
 	local resKey = KEYS[1]
 	local status = redis.call("HGET", resKey, "status")
 	local showtime_id = redis.call("HGET", resKey, "showtime_id")
 
-	if not status or status ~= "RESERVED" then
+	if not status then
 		return -2
 	end
+	-- 已支付或已超时，无需处理
+	if status ~= "RESERVED" then
+		return 0
+	end
 
 	-- 构建库存键
 	local remainKey = "showtime:" .. showtime_id .. ":ticket:remain"
@@ -139,5 +383,214 @@ var markTicketAsTimeoutScript = redis.NewScript(`
 	-- 增加对应场次的剩余票数
 	redis.call("INCR", remainKey)
 
+	-- 返还优惠码
+	release_promo(resKey)
+
+	return 1
+`)
+
+var markTicketAsFailedScript = redis.NewScript(releasePromoFunc + `
+	-- KEYS[1] = reservation:{reservation_id}
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	if not status then
+		return -2
+	end
+	-- 重复消息：已经处理过
+	if status == "FAILED" then
+		return 0
+	end
+	if status ~= "RESERVED" then
+		return -2
+	end
+
+	local showtime_id = redis.call("HGET", resKey, "showtime_id")
+	local user_id = redis.call("HGET", resKey, "user_id")
+
+	-- 更新状态为支付失败
+	redis.call("HSET", resKey, "status", "FAILED")
+
+	-- 立即返还库存
+	redis.call("INCR", "showtime:" .. showtime_id .. ":ticket:remain")
+
+	-- 允许用户重新订票
+	redis.call("DEL", "user:" .. user_id .. ":showtime:" .. showtime_id .. ":ordered")
+
+	-- 返还优惠码
+	release_promo(resKey)
+
+	return 1
+`)
+
+var cancelReservationScript = redis.NewScript(releasePromoFunc + `
+	-- KEYS[1] = reservation:{reservation_id}
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	if not status then
+		return -2
+	end
+	-- 重复请求：已经取消过
+	if status == "CANCELLED" then
+		return 0
+	end
+	if status ~= "RESERVED" then
+		return -2
+	end
+	-- 用户已经请求支付，结果未知时不能取消
+	if redis.call("HGET", resKey, "payment_pending") == "1" then
+		return -2
+	end
+	local intent = redis.call("HGET", resKey, "payment_intent_id")
+	if intent and intent ~= "" then
+		return -2
+	end
+
+	local showtime_id = redis.call("HGET", resKey, "showtime_id")
+	local user_id = redis.call("HGET", resKey, "user_id")
+
+	redis.call("HSET", resKey, "status", "CANCELLED")
+
+	-- 立即返还库存
+	redis.call("INCR", "showtime:" .. showtime_id .. ":ticket:remain")
+
+	-- 允许用户重新订票
+	redis.call("DEL", "user:" .. user_id .. ":showtime:" .. showtime_id .. ":ordered")
+
+	-- 返还优惠码
+	release_promo(resKey)
+
+	return 1
+`)
+
+var markPaymentPendingScript = redis.NewScript(`
+	-- KEYS[1] = reservation:{reservation_id}
+
+	-- returns 1 marked, 0 if it was already, -2 if the reservation isn't RESERVED
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	if status ~= "RESERVED" then
+		return -2
+	end
+	if redis.call("HGET", resKey, "payment_pending") == "1" then
+		return 0
+	end
+	redis.call("HSET", resKey, "payment_pending", "1")
 	return 1
 `)
+
+var claimPaymentScript = redis.NewScript(`
+	-- KEYS[1] = reservation:{reservation_id}
+
+	-- returns 1 claimed, 0 if the payment was claimed or started before, -2 if the reservation isn't RESERVED
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	if status ~= "RESERVED" then
+		return -2
+	end
+	if redis.call("HGET", resKey, "payment_claimed") == "1" then
+		return 0
+	end
+	local intent = redis.call("HGET", resKey, "payment_intent_id")
+	if intent and intent ~= "" then
+		return 0
+	end
+	redis.call("HSET", resKey, "payment_claimed", "1")
+	return 1
+`)
+
+var refundTicketScript = redis.NewScript(`
+	-- KEYS[1] = reservation:{reservation_id}
+
+	-- ARGV[1] = 1 if the tickets should be returned to stock, 0 otherwise
+
+	-- returns 1 refunded, 0 if it was already, -2 for any other status, -3 if there's no reservation
+
+	local resKey = KEYS[1]
+	local status = redis.call("HGET", resKey, "status")
+	if not status then
+		return -3
+	end
+	-- 重复消息：已经退款过
+	if status == "REFUNDED" then
+		return 0
+	end
+	if status ~= "PAID" then
+		return -2
+	end
+
+	local showtime_id = redis.call("HGET", resKey, "showtime_id")
+	local user_id = redis.call("HGET", resKey, "user_id")
+
+	redis.call("HSET", resKey, "status", "REFUNDED")
+
+	-- 场次未开始时返还库存
+	if ARGV[1] == "1" then
+		redis.call("INCR", "showtime:" .. showtime_id .. ":ticket:remain")
+	end
+
+	-- 允许用户重新订票
+	redis.call("DEL", "user:" .. user_id .. ":showtime:" .. showtime_id .. ":ordered")
+
+	return 1
+`)
+
+var adjustTicketsScript = redis.NewScript(`
+	-- KEYS[1] = showtime:{showtime_id}:ticket:remain
+	-- ARGV[1] = tickets to add, negative to remove
+	-- returns {1, remaining} if adjusted, {-1, remaining} if fewer tickets remain than would be removed,
+	-- {-2, 0} if the showtime's tickets aren't loaded
+
+	local remain = redis.call("GET", KEYS[1])
+	if not remain then
+		return {-2, 0}
+	end
+	remain = tonumber(remain)
+	local adjusted = remain + tonumber(ARGV[1])
+	if adjusted < 0 then
+		return {-1, remain}
+	end
+	redis.call("SET", KEYS[1], adjusted)
+	return {1, adjusted}
+`)
+
+var takeRateLimitTokenScript = redis.NewScript(`
+	-- KEYS[1] = ratelimit:{route}:{subject}
+	-- ARGV[1] = bucket size
+	-- ARGV[2] = milliseconds to refill the whole bucket
+	-- returns {1, 0} if a token was taken, {0, milliseconds until the next token} otherwise
+
+	local size = tonumber(ARGV[1])
+	local period = tonumber(ARGV[2])
+	-- the clock of redis, so every instance agrees on it
+	local time = redis.call("TIME")
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+	local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+	local tokens = tonumber(bucket[1])
+	local ts = tonumber(bucket[2])
+	if not tokens then
+		tokens = size
+		ts = now
+	end
+
+	local rate = size / period
+	tokens = math.min(size, tokens + math.max(0, now - ts) * rate)
+
+	local allowed = 0
+	local retry = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+		allowed = 1
+	else
+		retry = math.ceil((1 - tokens) / rate)
+	end
+
+	redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+	-- a bucket left alone for a period is full again, the same as a missing one
+	redis.call("PEXPIRE", KEYS[1], math.ceil(period))
+	return {allowed, retry}
+`)
@@ -90,19 +90,33 @@ func (r *RedisCache) GetBool(key string) (value bool, err error) {
 * remaining tickets of a showtime
  */
 
-// create a reservation in redis if there's tickets available
-func (r *RedisCache) ReserveTicket(showtimeID uint, userID uint) (reservationID uint, err error) {
+// create a reservation in redis if there's tickets available,
+// token is the secret the customer pays with, and the hold expires at expiresAt.
+// The price is locked into the reservation, later price changes don't affect it.
+// The use of promo is claimed in the same script, it's returned when the ticket is released
+func (r *RedisCache) ReserveTicket(showtimeID uint, userID uint, token string, expiresAt time.Time,
+	category string, price ShowtimePriceCacheValue, promo *PromoClaim) (reservationID uint, err error) {
+	if promo == nil {
+		promo = &PromoClaim{}
+	}
 	remainingTicketsKey := MakeShowtimeRemainingTicketsKey(showtimeID)
 	userShowtimeOrderedKey := MakeUserShowtimeOrderedKey(userID, showtimeID)
-	res, err := reserveTicketScript.Run(ctx, r.Client, []string{remainingTicketsKey, ReservationIDSeqKey, userShowtimeOrderedKey}, showtimeID, userID).Int64()
+	res, err := reserveTicketScript.Run(ctx, r.Client, []string{remainingTicketsKey, ReservationIDSeqKey, userShowtimeOrderedKey,
+		MakeUserReservationsKey(userID), MakeShowtimeReservationsKey(showtimeID)},
+		showtimeID, userID, token, expiresAt.Unix(), time.Now().Unix(), category, price.Amount, price.Currency,
+		promo.Code, promo.Discount, promo.MaxUses, promo.MaxUsesPerUser).Int64()
 	if err != nil {
 		return 0, err
 	}
-	if res == -1 {
+	switch res {
+	case -1:
 		return 0, ErrSoldOut
-	}
-	if res == -3 {
+	case -3:
 		return 0, ErrAlreadyOrdered
+	case -4:
+		return 0, ErrPromoExhausted
+	case -5:
+		return 0, ErrPromoUserExhausted
 	}
 
 	reservationID = uint(res)
@@ -110,25 +124,84 @@ func (r *RedisCache) ReserveTicket(showtimeID uint, userID uint) (reservationID
 	return reservationID, nil
 }
 
-func (r *RedisCache) MarkTicketAsPaid(reservationID uint) error {
-	res, err := markTicketAsPaidScript.Run(ctx, r.Client, []string{fmt.Sprintf("reservation:%d", reservationID)}).Result()
+// mark ticket as paid at paidAt, a reservation that's already paid keeps its first paidAt.
+// A payment arriving after the hold expired or the reservation was cancelled takes a ticket again
+// if there's one left, late is true then, and ErrSoldOut is returned if there's none.
+// duplicate is true if the reservation was already paid
+func (r *RedisCache) MarkTicketAsPaid(reservationID uint, paidAt time.Time) (late bool, duplicate bool, err error) {
+	res, err := markTicketAsPaidScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}, paidAt.Unix()).Int64()
+	if err != nil {
+		return false, false, err
+	}
+	switch res {
+	case 0:
+		return false, true, nil
+	case 2:
+		return true, false, nil
+	case 3:
+		return true, true, nil
+	case -1:
+		return true, false, ErrSoldOut
+	case -2:
+		return false, false, ErrInvalidReservationStatus
+	}
+	return false, false, nil
+}
+
+// MarkLatePaymentAsRefunded records that a payment arriving after the ticket was released (timeout or cancel) was refunded
+func (r *RedisCache) MarkLatePaymentAsRefunded(reservationID uint) error {
+	res, err := refundLatePaymentScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}).Result()
 	if err != nil {
 		return err
 	}
 	if res == int64(-2) {
-		return errors.New("invalid reservation status")
+		return ErrInvalidReservationStatus
 	}
 	return nil
 }
 
-// mark ticket as timeout and roll back remaining tickets in redis
-func (r *RedisCache) MarkTicketAsTimeout(reservationID uint) error {
+// mark ticket as timeout and roll back remaining tickets in redis,
+// timedOut is false if the reservation was paid or released before
+func (r *RedisCache) MarkTicketAsTimeout(reservationID uint) (timedOut bool, err error) {
 	res, err := markTicketAsTimeoutScript.Run(ctx, r.Client, []string{fmt.Sprintf("reservation:%d", reservationID)}).Result()
 	if err != nil {
-		return err
+		return false, err
+	}
+	if res == int64(-2) {
+		return false, ErrInvalidReservationStatus
+	}
+	return res == int64(1), nil
+}
+
+// mark ticket as failed and release it at once, failed is false if it was marked failed before
+func (r *RedisCache) MarkTicketAsFailed(reservationID uint) (failed bool, err error) {
+	res, err := markTicketAsFailedScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}).Result()
+	if err != nil {
+		return false, err
 	}
 	if res == int64(-2) {
-		return errors.New("invalid reservation status")
+		return false, ErrInvalidReservationStatus
+	}
+	return res == int64(1), nil
+}
+
+// mark a paid ticket as refunded and clear the user's ordered marker,
+// the ticket goes back to stock only if restock is true.
+// It returns ErrReservationNotFound if redis doesn't hold the reservation anymore, e.g. after a restart
+func (r *RedisCache) MarkTicketAsRefunded(reservationID uint, restock bool) error {
+	restockArg := 0
+	if restock {
+		restockArg = 1
+	}
+	res, err := refundTicketScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}, restockArg).Result()
+	if err != nil {
+		return err
+	}
+	switch res {
+	case int64(-2):
+		return ErrInvalidReservationStatus
+	case int64(-3):
+		return ErrReservationNotFound
 	}
 	return nil
 }
@@ -138,6 +211,105 @@ func (r *RedisCache) ReleaseTicket(showtimeID uint) error {
 	return r.Client.Incr(ctx, key).Err()
 }
 
+// GetRemainingTickets returns the tickets left of a showtime, it returns ErrCacheMiss if they aren't loaded
+func (r *RedisCache) GetRemainingTickets(showtimeID uint) (int, error) {
+	remain, err := r.Client.Get(ctx, MakeShowtimeRemainingTicketsKey(showtimeID)).Int()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, ErrCacheMiss
+		}
+		return 0, err
+	}
+	return remain, nil
+}
+
+// GetRemainingTicketsBatch returns the tickets left of each showtime, showtimes whose tickets aren't loaded are missing
+func (r *RedisCache) GetRemainingTicketsBatch(showtimeIDs []uint) (map[uint]int, error) {
+	remaining := make(map[uint]int, len(showtimeIDs))
+	if len(showtimeIDs) == 0 {
+		return remaining, nil
+	}
+	keys := make([]string, len(showtimeIDs))
+	for i, id := range showtimeIDs {
+		keys[i] = MakeShowtimeRemainingTicketsKey(id)
+	}
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var remain int
+		if _, err := fmt.Sscan(s, &remain); err != nil {
+			return nil, err
+		}
+		remaining[showtimeIDs[i]] = remain
+	}
+	return remaining, nil
+}
+
+// SetRemainingTickets puts a showtime on sale with the tickets, or replaces the tickets left
+func (r *RedisCache) SetRemainingTickets(showtimeID uint, tickets int) error {
+	return r.Client.Set(ctx, MakeShowtimeRemainingTicketsKey(showtimeID), tickets, 0).Err()
+}
+
+// DeleteRemainingTickets takes a showtime off sale, reserving it fails as if it were sold out
+func (r *RedisCache) DeleteRemainingTickets(showtimeID uint) error {
+	return r.Client.Del(ctx, MakeShowtimeRemainingTicketsKey(showtimeID)).Err()
+}
+
+// AdjustRemainingTickets adds delta tickets to a showtime, or removes them if it's negative, and returns the tickets left.
+// It returns ErrNotEnoughTickets if fewer tickets remain than would be removed,
+// and ErrCacheMiss if the showtime's tickets aren't loaded.
+func (r *RedisCache) AdjustRemainingTickets(showtimeID uint, delta int) (int, error) {
+	res, err := adjustTicketsScript.Run(ctx, r.Client, []string{MakeShowtimeRemainingTicketsKey(showtimeID)}, delta).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	switch res[0] {
+	case -1:
+		return int(res[1]), ErrNotEnoughTickets
+	case -2:
+		return 0, ErrCacheMiss
+	}
+	return int(res[1]), nil
+}
+
+// ScanReservations returns every reservation of the showtime kept in redis, keyed by reservation id.
+// It reads the showtime's reservation index (see MakeShowtimeReservationsKey) in batches
+func (r *RedisCache) ScanReservations(showtimeID uint) (map[uint]*ReservationCacheValue, error) {
+	reservations := make(map[uint]*ReservationCacheValue)
+	indexKey := MakeShowtimeReservationsKey(showtimeID)
+	const batch = 500
+	for start := int64(0); ; start += batch {
+		members, err := r.Client.ZRange(ctx, indexKey, start, start+batch-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]uint, len(members))
+		for i, member := range members {
+			if _, err := fmt.Sscan(member, &ids[i]); err != nil {
+				return nil, err
+			}
+		}
+		found, err := r.LookupReservations(ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, reservation := range found {
+			if reservation != nil {
+				reservations[ids[i]] = reservation
+			}
+		}
+		if len(members) < batch {
+			return reservations, nil
+		}
+	}
+}
+
 /*
 * user ordered showtime
  */
@@ -161,7 +333,371 @@ func (r *RedisCache) GetOrdered(userID uint, showtimeID uint) (bool, error) {
 	return exist, nil
 }
 
-func (r *RedisCache) GetReservationInfo(reservationID uint) (map[string]string, error) {
+/*
+* processed mq messages
+ */
+
+// IsMessageProcessed reports whether the message has been handled by a consumer of the queue
+func (r *RedisCache) IsMessageProcessed(queueName string, messageID string) (bool, error) {
+	key := MakeProcessedMessageKey(queueName, messageID)
+	n, err := r.Client.Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MarkMessageProcessed records the message as handled, the record expires after ttl
+func (r *RedisCache) MarkMessageProcessed(queueName string, messageID string, ttl time.Duration) error {
+	key := MakeProcessedMessageKey(queueName, messageID)
+	return r.Client.Set(ctx, key, time.Now().Unix(), ttl).Err()
+}
+
+/*
+* payment webhook events
+ */
+
+// ClaimWebhookEvent records the event id, it returns false if the event was already received
+func (r *RedisCache) ClaimWebhookEvent(provider string, eventID string, ttl time.Duration) (bool, error) {
+	key := MakePaymentWebhookEventKey(provider, eventID)
+	return r.Client.SetNX(ctx, key, time.Now().Unix(), ttl).Result()
+}
+
+// ReleaseWebhookEvent forgets the event id, so the provider can deliver an event that failed again
+func (r *RedisCache) ReleaseWebhookEvent(provider string, eventID string) error {
+	key := MakePaymentWebhookEventKey(provider, eventID)
+	return r.Client.Del(ctx, key).Err()
+}
+
+// GetReservation reads the reservation hash, it returns ErrReservationNotFound if there's none
+func (r *RedisCache) GetReservation(reservationID uint) (*ReservationCacheValue, error) {
+	key := MakeReservationKey(reservationID)
+	res := r.Client.HGetAll(ctx, key)
+	data, err := res.Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrReservationNotFound
+	}
+
+	var reservation ReservationCacheValue
+	if err := res.Scan(&reservation); err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// GetReservations reads the reservation hashes in one round trip,
+// it returns ErrReservationNotFound if any of them is missing
+func (r *RedisCache) GetReservations(reservationIDs []uint) ([]*ReservationCacheValue, error) {
+	pipe := r.Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(reservationIDs))
+	for i, id := range reservationIDs {
+		cmds[i] = pipe.HGetAll(ctx, MakeReservationKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	reservations := make([]*ReservationCacheValue, len(reservationIDs))
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			return nil, fmt.Errorf("%w: %d", ErrReservationNotFound, reservationIDs[i])
+		}
+		var reservation ReservationCacheValue
+		if err := cmd.Scan(&reservation); err != nil {
+			return nil, err
+		}
+		reservations[i] = &reservation
+	}
+	return reservations, nil
+}
+
+// LookupReservations reads the reservation hashes in one round trip, missing reservations are nil
+func (r *RedisCache) LookupReservations(reservationIDs []uint) ([]*ReservationCacheValue, error) {
+	pipe := r.Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(reservationIDs))
+	for i, id := range reservationIDs {
+		cmds[i] = pipe.HGetAll(ctx, MakeReservationKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	reservations := make([]*ReservationCacheValue, len(reservationIDs))
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		var reservation ReservationCacheValue
+		if err := cmd.Scan(&reservation); err != nil {
+			return nil, err
+		}
+		reservations[i] = &reservation
+	}
+	return reservations, nil
+}
+
+// ListReservationIndex returns up to count reservation ids of an index (see MakeUserReservationsKey),
+// newest first and below beforeID, 0 means from the newest
+func (r *RedisCache) ListReservationIndex(indexKey string, beforeID uint, count int) ([]uint, error) {
+	max := "+inf"
+	if beforeID > 0 {
+		max = fmt.Sprintf("(%d", beforeID)
+	}
+	members, err := r.Client.ZRevRangeByScore(ctx, indexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(members))
+	for _, member := range members {
+		var id uint
+		if _, err := fmt.Sscan(member, &id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RemoveFromReservationIndex drops reservations that are no longer worth listing from an index
+func (r *RedisCache) RemoveFromReservationIndex(indexKey string, reservationIDs []uint) error {
+	if len(reservationIDs) == 0 {
+		return nil
+	}
+	members := make([]any, len(reservationIDs))
+	for i, id := range reservationIDs {
+		members[i] = id
+	}
+	return r.Client.ZRem(ctx, indexKey, members...).Err()
+}
+
+// SetReservationPayment records the payment intent started for the reservation
+func (r *RedisCache) SetReservationPayment(reservationID uint, paymentIntentID string) error {
 	key := MakeReservationKey(reservationID)
-	return r.Client.HGetAll(ctx, key).Result()
+	return r.Client.HSet(ctx, key, "payment_intent_id", paymentIntentID).Err()
+}
+
+// MarkPaymentPending records that the customer asked to pay a RESERVED reservation, it can't be cancelled afterwards.
+// marked is false if it was marked before
+func (r *RedisCache) MarkPaymentPending(reservationID uint) (marked bool, err error) {
+	res, err := markPaymentPendingScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}).Int64()
+	if err != nil {
+		return false, err
+	}
+	if res == -2 {
+		return false, ErrInvalidReservationStatus
+	}
+	return res == 1, nil
+}
+
+// UnmarkPaymentPending withdraws the payment request of a reservation whose payment was never started
+func (r *RedisCache) UnmarkPaymentPending(reservationID uint) error {
+	return r.Client.HDel(ctx, MakeReservationKey(reservationID), "payment_pending").Err()
+}
+
+// ClaimPayment gives the caller the right to create the payment intent of a RESERVED reservation,
+// claimed is false if another caller claimed it or the payment was started before
+func (r *RedisCache) ClaimPayment(reservationID uint) (claimed bool, err error) {
+	res, err := claimPaymentScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}).Int64()
+	if err != nil {
+		return false, err
+	}
+	if res == -2 {
+		return false, ErrInvalidReservationStatus
+	}
+	return res == 1, nil
+}
+
+// ReleasePaymentClaim gives up a claim whose payment intent couldn't be created, so it can be claimed again
+func (r *RedisCache) ReleasePaymentClaim(reservationID uint) error {
+	return r.Client.HDel(ctx, MakeReservationKey(reservationID), "payment_claimed").Err()
+}
+
+// CancelReservation releases a reservation nobody asked to pay yet, the ticket and promo code use are returned at once
+func (r *RedisCache) CancelReservation(reservationID uint) error {
+	res, err := cancelReservationScript.Run(ctx, r.Client, []string{MakeReservationKey(reservationID)}).Result()
+	if err != nil {
+		return err
+	}
+	if res == int64(-2) {
+		return ErrInvalidReservationStatus
+	}
+	return nil
+}
+
+// GetPromoCode reads a cached promo code into dest, it returns ErrCacheMiss if it's not cached
+func (r *RedisCache) GetPromoCode(code string, dest any) error {
+	if err := r.Get(MakePromoCodeKey(code), dest); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrCacheMiss
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *RedisCache) SetPromoCode(code string, value any, ttl time.Duration) error {
+	return r.Set(MakePromoCodeKey(code), value, ttl)
+}
+
+// SetPromoUsage overwrites the usage counters of the promo codes,
+// used maps code to uses and userUsed maps code to the uses of each user
+func (r *RedisCache) SetPromoUsage(used map[string]int, userUsed map[string]map[uint]int) error {
+	pipe := r.Client.Pipeline()
+	for code, count := range used {
+		pipe.Set(ctx, MakePromoUsedKey(code), count, 0)
+	}
+	for code, users := range userUsed {
+		for userID, count := range users {
+			pipe.Set(ctx, MakePromoUserUsedKey(code, userID), count, 0)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetShowtimePrice reads a cached price, it returns ErrCacheMiss if it's not cached
+func (r *RedisCache) GetShowtimePrice(showtimeID uint, category string) (*ShowtimePriceCacheValue, error) {
+	var price ShowtimePriceCacheValue
+	if err := r.Get(MakeShowtimePriceKey(showtimeID, category), &price); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	return &price, nil
+}
+
+func (r *RedisCache) SetShowtimePrice(showtimeID uint, category string, price ShowtimePriceCacheValue, ttl time.Duration) error {
+	return r.Set(MakeShowtimePriceKey(showtimeID, category), price, ttl)
+}
+
+/*
+* rate limits
+ */
+
+// TakeRateLimitToken takes a token from the bucket of route and subject, which holds limit tokens refilled over period.
+// If the bucket is empty, allowed is false and retryAfter is how long until the next token
+func (r *RedisCache) TakeRateLimitToken(route string, subject string, limit int, period time.Duration) (allowed bool,
+	retryAfter time.Duration, err error) {
+	res, err := takeRateLimitTokenScript.Run(ctx, r.Client, []string{MakeRateLimitKey(route, subject)},
+		limit, period.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+/*
+* idempotency keys
+ */
+
+// ClaimIdempotencyKey stores the pending record if the key is new, it returns false if the key was already used
+func (r *RedisCache) ClaimIdempotencyKey(scope string, key string, record IdempotencyRecord, ttl time.Duration) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	return r.Client.SetNX(ctx, MakeIdempotencyKey(scope, key), data, ttl).Result()
+}
+
+// GetIdempotencyRecord returns ErrCacheMiss if the key isn't used
+func (r *RedisCache) GetIdempotencyRecord(scope string, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	if err := r.Get(MakeIdempotencyKey(scope, key), &record); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// SaveIdempotencyRecord replaces the pending record with the completed one
+func (r *RedisCache) SaveIdempotencyRecord(scope string, key string, record IdempotencyRecord, ttl time.Duration) error {
+	return r.Set(MakeIdempotencyKey(scope, key), record, ttl)
+}
+
+// ReleaseIdempotencyKey forgets the key, so the request can be retried with it
+func (r *RedisCache) ReleaseIdempotencyKey(scope string, key string) error {
+	return r.Client.Del(ctx, MakeIdempotencyKey(scope, key)).Err()
+}
+
+/*
+* public catalog
+ */
+
+// GetCatalogQuery reads a cached catalog query result into dest, it returns ErrCacheMiss if it's not cached
+func (r *RedisCache) GetCatalogQuery(query string, dest any) error {
+	if err := r.Get(MakeCatalogQueryKey(query), dest); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return ErrCacheMiss
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *RedisCache) SetCatalogQuery(query string, value any, ttl time.Duration) error {
+	return r.Set(MakeCatalogQueryKey(query), value, ttl)
+}
+
+/*
+* reservation events
+ */
+
+// PublishReservationEvent sends an event to every instance subscribed to the reservation events
+func (r *RedisCache) PublishReservationEvent(event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return r.Client.Publish(ctx, ReservationEventsChannel, data).Err()
+}
+
+// SubscribeReservationEvents subscribes to the reservation events,
+// it returns once the subscription is confirmed so no event published afterwards is missed
+func (r *RedisCache) SubscribeReservationEvents() (*redis.PubSub, error) {
+	pubsub := r.Client.Subscribe(ctx, ReservationEventsChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
+
+/*
+* reserve challenges
+ */
+
+// UseChallenge marks a challenge solved until ttl passes, it returns false if it already was
+func (r *RedisCache) UseChallenge(challengeID string, ttl time.Duration) (bool, error) {
+	return r.Client.SetNX(ctx, MakeChallengeUsedKey(challengeID), 1, ttl).Result()
+}
+
+// GetChallengeDifficulty returns the difficulty raised for a showtime, or ErrCacheMiss if it wasn't
+func (r *RedisCache) GetChallengeDifficulty(showtimeID uint) (int, error) {
+	difficulty, err := r.Client.Get(ctx, MakeShowtimeChallengeDifficultyKey(showtimeID)).Int()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, ErrCacheMiss
+		}
+		return 0, err
+	}
+	return difficulty, nil
+}
+
+func (r *RedisCache) SetChallengeDifficulty(showtimeID uint, difficulty int) error {
+	return r.Client.Set(ctx, MakeShowtimeChallengeDifficultyKey(showtimeID), difficulty, 0).Err()
+}
+
+func (r *RedisCache) DeleteChallengeDifficulty(showtimeID uint) error {
+	return r.Client.Del(ctx, MakeShowtimeChallengeDifficultyKey(showtimeID)).Err()
 }
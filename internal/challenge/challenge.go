@@ -0,0 +1,139 @@
+// Package challenge signs the challenges a client has to solve before reserving.
+// A challenge token looks like "<payload>.<signature>", both base64url encoded,
+// where the signature is the HMAC-SHA256 of the payload keyed by the server's secret,
+// so the server doesn't have to keep the challenges it issued.
+//
+// A proof-of-work solution is any string s such that sha256("<token>:<s>")
+// starts with at least Difficulty zero bits.
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/util"
+)
+
+// MaxDifficulty bounds the proof-of-work difficulty, a browser needs minutes at 32 bits
+const MaxDifficulty = 32
+
+var (
+	ErrInvalidChallenge = errors.New("invalid challenge")
+	ErrExpiredChallenge = errors.New("challenge expired")
+	ErrWrongSolution    = errors.New("wrong challenge solution")
+)
+
+// Challenge is issued to a user for one showtime, it can't be used for another
+type Challenge struct {
+	ID         string `json:"id"`
+	UserID     uint   `json:"uid"`
+	ShowtimeID uint   `json:"sid"`
+	// leading zero bits the proof-of-work hash needs, 0 for captchas
+	Difficulty int   `json:"d"`
+	ExpiresAt  int64 `json:"exp"` // unix seconds
+}
+
+// Signer signs and parses challenge tokens
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret string) *Signer {
+	return &Signer{secret: []byte(secret)}
+}
+
+// New returns a challenge with a random id, valid for ttl from now
+func New(userID uint, showtimeID uint, difficulty int, ttl time.Duration, now time.Time) *Challenge {
+	return &Challenge{
+		ID:         util.RandomHex(16),
+		UserID:     userID,
+		ShowtimeID: showtimeID,
+		Difficulty: difficulty,
+		ExpiresAt:  now.Add(ttl).Unix(),
+	}
+}
+
+// Sign returns the token of c
+func (s *Signer) Sign(c *Challenge) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+// Parse checks the signature of token and that it hasn't expired at now
+func (s *Signer) Parse(token string, now time.Time) (*Challenge, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidChallenge
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, s.mac(encoded)) {
+		return nil, ErrInvalidChallenge
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidChallenge
+	}
+
+	var c Challenge
+	if err := json.Unmarshal(payload, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidChallenge
+	}
+	if now.Unix() >= c.ExpiresAt {
+		return nil, ErrExpiredChallenge
+	}
+	return &c, nil
+}
+
+func (s *Signer) mac(encoded string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// VerifyProofOfWork checks that solution solves token at difficulty
+func VerifyProofOfWork(token string, solution string, difficulty int) error {
+	if solution == "" || len(solution) > 64 {
+		return ErrWrongSolution
+	}
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return ErrWrongSolution
+	}
+	return nil
+}
+
+// Solve finds a proof-of-work solution of token by counting up, it's what a client does
+func Solve(token string, difficulty int) (string, error) {
+	if difficulty < 0 || difficulty > MaxDifficulty {
+		return "", fmt.Errorf("difficulty %d out of range", difficulty)
+	}
+	for n := uint64(0); ; n++ {
+		solution := strconv.FormatUint(n, 10)
+		if VerifyProofOfWork(token, solution, difficulty) == nil {
+			return solution, nil
+		}
+	}
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,91 @@
+package challenge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner_SignAndParse(t *testing.T) {
+	s := NewSigner("secret")
+	now := time.Now()
+
+	c := New(42, 7, 8, time.Minute, now)
+	token, err := s.Sign(c)
+	if err != nil {
+		t.Fatalf("Failed to sign challenge: %v", err)
+	}
+
+	parsed, err := s.Parse(token, now)
+	if err != nil {
+		t.Fatalf("Failed to parse challenge: %v", err)
+	}
+	if *parsed != *c {
+		t.Errorf("Expected %+v, got %+v", *c, *parsed)
+	}
+}
+
+func TestSigner_RejectsInvalidTokens(t *testing.T) {
+	s := NewSigner("secret")
+	now := time.Now()
+
+	c := New(42, 7, 8, time.Minute, now)
+	token, _ := s.Sign(c)
+	otherSecret, _ := NewSigner("other").Sign(c)
+	payload, signature, _ := strings.Cut(token, ".")
+	raised := *c
+	raised.Difficulty = 0
+	forged, _ := NewSigner("other").Sign(&raised)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	for name, token := range map[string]string{
+		"other secret":    otherSecret,
+		"no signature":    payload,
+		"changed payload": forgedPayload + "." + signature,
+		"empty":           "",
+	} {
+		if _, err := s.Parse(token, now); !errors.Is(err, ErrInvalidChallenge) {
+			t.Errorf("%s: expected ErrInvalidChallenge, got %v", name, err)
+		}
+	}
+
+	if _, err := s.Parse(token, now.Add(time.Minute)); !errors.Is(err, ErrExpiredChallenge) {
+		t.Errorf("Expected ErrExpiredChallenge, got %v", err)
+	}
+}
+
+func TestVerifyProofOfWork(t *testing.T) {
+	token := "challenge"
+
+	solution, err := Solve(token, 12)
+	if err != nil {
+		t.Fatalf("Failed to solve: %v", err)
+	}
+	if err := VerifyProofOfWork(token, solution, 12); err != nil {
+		t.Errorf("Expected the solution to be accepted, got %v", err)
+	}
+	if err := VerifyProofOfWork("other", solution, 12); !errors.Is(err, ErrWrongSolution) {
+		// one in 4096 solutions would pass for another token, "other" isn't one of them
+		t.Errorf("Expected ErrWrongSolution for another token, got %v", err)
+	}
+	if err := VerifyProofOfWork(token, "", 0); !errors.Is(err, ErrWrongSolution) {
+		t.Errorf("Expected ErrWrongSolution for an empty solution, got %v", err)
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	for _, tc := range []struct {
+		b    []byte
+		want int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00, 0x10}, 11},
+		{[]byte{0x00, 0x00}, 16},
+	} {
+		if got := leadingZeroBits(tc.b); got != tc.want {
+			t.Errorf("leadingZeroBits(%x) = %d, want %d", tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,604 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// AdminHandler serves the catalog, inventory, reconciliation and order lookup endpoints of staff,
+// the routes are guarded by RequireRole and RequirePermission
+type AdminHandler struct {
+	app *app.App
+}
+
+func NewAdminHandler(app *app.App) *AdminHandler {
+	return &AdminHandler{
+		app: app,
+	}
+}
+
+func (h *AdminHandler) HandleCreateMovie(ctx *gin.Context) {
+	var req MovieRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	movie := &model.Movie{
+		Title:       req.Title,
+		Description: req.Description,
+	}
+	if err := h.app.MovieService.CreateMovie(movie); err != nil {
+		writeMovieError(ctx, err, "Failed to create movie, please try again later")
+		return
+	}
+
+	ctx.JSON(201, newMovieResponse(movie))
+}
+
+func (h *AdminHandler) HandleUpdateMovie(ctx *gin.Context) {
+	movieID, ok := parseIDParam(ctx, "Invalid movie id")
+	if !ok {
+		return
+	}
+
+	var req MovieRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	movie := &model.Movie{
+		ID:          movieID,
+		Title:       req.Title,
+		Description: req.Description,
+	}
+	if err := h.app.MovieService.UpdateMovie(movie); err != nil {
+		writeMovieError(ctx, err, "Failed to update movie, please try again later")
+		return
+	}
+
+	ctx.JSON(200, newMovieResponse(movie))
+}
+
+// HandleDeleteMovie deletes a movie without showtimes
+func (h *AdminHandler) HandleDeleteMovie(ctx *gin.Context) {
+	movieID, ok := parseIDParam(ctx, "Invalid movie id")
+	if !ok {
+		return
+	}
+
+	if err := h.app.MovieService.DeleteMovie(movieID); err != nil {
+		writeMovieError(ctx, err, "Failed to delete movie, please try again later")
+		return
+	}
+
+	ctx.Status(204)
+}
+
+// HandleCreateShowtime creates a showtime, its tickets are on sale right away
+func (h *AdminHandler) HandleCreateShowtime(ctx *gin.Context) {
+	var req CreateShowtimeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	showtime := &model.Showtime{
+		MovieID:  req.MovieID,
+		StartAt:  req.StartAt,
+		Capacity: req.Capacity,
+	}
+	if err := h.app.ShowtimeService.CreateShowtime(showtime); err != nil {
+		writeShowtimeError(ctx, err, "Failed to create showtime, please try again later")
+		return
+	}
+
+	ctx.JSON(201, newShowtimeResponse(showtime))
+}
+
+// HandleUpdateShowtime changes the start time and capacity of a showtime without orders,
+// the tickets left change by as much as the capacity
+func (h *AdminHandler) HandleUpdateShowtime(ctx *gin.Context) {
+	showtimeID, ok := parseIDParam(ctx, "Invalid showtime id")
+	if !ok {
+		return
+	}
+
+	var req UpdateShowtimeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	showtime := &model.Showtime{
+		ID:       showtimeID,
+		StartAt:  req.StartAt,
+		Capacity: req.Capacity,
+	}
+	if err := h.app.ShowtimeService.UpdateShowtime(showtime); err != nil {
+		writeShowtimeError(ctx, err, "Failed to update showtime, please try again later")
+		return
+	}
+
+	ctx.JSON(200, newShowtimeResponse(showtime))
+}
+
+// HandleDeleteShowtime deletes a showtime without orders or reservations being paid, and takes it off sale
+func (h *AdminHandler) HandleDeleteShowtime(ctx *gin.Context) {
+	showtimeID, ok := parseIDParam(ctx, "Invalid showtime id")
+	if !ok {
+		return
+	}
+
+	if err := h.app.ShowtimeService.DeleteShowtime(showtimeID); err != nil {
+		writeShowtimeError(ctx, err, "Failed to delete showtime, please try again later")
+		return
+	}
+
+	ctx.Status(204)
+}
+
+// HandleSetPrice creates or changes the price of a ticket category of a showtime
+func (h *AdminHandler) HandleSetPrice(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	var req SetPriceRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	category := model.TicketCategory(req.Category)
+	if err := h.app.PriceService.SetPrice(showtimeID, category, req.Amount, req.Currency); err != nil {
+		if errors.Is(err, domain.ErrInvalidTicketCategory) || errors.Is(err, domain.ErrInvalidPriceAmount) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid price",
+				"message": err.Error(),
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to set price, please try again later",
+		})
+		return
+	}
+
+	price, err := h.app.PriceService.GetPrice(showtimeID, category)
+	if err != nil {
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Price set but failed to read it back",
+		})
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"showtime_id": price.ShowtimeID,
+		"category":    price.Category,
+		"amount":      price.Amount,
+		"currency":    price.Currency,
+	})
+}
+
+func (h *AdminHandler) HandleCreatePromoCode(ctx *gin.Context) {
+	var req CreatePromoCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	promo := &model.PromoCode{
+		Code:           req.Code,
+		DiscountType:   model.DiscountType(req.DiscountType),
+		DiscountValue:  req.DiscountValue,
+		MaxUses:        req.MaxUses,
+		MaxUsesPerUser: req.MaxUsesPerUser,
+		ValidFrom:      req.ValidFrom,
+		ValidUntil:     req.ValidUntil,
+		ShowtimeID:     req.ShowtimeID,
+		MovieID:        req.MovieID,
+	}
+	if err := h.app.PromoService.CreatePromoCode(promo); err != nil {
+		if errors.Is(err, domain.ErrInvalidPromoCode) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid promo code",
+				"message": "The code must be 1 to 32 letters, digits, '_' or '-', with a positive discount of at most 100 percent",
+			})
+			return
+		}
+		if errors.Is(err, service.ErrAlreadyExists) {
+			ctx.JSON(409, gin.H{
+				"error":   "Promo code already exists",
+				"message": "A promo code with the code exists",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to create promo code, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(201, gin.H{
+		"id":                promo.ID,
+		"code":              promo.Code,
+		"discount_type":     promo.DiscountType,
+		"discount_value":    promo.DiscountValue,
+		"max_uses":          promo.MaxUses,
+		"max_uses_per_user": promo.MaxUsesPerUser,
+		"valid_from":        promo.ValidFrom,
+		"valid_until":       promo.ValidUntil,
+		"showtime_id":       promo.ShowtimeID,
+		"movie_id":          promo.MovieID,
+	})
+}
+
+// HandleAdjustInventory adds tickets to a showtime or removes them
+func (h *AdminHandler) HandleAdjustInventory(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	var req AdjustInventoryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	remain, err := h.app.InventoryService.AdjustInventory(showtimeID, req.Delta)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidInventoryAdjustment) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid adjustment",
+				"message": "The delta must not be zero",
+			})
+			return
+		}
+		if errors.Is(err, cache.ErrNotEnoughTickets) {
+			ctx.JSON(409, gin.H{
+				"error":             "Not enough tickets",
+				"message":           "Fewer tickets remain than would be removed",
+				"remaining_tickets": remain,
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrInventoryNotLoaded) {
+			ctx.JSON(409, gin.H{
+				"error":   "Inventory not loaded",
+				"message": "The showtime's tickets aren't on sale",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to adjust inventory, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"showtime_id":       showtimeID,
+		"remaining_tickets": remain,
+	})
+}
+
+// HandleSetChallengeDifficulty raises the proof-of-work difficulty of a showtime's challenges, e.g. for a hot sale
+func (h *AdminHandler) HandleSetChallengeDifficulty(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	var req ChallengeDifficultyRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	if err := h.app.ChallengeService.SetDifficulty(showtimeID, req.Difficulty); err != nil {
+		if errors.Is(err, domain.ErrInvalidChallengeDifficulty) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid difficulty",
+				"message": err.Error(),
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to set challenge difficulty, please try again later",
+		})
+		return
+	}
+
+	difficulty, err := h.app.ChallengeService.GetDifficulty(showtimeID)
+	if err != nil {
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to get challenge difficulty, please try again later",
+		})
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"showtime_id": showtimeID,
+		"difficulty":  difficulty,
+	})
+}
+
+// HandleReconcile reports the differences between redis and the orders of a showtime
+func (h *AdminHandler) HandleReconcile(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	report, err := h.app.ReconciliationService.ReconcileShowtime(showtimeID)
+	if err != nil {
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to reconcile showtime, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, report)
+}
+
+// HandleRepair creates the missing orders of paid reservations of a showtime
+func (h *AdminHandler) HandleRepair(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	report, repaired, err := h.app.ReconciliationService.RepairShowtime(showtimeID)
+	if err != nil {
+		if report == nil {
+			ctx.JSON(500, gin.H{
+				"error":   "Internal server error",
+				"message": "Failed to reconcile showtime, please try again later",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":    "Repair incomplete",
+			"message":  "Some orders couldn't be created, run the repair again or look at the parked queue",
+			"report":   report,
+			"repaired": repaired,
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"report":   report,
+		"repaired": repaired,
+	})
+}
+
+// parseIDParam parses the id of the path, it writes the error response and returns false if it isn't a number
+func parseIDParam(ctx *gin.Context, message string) (uint, bool) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  message,
+			"detail": err.Error(),
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func writeMovieError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidMovieTitle):
+		ctx.JSON(400, gin.H{
+			"error":   "Invalid movie",
+			"message": "The title must be 1 to 100 characters",
+		})
+	case errors.Is(err, service.ErrNotFound):
+		ctx.JSON(404, gin.H{
+			"error":   "Movie not found",
+			"message": "No movie has the id",
+		})
+	case errors.Is(err, service.ErrAlreadyExists):
+		ctx.JSON(409, gin.H{
+			"error":   "Movie already exists",
+			"message": "Another movie has the title",
+		})
+	case errors.Is(err, domain.ErrRelatedResourceExists):
+		ctx.JSON(409, gin.H{
+			"error":   "Movie in use",
+			"message": "A movie with orders can't be changed, and a movie with showtimes can't be deleted",
+		})
+	default:
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": message,
+		})
+	}
+}
+
+func writeShowtimeError(ctx *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidShowtime):
+		ctx.JSON(400, gin.H{
+			"error":   "Invalid showtime",
+			"message": "The start time is required and the capacity must not be negative",
+		})
+	case errors.Is(err, domain.ErrMovieNotFound):
+		ctx.JSON(400, gin.H{
+			"error":   "Movie not found",
+			"message": "No movie has the movie_id",
+		})
+	case errors.Is(err, service.ErrNotFound):
+		ctx.JSON(404, gin.H{
+			"error":   "Showtime not found",
+			"message": "No showtime has the id",
+		})
+	case errors.Is(err, domain.ErrRelatedResourceExists):
+		ctx.JSON(409, gin.H{
+			"error":   "Showtime in use",
+			"message": "A showtime with orders can't be changed or deleted, nor deleted while reservations are being paid",
+		})
+	case errors.Is(err, cache.ErrNotEnoughTickets):
+		ctx.JSON(409, gin.H{
+			"error":   "Capacity too small",
+			"message": "More tickets are held than the new capacity allows",
+		})
+	default:
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": message,
+		})
+	}
+}
+
+func newMovieResponse(movie *model.Movie) gin.H {
+	return gin.H{
+		"id":          movie.ID,
+		"title":       movie.Title,
+		"description": movie.Description,
+	}
+}
+
+func newShowtimeResponse(showtime *model.Showtime) gin.H {
+	return gin.H{
+		"id":       showtime.ID,
+		"movie_id": showtime.MovieID,
+		"start_at": showtime.StartAt,
+		"capacity": showtime.Capacity,
+	}
+}
+
+// HandleListShowtimeOrders lists the orders of a showtime with the reservations still held or being paid,
+// for support staff
+func (h *AdminHandler) HandleListShowtimeOrders(ctx *gin.Context) {
+	showtimeID, ok := h.bindShowtime(ctx)
+	if !ok {
+		return
+	}
+
+	var req OrderListRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	page, err := h.app.OrderHistoryService.ListShowtimeOrders(showtimeID, req.Cursor, req.Limit)
+	if err != nil {
+		writeOrderListError(ctx, err)
+		return
+	}
+	ctx.JSON(200, newOrderListResponse(page, true))
+}
+
+// bindShowtime parses the showtime id of the path and checks the showtime exists,
+// it writes the error response and returns false otherwise
+func (h *AdminHandler) bindShowtime(ctx *gin.Context) (uint, bool) {
+	showtimeID, ok := parseIDParam(ctx, "Invalid showtime id")
+	if !ok {
+		return 0, false
+	}
+
+	if _, err := h.app.ShowtimeService.GetShowtimeByID(showtimeID); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Showtime not found",
+				"message": "No showtime has the id",
+			})
+			return 0, false
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to get showtime, please try again later",
+		})
+		return 0, false
+	}
+	return showtimeID, true
+}
+
+type MovieRequest struct {
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description"`
+}
+
+type CreateShowtimeRequest struct {
+	MovieID  uint      `json:"movie_id" binding:"required"`
+	StartAt  time.Time `json:"start_at" binding:"required"`
+	Capacity int       `json:"capacity"`
+}
+
+type UpdateShowtimeRequest struct {
+	StartAt time.Time `json:"start_at" binding:"required"`
+	// the tickets left change by as much as the capacity
+	Capacity int `json:"capacity" binding:"required"`
+}
+
+type SetPriceRequest struct {
+	Category string `json:"category" binding:"required"`
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type CreatePromoCodeRequest struct {
+	Code           string     `json:"code" binding:"required"`
+	DiscountType   string     `json:"discount_type" binding:"required"`
+	DiscountValue  int        `json:"discount_value"`
+	MaxUses        int        `json:"max_uses"`
+	MaxUsesPerUser int        `json:"max_uses_per_user"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	ShowtimeID     *uint      `json:"showtime_id"`
+	MovieID        *uint      `json:"movie_id"`
+}
+
+type AdjustInventoryRequest struct {
+	// tickets to add, negative to remove
+	Delta int `json:"delta"`
+}
+
+type ChallengeDifficultyRequest struct {
+	// leading zero bits of the proof-of-work, 0 resets it to the default
+	Difficulty int `json:"difficulty"`
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+type AuthHandler struct {
+	app *app.App
+}
+
+func NewAuthHandler(app *app.App) *AuthHandler {
+	return &AuthHandler{
+		app: app,
+	}
+}
+
+// HandleRegister creates a user, the user logs in afterwards
+func (h *AuthHandler) HandleRegister(ctx *gin.Context) {
+	var req CredentialRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	user, err := h.app.UserService.Register(req.Name, req.Password)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidUserName) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid user name",
+				"message": "The user name must be 1 to 64 characters",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrInvalidPassword) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid password",
+				"message": "The password must be 8 to 72 bytes",
+			})
+			return
+		}
+		if errors.Is(err, service.ErrAlreadyExists) {
+			ctx.JSON(409, gin.H{
+				"error":   "User already exists",
+				"message": "The user name is taken",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to register, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(201, gin.H{
+		"message": "User registered",
+		"user_id": user.ID,
+		"name":    user.Name,
+	})
+}
+
+// HandleLogin checks the password and returns an access token and a refresh token
+func (h *AuthHandler) HandleLogin(ctx *gin.Context) {
+	var req CredentialRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	tokens, err := h.app.UserService.Login(req.Name, req.Password)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredential) {
+			ctx.JSON(401, gin.H{
+				"error":   "Invalid credential",
+				"message": "The user name or password is wrong",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to log in, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, newTokenResponse(tokens))
+}
+
+// HandleRefresh trades a refresh token for new tokens, the refresh token can only be used once
+func (h *AuthHandler) HandleRefresh(ctx *gin.Context) {
+	var req RefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	tokens, err := h.app.UserService.Refresh(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidCredential) {
+			ctx.JSON(401, gin.H{
+				"error":   "Invalid refresh token",
+				"message": "The refresh token is invalid, expired or already used, please log in again",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to refresh token, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, newTokenResponse(tokens))
+}
+
+func newTokenResponse(tokens *domain.AuthTokens) gin.H {
+	return gin.H{
+		"user_id":                  tokens.UserID,
+		"token_type":               "Bearer",
+		"access_token":             tokens.AccessToken,
+		"access_token_expires_at":  tokens.AccessTokenExpiresAt,
+		"refresh_token":            tokens.RefreshToken,
+		"refresh_token_expires_at": tokens.RefreshTokenExpiresAt,
+	}
+}
+
+type CredentialRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
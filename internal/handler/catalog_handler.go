@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// CatalogHandler serves the public movie and showtime listings, no login is needed
+type CatalogHandler struct {
+	app *app.App
+}
+
+func NewCatalogHandler(app *app.App) *CatalogHandler {
+	return &CatalogHandler{
+		app: app,
+	}
+}
+
+func (h *CatalogHandler) HandleListMovies(ctx *gin.Context) {
+	var req PageRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	page, err := h.app.CatalogService.ListMovies(req.pageQuery())
+	if err != nil {
+		writeCatalogError(ctx, err, "Movie not found")
+		return
+	}
+	ctx.JSON(200, page)
+}
+
+func (h *CatalogHandler) HandleGetMovie(ctx *gin.Context) {
+	movieID, ok := parseIDParam(ctx, "Invalid movie id")
+	if !ok {
+		return
+	}
+
+	movie, err := h.app.CatalogService.GetMovie(movieID)
+	if err != nil {
+		writeCatalogError(ctx, err, "Movie not found")
+		return
+	}
+	ctx.JSON(200, movie)
+}
+
+// HandleListMovieShowtimes lists the showtimes of a movie, like HandleListShowtimes with movie_id set
+func (h *CatalogHandler) HandleListMovieShowtimes(ctx *gin.Context) {
+	movieID, ok := parseIDParam(ctx, "Invalid movie id")
+	if !ok {
+		return
+	}
+
+	var req ShowtimeListRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+	req.MovieID = movieID
+
+	// an unknown movie is a 404 rather than an empty list
+	if _, err := h.app.CatalogService.GetMovie(movieID); err != nil {
+		writeCatalogError(ctx, err, "Movie not found")
+		return
+	}
+	h.listShowtimes(ctx, req)
+}
+
+// HandleListShowtimes lists showtimes by start time, optionally of one movie and starting within [from, to)
+func (h *CatalogHandler) HandleListShowtimes(ctx *gin.Context) {
+	var req ShowtimeListRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+	h.listShowtimes(ctx, req)
+}
+
+func (h *CatalogHandler) HandleGetShowtime(ctx *gin.Context) {
+	showtimeID, ok := parseIDParam(ctx, "Invalid showtime id")
+	if !ok {
+		return
+	}
+
+	showtime, err := h.app.CatalogService.GetShowtime(showtimeID)
+	if err != nil {
+		writeCatalogError(ctx, err, "Showtime not found")
+		return
+	}
+	ctx.JSON(200, showtime)
+}
+
+func (h *CatalogHandler) listShowtimes(ctx *gin.Context, req ShowtimeListRequest) {
+	filter := repository.ShowtimeFilter{
+		MovieID: req.MovieID,
+		From:    req.From,
+		To:      req.To,
+	}
+	page, err := h.app.CatalogService.ListShowtimes(filter, req.pageQuery())
+	if err != nil {
+		writeCatalogError(ctx, err, "Showtime not found")
+		return
+	}
+	ctx.JSON(200, page)
+}
+
+func writeCatalogError(ctx *gin.Context, err error, notFound string) {
+	switch {
+	case errors.Is(err, domain.ErrInvalidCatalogQuery):
+		ctx.JSON(400, gin.H{
+			"error":   "Invalid query",
+			"message": "page must be at least 1, page_size 1 to 100, and from before to",
+		})
+	case errors.Is(err, service.ErrNotFound):
+		ctx.JSON(404, gin.H{
+			"error":   notFound,
+			"message": "Nothing has the id",
+		})
+	default:
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to query the catalog, please try again later",
+		})
+	}
+}
+
+type PageRequest struct {
+	Page     int `form:"page"`
+	PageSize int `form:"page_size"`
+}
+
+func (r PageRequest) pageQuery() domain.PageQuery {
+	return domain.PageQuery{
+		Page:     r.Page,
+		PageSize: r.PageSize,
+	}
+}
+
+type ShowtimeListRequest struct {
+	PageRequest
+	MovieID uint `form:"movie_id"`
+	// RFC 3339 times
+	From time.Time `form:"from"`
+	To   time.Time `form:"to"`
+}
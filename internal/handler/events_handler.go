@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
+)
+
+// how often an idle stream sends a comment, so proxies don't close it
+const eventStreamHeartbeat = 15 * time.Second
+
+type EventsHandler struct {
+	app *app.App
+}
+
+func NewEventsHandler(app *app.App) *EventsHandler {
+	return &EventsHandler{
+		app: app,
+	}
+}
+
+// HandleReservationEvents streams the state changes of one of the user's reservations as server-sent events.
+// The current state is sent first, then every change until the client disconnects.
+func (h *EventsHandler) HandleReservationEvents(ctx *gin.Context) {
+	reservationID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid reservation id",
+			"detail": err.Error(),
+		})
+		return
+	}
+	userID := CurrentUserID(ctx)
+
+	// subscribe before reading the state, a change in between would be missed otherwise
+	sub := h.app.ReservationEvents.Subscribe(userID)
+	defer h.app.ReservationEvents.Unsubscribe(sub)
+
+	status, err := h.app.ReservationWorkflow.Status(uint(reservationID), userID)
+	if err != nil {
+		if errors.Is(err, cache.ErrReservationNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Reservation not found",
+				"message": "You have no reservation with the id",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to query reservation, please try again later",
+		})
+		return
+	}
+
+	startEventStream(ctx)
+	ctx.SSEvent("status", realtime.Event{
+		ReservationID: status.ReservationID,
+		UserID:        status.UserID,
+		State:         status.State,
+		OrderStatus:   status.OrderStatus,
+		At:            time.Now(),
+	})
+	streamEvents(ctx, sub, func(event realtime.Event) bool {
+		return event.ReservationID == status.ReservationID
+	})
+}
+
+// HandleUserEvents streams the state changes of all the user's reservations as server-sent events,
+// until the client disconnects
+func (h *EventsHandler) HandleUserEvents(ctx *gin.Context) {
+	sub := h.app.ReservationEvents.Subscribe(CurrentUserID(ctx))
+	defer h.app.ReservationEvents.Unsubscribe(sub)
+
+	startEventStream(ctx)
+	// sends the headers, so the client knows the stream is open before the first change
+	ctx.Writer.Flush()
+	streamEvents(ctx, sub, func(realtime.Event) bool {
+		return true
+	})
+}
+
+func startEventStream(ctx *gin.Context) {
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+}
+
+// streamEvents sends the events of the subscription that match as status events,
+// until the client disconnects or the server shuts down
+func streamEvents(ctx *gin.Context, sub *realtime.Subscription, match func(realtime.Event) bool) {
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// shutting down
+				return false
+			}
+			if match(event) {
+				ctx.SSEvent("status", event)
+			}
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -2,11 +2,15 @@ package handler
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/qs-lzh/flash-sale/internal/app"
 	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
 )
 
 type ReserveHandler struct {
@@ -29,7 +33,57 @@ func (h *ReserveHandler) HandleReserve(ctx *gin.Context) {
 		return
 	}
 
-	if err := h.app.ReservationWorkflow.Reserve(req.UserID, req.ShowtimeID); err != nil {
+	if h.app.ChallengeService.Enabled() {
+		err := h.app.ChallengeService.VerifySolution(CurrentUserID(ctx), req.ShowtimeID, req.Challenge,
+			req.ChallengeSolution)
+		if err != nil {
+			writeChallengeError(ctx, err)
+			return
+		}
+	}
+
+	category := model.TicketCategory(req.Category)
+	if category == "" {
+		category = model.TicketCategoryStandard
+	}
+
+	reservation, err := h.app.ReservationWorkflow.Reserve(CurrentUserID(ctx), req.ShowtimeID, category, req.PromoCode)
+	if err != nil {
+		if errors.Is(err, domain.ErrInvalidTicketCategory) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid ticket category",
+				"message": "The ticket category must be standard, vip or student",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrPromoNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Promo code not found",
+				"message": "The promo code doesn't exist",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrPromoNotApplicable) {
+			ctx.JSON(422, gin.H{
+				"error":   "Promo code not applicable",
+				"message": "The promo code is not valid for this showtime at the moment",
+			})
+			return
+		}
+		if errors.Is(err, cache.ErrPromoExhausted) || errors.Is(err, cache.ErrPromoUserExhausted) {
+			ctx.JSON(409, gin.H{
+				"error":   "Promo code used up",
+				"message": "The promo code has no uses left",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrPriceNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Ticket category not on sale",
+				"message": "This showtime doesn't sell tickets of the category",
+			})
+			return
+		}
 		if errors.Is(err, cache.ErrSoldOut) {
 			ctx.JSON(409, gin.H{
 				"error":   "Tickets sold out",
@@ -52,13 +106,250 @@ func (h *ReserveHandler) HandleReserve(ctx *gin.Context) {
 	}
 
 	ctx.JSON(200, gin.H{
-		"message": "Ticket reserved successfully",
-		"status":  "RESERVED",
-		"note":    "Please complete payment within 15 minutes",
+		"message":           "Ticket reserved successfully",
+		"status":            "RESERVED",
+		"reservation_id":    reservation.ID,
+		"reservation_token": reservation.Token,
+		"expires_at":        reservation.ExpiresAt,
+		"category":          reservation.Category,
+		"amount":            reservation.Amount,
+		"currency":          reservation.Currency,
+		"promo_code":        reservation.PromoCode,
+		"discount":          reservation.Discount,
+		"note":              "Please complete payment before the reservation expires",
 	})
 }
 
+// the user is the one the access token was issued to
 type ReserveRequest struct {
-	UserID     uint `json:"user_id"`
 	ShowtimeID uint `json:"showtime_id"`
+	// ticket category, standard if it's empty
+	Category string `json:"category"`
+	// optional discount code
+	PromoCode string `json:"promo_code"`
+	// the challenge from GET /challenges and its solution, when challenges are turned on
+	Challenge         string `json:"challenge"`
+	ChallengeSolution string `json:"challenge_solution"`
+}
+
+// HandleGetChallenge issues the challenge to solve before reserving a ticket of a showtime
+func (h *ReserveHandler) HandleGetChallenge(ctx *gin.Context) {
+	if !h.app.ChallengeService.Enabled() {
+		ctx.JSON(404, gin.H{
+			"error":   "Challenges disabled",
+			"message": "Reserving doesn't require a challenge",
+		})
+		return
+	}
+
+	showtimeID, err := strconv.ParseUint(ctx.Query("showtime_id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid showtime id",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	issued, err := h.app.ChallengeService.IssueChallenge(CurrentUserID(ctx), uint(showtimeID))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Showtime not found",
+				"message": "No showtime with the id is on sale",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to issue challenge, please try again later",
+		})
+		return
+	}
+	ctx.JSON(200, issued)
+}
+
+func writeChallengeError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, domain.ErrChallengeRequired):
+		ctx.JSON(403, gin.H{
+			"error":   "Challenge required",
+			"message": "Solve a challenge from GET /challenges and send it with challenge_solution",
+		})
+	case errors.Is(err, domain.ErrInvalidChallenge):
+		ctx.JSON(403, gin.H{
+			"error":   "Invalid challenge",
+			"message": "The challenge is invalid, expired or was issued for another showtime",
+		})
+	case errors.Is(err, domain.ErrChallengeUsed):
+		ctx.JSON(403, gin.H{
+			"error":   "Challenge used",
+			"message": "Every challenge lets one reservation through, get a new one",
+		})
+	case errors.Is(err, domain.ErrWrongChallengeSolution):
+		ctx.JSON(403, gin.H{
+			"error":   "Wrong challenge solution",
+			"message": "The solution doesn't solve the challenge",
+		})
+	default:
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to verify challenge, please try again later",
+		})
+	}
+}
+
+// HandlePay starts the payment of a reservation, the result is reported by the payment provider later
+func (h *ReserveHandler) HandlePay(ctx *gin.Context) {
+	reservationID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid reservation id",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	var req PayRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	reservation, err := h.app.ReservationWorkflow.Pay(uint(reservationID), req.ReservationToken)
+	if err != nil {
+		if errors.Is(err, cache.ErrReservationNotFound) || errors.Is(err, domain.ErrInvalidReservationToken) {
+			ctx.JSON(404, gin.H{
+				"error":   "Reservation not found",
+				"message": "No reservation matches the id and token",
+			})
+			return
+		}
+		if errors.Is(err, cache.ErrInvalidReservationStatus) {
+			ctx.JSON(409, gin.H{
+				"error":   "Reservation not payable",
+				"message": "The reservation is already paid or has expired",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to start payment, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(202, gin.H{
+		"message":        "Payment started",
+		"reservation_id": reservation.ID,
+		"expires_at":     reservation.ExpiresAt,
+	})
+}
+
+type PayRequest struct {
+	ReservationToken string `json:"reservation_token" binding:"required"`
+}
+
+// HandleCancel releases a reservation which hasn't been paid, the ticket can be reserved again at once
+func (h *ReserveHandler) HandleCancel(ctx *gin.Context) {
+	reservationID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid reservation id",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	var req CancelRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	reservation, err := h.app.ReservationWorkflow.Cancel(uint(reservationID), req.ReservationToken)
+	if err != nil {
+		if errors.Is(err, cache.ErrReservationNotFound) || errors.Is(err, domain.ErrInvalidReservationToken) {
+			ctx.JSON(404, gin.H{
+				"error":   "Reservation not found",
+				"message": "No reservation matches the id and token",
+			})
+			return
+		}
+		if errors.Is(err, cache.ErrInvalidReservationStatus) {
+			ctx.JSON(409, gin.H{
+				"error":   "Reservation not cancellable",
+				"message": "The reservation is being paid, already paid or has expired",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to cancel reservation, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"message":        "Reservation cancelled",
+		"status":         reservation.Status,
+		"reservation_id": reservation.ID,
+	})
+}
+
+type CancelRequest struct {
+	ReservationToken string `json:"reservation_token" binding:"required"`
+}
+
+// HandleGetReservation tells the owner of a reservation whether it's still held, paid, expired or already an order,
+// reservations of other users are not found
+func (h *ReserveHandler) HandleGetReservation(ctx *gin.Context) {
+	reservationID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid reservation id",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	status, err := h.app.ReservationWorkflow.Status(uint(reservationID), CurrentUserID(ctx))
+	if err != nil {
+		if errors.Is(err, cache.ErrReservationNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Reservation not found",
+				"message": "You have no reservation with the id",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to query reservation, please try again later",
+		})
+		return
+	}
+
+	resp := gin.H{
+		"reservation_id": status.ReservationID,
+		"showtime_id":    status.ShowtimeID,
+		"status":         status.State,
+		"category":       status.Category,
+		"amount":         status.Amount,
+		"currency":       status.Currency,
+		"promo_code":     status.PromoCode,
+		"discount":       status.Discount,
+	}
+	if !status.ExpiresAt.IsZero() {
+		resp["expires_at"] = status.ExpiresAt
+	}
+	if status.OrderStatus != "" {
+		resp["order_status"] = status.OrderStatus
+	}
+	ctx.JSON(200, resp)
 }
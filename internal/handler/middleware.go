@@ -0,0 +1,329 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/auth"
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// keys of the authenticated user in the gin context
+const (
+	contextKeyUserID   = "user_id"
+	contextKeyUserRole = "user_role"
+)
+
+// RequireAuth rejects requests without a valid access token in the Authorization header,
+// the user of the token is available through CurrentUserID and CurrentUserRole afterwards
+func RequireAuth(tokens *auth.TokenManager) gin.HandlerFunc {
+	return requireAuth(tokens, false)
+}
+
+// RequireStreamAuth is RequireAuth for event streams, EventSource can't set headers,
+// so the token may be sent in the access_token query parameter as well
+func RequireStreamAuth(tokens *auth.TokenManager) gin.HandlerFunc {
+	return requireAuth(tokens, true)
+}
+
+func requireAuth(tokens *auth.TokenManager, allowQuery bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok && allowQuery {
+			token = ctx.Query("access_token")
+		}
+		if token == "" {
+			ctx.Header("WWW-Authenticate", "Bearer")
+			ctx.AbortWithStatusJSON(401, gin.H{
+				"error":   "Unauthorized",
+				"message": "An access token is required",
+			})
+			return
+		}
+
+		claims, err := tokens.ParseAccessToken(token)
+		if err != nil {
+			ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			ctx.AbortWithStatusJSON(401, gin.H{
+				"error":   "Unauthorized",
+				"message": "The access token is invalid or has expired",
+			})
+			return
+		}
+		// ParseAccessToken checked the subject
+		userID, _ := claims.UserID()
+
+		ctx.Set(contextKeyUserID, userID)
+		ctx.Set(contextKeyUserRole, claims.Role)
+		ctx.Next()
+	}
+}
+
+// RequireRole rejects users authenticated by RequireAuth who don't have the role,
+// every rejection is recorded in the audit log
+func RequireRole(audit domain.AuditService, role model.UserRole) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if CurrentUserRole(ctx) != role {
+			deny(ctx, audit, "role:"+string(role))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequirePermission rejects users authenticated by RequireAuth whose role doesn't have the permission,
+// every rejection is recorded in the audit log
+func RequirePermission(audit domain.AuditService, permission model.Permission) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !CurrentUserRole(ctx).Can(permission) {
+			deny(ctx, audit, string(permission))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// deny records the rejection and aborts with 403, the request is denied even if recording fails
+func deny(ctx *gin.Context, audit domain.AuditService, required string) {
+	entry := &model.AuditLog{
+		UserID:   CurrentUserID(ctx),
+		Role:     CurrentUserRole(ctx),
+		Method:   ctx.Request.Method,
+		Path:     ctx.Request.URL.Path,
+		Required: required,
+		ClientIP: ctx.ClientIP(),
+	}
+	if err := audit.RecordDenial(entry); err != nil {
+		log.Printf("Failed to record denial of %s %s to user %d: %v", entry.Method, entry.Path, entry.UserID, err)
+	}
+
+	ctx.AbortWithStatusJSON(403, gin.H{
+		"error":   "Forbidden",
+		"message": "You aren't allowed to do this",
+	})
+}
+
+// RateLimit limits the requests to a route per client ip, and per user once RequireAuth ran,
+// with the limits configured as route.ip and route.user. Limited requests get 429 with Retry-After.
+// If redis can't be asked, requests are let through or get 503 as configured
+func RateLimit(app *app.App, route string) gin.HandlerFunc {
+	ipLimit, limitIP := app.Config.RateLimits[route+".ip"]
+	userLimit, limitUser := app.Config.RateLimits[route+".user"]
+
+	return func(ctx *gin.Context) {
+		if limitIP && !takeRateLimitToken(ctx, app, route+".ip", ctx.ClientIP(), ipLimit) {
+			return
+		}
+		if userID := CurrentUserID(ctx); limitUser && userID != 0 &&
+			!takeRateLimitToken(ctx, app, route+".user", strconv.FormatUint(uint64(userID), 10), userLimit) {
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// takeRateLimitToken aborts the request and returns false if the subject is over the limit
+func takeRateLimitToken(ctx *gin.Context, app *app.App, bucket string, subject string, limit config.RateLimit) bool {
+	allowed, retryAfter, err := app.Cache.TakeRateLimitToken(bucket, subject, limit.Limit, limit.Period)
+	if err != nil {
+		log.Printf("Failed to check rate limit %s of %s: %v", bucket, subject, err)
+		if app.Config.RateLimitFailOpen {
+			return true
+		}
+		ctx.AbortWithStatusJSON(503, gin.H{
+			"error":   "Service unavailable",
+			"message": "Please try again later",
+		})
+		return false
+	}
+	if allowed {
+		return true
+	}
+
+	seconds := max(1, int(math.Ceil(retryAfter.Seconds())))
+	ctx.Header("Retry-After", strconv.Itoa(seconds))
+	ctx.AbortWithStatusJSON(429, gin.H{
+		"error":   "Too many requests",
+		"message": fmt.Sprintf("Please retry in %v", time.Duration(seconds)*time.Second),
+	})
+	return false
+}
+
+const (
+	// how long a request with an Idempotency-Key may run before a duplicate may run it again
+	idempotencyPendingTTL = time.Minute
+	// how often a duplicate checks whether the first request finished
+	idempotencyPollInterval = 50 * time.Millisecond
+)
+
+// Idempotent makes a route safe to retry with an Idempotency-Key header: the first response with a key is stored,
+// and later requests with the key get it replayed with the Idempotent-Replayed header instead of running again.
+// A duplicate arriving while the first is running waits for its response.
+// Keys belong to the user once RequireAuth ran, otherwise to the :id of the path.
+// Requests without the header run as usual, and 5xx responses aren't stored so the request can be retried
+func Idempotent(app *app.App, route string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader("Idempotency-Key")
+		if key == "" {
+			ctx.Next()
+			return
+		}
+		if len(key) > 255 || strings.ContainsFunc(key, func(r rune) bool { return r < 0x21 || r > 0x7e }) {
+			ctx.AbortWithStatusJSON(400, gin.H{
+				"error":   "Invalid Idempotency-Key",
+				"message": "The key must be 1 to 255 printable ascii characters without spaces",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.AbortWithStatusJSON(400, gin.H{
+				"error":  "Invalid request format",
+				"detail": err.Error(),
+			})
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%s\n%s", ctx.Request.Method, ctx.Request.URL.Path, body))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		scope := idempotencyScope(ctx, route)
+		deadline := time.Now().Add(app.Config.IdempotencyWaitTimeout)
+		for {
+			claimed, err := app.Cache.ClaimIdempotencyKey(scope, key, cache.IdempotencyRecord{Fingerprint: fingerprint},
+				idempotencyPendingTTL)
+			if err != nil {
+				abortIdempotencyError(ctx, err)
+				return
+			}
+			if claimed {
+				runIdempotent(ctx, app, scope, key, fingerprint)
+				return
+			}
+
+			record, err := app.Cache.GetIdempotencyRecord(scope, key)
+			if errors.Is(err, cache.ErrCacheMiss) {
+				// the first request failed and released the key in between, claim it again
+				continue
+			}
+			if err != nil {
+				abortIdempotencyError(ctx, err)
+				return
+			}
+			if record.Fingerprint != fingerprint {
+				ctx.AbortWithStatusJSON(422, gin.H{
+					"error":   "Idempotency-Key reused",
+					"message": "The key was used for a different request",
+				})
+				return
+			}
+			if record.Completed {
+				ctx.Header("Idempotent-Replayed", "true")
+				ctx.Data(record.Status, record.ContentType, record.Body)
+				ctx.Abort()
+				return
+			}
+
+			if time.Now().After(deadline) {
+				ctx.Header("Retry-After", "1")
+				ctx.AbortWithStatusJSON(409, gin.H{
+					"error":   "Request in progress",
+					"message": "A request with the Idempotency-Key is still running, retry later",
+				})
+				return
+			}
+			select {
+			case <-time.After(idempotencyPollInterval):
+			case <-ctx.Request.Context().Done():
+				ctx.Abort()
+				return
+			}
+		}
+	}
+}
+
+// runIdempotent runs the request that claimed the key and stores its response
+func runIdempotent(ctx *gin.Context, app *app.App, scope string, key string, fingerprint string) {
+	recorder := &responseRecorder{ResponseWriter: ctx.Writer}
+	ctx.Writer = recorder
+	ctx.Next()
+
+	status := recorder.Status()
+	if status >= 500 {
+		if err := app.Cache.ReleaseIdempotencyKey(scope, key); err != nil {
+			log.Printf("Failed to release idempotency key %s of %s: %v", key, scope, err)
+		}
+		return
+	}
+
+	record := cache.IdempotencyRecord{
+		Fingerprint: fingerprint,
+		Completed:   true,
+		Status:      status,
+		ContentType: recorder.Header().Get("Content-Type"),
+		Body:        recorder.body.Bytes(),
+	}
+	if err := app.Cache.SaveIdempotencyRecord(scope, key, record, app.Config.IdempotencyKeyTTL); err != nil {
+		log.Printf("Failed to save response of idempotency key %s of %s: %v", key, scope, err)
+	}
+}
+
+// idempotencyScope is the owner of the keys of a request, so users can't see each other's responses
+func idempotencyScope(ctx *gin.Context, route string) string {
+	if userID := CurrentUserID(ctx); userID != 0 {
+		return fmt.Sprintf("%s:user:%d", route, userID)
+	}
+	return fmt.Sprintf("%s:%s", route, ctx.Param("id"))
+}
+
+func abortIdempotencyError(ctx *gin.Context, err error) {
+	log.Printf("Failed to check idempotency key: %v", err)
+	ctx.AbortWithStatusJSON(500, gin.H{
+		"error":   "Internal server error",
+		"message": "Failed to check Idempotency-Key, please try again later",
+	})
+}
+
+// responseRecorder copies the response body while it's written
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// CurrentUserID returns the user authenticated by RequireAuth
+func CurrentUserID(ctx *gin.Context) uint {
+	return ctx.GetUint(contextKeyUserID)
+}
+
+// CurrentUserRole returns the role of the user authenticated by RequireAuth
+func CurrentUserRole(ctx *gin.Context) model.UserRole {
+	role, _ := ctx.Get(contextKeyUserRole)
+	r, _ := role.(model.UserRole)
+	return r
+}
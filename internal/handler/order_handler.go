@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+type OrderHandler struct {
+	app *app.App
+}
+
+func NewOrderHandler(app *app.App) *OrderHandler {
+	return &OrderHandler{
+		app: app,
+	}
+}
+
+// HandleRefund queues the refund of a paid order, the order becomes REFUNDED once the provider refunded it
+func (h *OrderHandler) HandleRefund(ctx *gin.Context) {
+	orderID, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid order id",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	order, err := h.app.OrderWorkflow.RequestRefund(uint(orderID), CurrentUserID(ctx))
+	if err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			ctx.JSON(404, gin.H{
+				"error":   "Order not found",
+				"message": "You have no order with this id",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrInvalidOrderStatus) {
+			ctx.JSON(409, gin.H{
+				"error":   "Order not refundable",
+				"message": "Only paid orders can be refunded",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to request refund, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(202, gin.H{
+		"message":  "Refund requested",
+		"order_id": order.ID,
+	})
+}
+
+// HandleListMyOrders lists the orders of the user with the reservations still held or being paid, newest first
+func (h *OrderHandler) HandleListMyOrders(ctx *gin.Context) {
+	var req OrderListRequest
+	if err := ctx.ShouldBindQuery(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	page, err := h.app.OrderHistoryService.ListUserOrders(CurrentUserID(ctx), req.Cursor, req.Limit)
+	if err != nil {
+		writeOrderListError(ctx, err)
+		return
+	}
+	ctx.JSON(200, newOrderListResponse(page, false))
+}
+
+func writeOrderListError(ctx *gin.Context, err error) {
+	if errors.Is(err, domain.ErrInvalidOrderHistoryLimit) {
+		ctx.JSON(400, gin.H{
+			"error":   "Invalid limit",
+			"message": "The limit must be 1 to 100",
+		})
+		return
+	}
+	ctx.JSON(500, gin.H{
+		"error":   "Internal server error",
+		"message": "Failed to list orders, please try again later",
+	})
+}
+
+// newOrderListResponse lays the items out like HandleGetReservation, withUser adds the owner for staff
+func newOrderListResponse(page *domain.OrderHistoryPage, withUser bool) gin.H {
+	items := make([]gin.H, len(page.Items))
+	for i, item := range page.Items {
+		resp := gin.H{
+			"reservation_id": item.ReservationID,
+			"showtime_id":    item.ShowtimeID,
+			"movie_id":       item.MovieID,
+			"movie_title":    item.MovieTitle,
+			"start_at":       item.StartAt,
+			"status":         item.State,
+			"category":       item.Category,
+			"amount":         item.Amount,
+			"currency":       item.Currency,
+			"promo_code":     item.PromoCode,
+			"discount":       item.Discount,
+		}
+		if !item.ExpiresAt.IsZero() {
+			resp["expires_at"] = item.ExpiresAt
+		}
+		if item.OrderStatus != "" {
+			resp["order_status"] = item.OrderStatus
+		}
+		if withUser {
+			resp["user_id"] = item.UserID
+		}
+		items[i] = resp
+	}
+
+	resp := gin.H{
+		"items": items,
+	}
+	if page.NextCursor != 0 {
+		resp["next_cursor"] = page.NextCursor
+	}
+	return resp
+}
+
+type OrderListRequest struct {
+	// next_cursor of the previous page
+	Cursor uint `form:"cursor"`
+	Limit  int  `form:"limit"`
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/webhook"
+)
+
+// how long a received event id is remembered for replay protection,
+// much longer than the timestamp tolerance so a replay is caught either way
+const webhookEventTTL = 24 * time.Hour
+
+type PaymentHandler struct {
+	app *app.App
+}
+
+func NewPaymentHandler(app *app.App) *PaymentHandler {
+	return &PaymentHandler{
+		app: app,
+	}
+}
+
+// HandleWebhook receives payment results from the payment provider.
+// The request must be signed with the provider's secret, recently, and carry an event id not seen before.
+// A non-2xx response makes the provider deliver the event again.
+func (h *PaymentHandler) HandleWebhook(ctx *gin.Context) {
+	body, err := ctx.GetRawData()
+	if err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	provider := ctx.GetHeader(webhook.ProviderHeader)
+	secret, ok := h.app.Config.PaymentWebhookSecrets[provider]
+	if !ok || secret == "" {
+		h.reject(ctx, 401, "unknown payment provider", provider, "")
+		return
+	}
+
+	if err := webhook.Verify(secret, ctx.GetHeader(webhook.SignatureHeader), body,
+		h.app.Config.PaymentWebhookTolerance, time.Now()); err != nil {
+		h.reject(ctx, 401, err.Error(), provider, "")
+		return
+	}
+
+	var event domain.PaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+	if event.EventID == "" || event.Provider != provider {
+		h.reject(ctx, 400, "event doesn't match the signing provider", provider, event.EventID)
+		return
+	}
+
+	claimed, err := h.app.Cache.ClaimWebhookEvent(provider, event.EventID, webhookEventTTL)
+	if err != nil {
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to process payment event",
+		})
+		return
+	}
+	if !claimed {
+		h.reject(ctx, 409, "replayed event id", provider, event.EventID)
+		return
+	}
+
+	if err := h.app.PaymentWorkflow.HandlePaymentEvent(event); err != nil {
+		// let the provider deliver the event again
+		if err := h.app.Cache.ReleaseWebhookEvent(provider, event.EventID); err != nil {
+			log.Printf("Failed to release webhook event %s: %v", event.EventID, err)
+		}
+
+		if errors.Is(err, cache.ErrReservationNotFound) ||
+			errors.Is(err, domain.ErrPaymentIntentMismatch) ||
+			errors.Is(err, domain.ErrPaymentNotVerified) ||
+			errors.Is(err, cache.ErrInvalidReservationStatus) {
+			h.reject(ctx, 400, err.Error(), provider, event.EventID)
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to process payment event",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"message": "Payment event received",
+	})
+}
+
+// reject answers with status and records the attempt in the security log
+func (h *PaymentHandler) reject(ctx *gin.Context, status int, reason string, provider string, eventID string) {
+	h.app.SecurityLogger.Warn("payment webhook rejected",
+		zap.String("reason", reason),
+		zap.String("provider", provider),
+		zap.String("event_id", eventID),
+		zap.String("remote_addr", ctx.ClientIP()),
+		zap.Int("status", status),
+	)
+	ctx.JSON(status, gin.H{
+		"error":   "Payment event rejected",
+		"message": reason,
+	})
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/service/workflow"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+	"github.com/qs-lzh/flash-sale/internal/webhook"
+)
+
+const testWebhookSecret = "secret"
+
+func newWebhookTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+
+	redisCache := testutil.Redis(t)
+	provider := domain.NewMockPaymentProvider(func(domain.PaymentEvent) error { return nil }, domain.MockPaymentOptions{})
+	paymentService := domain.NewPaymentService(redisCache, provider)
+	a := &app.App{
+		Config: &config.Config{
+			PaymentWebhookSecrets:   map[string]string{domain.PaymentProviderLocal: testWebhookSecret},
+			PaymentWebhookTolerance: 5 * time.Minute,
+		},
+		Cache:          redisCache,
+		SecurityLogger: zap.NewNop(),
+		PaymentWorkflow: workflow.NewPaymentWorkflow(paymentService, nil,
+			workflow.NewMessageDeduplicator(redisCache, time.Minute), nil, nil),
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/payments/webhook", NewPaymentHandler(a).HandleWebhook)
+	return r
+}
+
+func sendWebhook(r *gin.Engine, event domain.PaymentEvent) int {
+	body, _ := json.Marshal(event)
+	req := httptest.NewRequest(http.MethodPost, "/payments/webhook", bytes.NewReader(body))
+	req.Header.Set(webhook.ProviderHeader, event.Provider)
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(testWebhookSecret, time.Now(), body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestHandleWebhook_RejectsReplayedEventID(t *testing.T) {
+	r := newWebhookTestRouter(t)
+
+	// a pending intent isn't acted on, the event only has to get through the checks
+	event := domain.PaymentEvent{
+		EventID:  fmt.Sprintf("evt_test_%d", testutil.ID()),
+		Provider: domain.PaymentProviderLocal,
+		IntentID: "pi_test",
+		Status:   domain.PaymentIntentStatusPending,
+	}
+	if code := sendWebhook(r, event); code != 200 {
+		t.Fatalf("Expected the event to be accepted, got %d", code)
+	}
+	// signed again, so only the event id gives the replay away
+	if code := sendWebhook(r, event); code != 409 {
+		t.Errorf("Expected the replay to be rejected with 409, got %d", code)
+	}
+}
+
+func TestHandleWebhook_ReleasesEventIDOfFailedEvent(t *testing.T) {
+	r := newWebhookTestRouter(t)
+
+	event := domain.PaymentEvent{
+		EventID:       fmt.Sprintf("evt_test_%d", testutil.ID()),
+		Provider:      domain.PaymentProviderLocal,
+		IntentID:      "pi_test",
+		ReservationID: testutil.ID(),
+		Status:        domain.PaymentIntentStatusSucceeded,
+	}
+	// the reservation doesn't exist
+	if code := sendWebhook(r, event); code != 400 {
+		t.Fatalf("Expected the event to be rejected with 400, got %d", code)
+	}
+	// the provider may deliver it again, it isn't taken for a replay
+	if code := sendWebhook(r, event); code != 400 {
+		t.Errorf("Expected the redelivery to be handled again, got %d", code)
+	}
+}
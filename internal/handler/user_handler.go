@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/app"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// UserHandler serves the settings of the authenticated user
+type UserHandler struct {
+	app *app.App
+}
+
+func NewUserHandler(app *app.App) *UserHandler {
+	return &UserHandler{
+		app: app,
+	}
+}
+
+func (h *UserHandler) HandleGetNotificationPreference(ctx *gin.Context) {
+	preference, err := h.app.NotificationService.GetPreference(CurrentUserID(ctx))
+	if err != nil {
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to get notification preferences, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, newNotificationPreferenceResponse(preference))
+}
+
+// HandleSetNotificationPreference replaces the notification preferences of the user
+func (h *UserHandler) HandleSetNotificationPreference(ctx *gin.Context) {
+	var req NotificationPreferenceRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{
+			"error":  "Invalid request format",
+			"detail": err.Error(),
+		})
+		return
+	}
+
+	preference := &model.NotificationPreference{
+		UserID:       CurrentUserID(ctx),
+		Email:        req.Email,
+		Phone:        req.Phone,
+		EmailEnabled: req.EmailEnabled,
+		SMSEnabled:   req.SMSEnabled,
+	}
+	if err := h.app.NotificationService.SetPreference(preference); err != nil {
+		if errors.Is(err, domain.ErrInvalidEmail) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid email address",
+				"message": "The email must be a plain address like name@example.com",
+			})
+			return
+		}
+		if errors.Is(err, domain.ErrInvalidPhone) {
+			ctx.JSON(400, gin.H{
+				"error":   "Invalid phone number",
+				"message": "The phone number must be 6 to 15 digits, optionally starting with +",
+			})
+			return
+		}
+		ctx.JSON(500, gin.H{
+			"error":   "Internal server error",
+			"message": "Failed to save notification preferences, please try again later",
+		})
+		return
+	}
+
+	ctx.JSON(200, newNotificationPreferenceResponse(preference))
+}
+
+func newNotificationPreferenceResponse(preference *model.NotificationPreference) gin.H {
+	return gin.H{
+		"email":         preference.Email,
+		"phone":         preference.Phone,
+		"email_enabled": preference.EmailEnabled,
+		"sms_enabled":   preference.SMSEnabled,
+	}
+}
+
+type NotificationPreferenceRequest struct {
+	Email        string `json:"email"`
+	Phone        string `json:"phone"`
+	EmailEnabled bool   `json:"email_enabled"`
+	SMSEnabled   bool   `json:"sms_enabled"`
+}
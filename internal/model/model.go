@@ -11,13 +11,87 @@ type User struct {
 	Role           UserRole `gorm:"type:varchar(16);not null"`
 }
 
+// RefreshToken is a refresh token issued to a user, only the hash of the token is stored.
+// It's used once, UsedAt is set when it's traded for new tokens
+type RefreshToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// NotificationPreference is how a user wants to be notified,
+// users without one get DefaultNotificationPreference
+type NotificationPreference struct {
+	UserID       uint   `gorm:"primaryKey;autoIncrement:false"`
+	Email        string `gorm:"size:254"`
+	Phone        string `gorm:"size:32"`
+	EmailEnabled bool   `gorm:"not null"`
+	SMSEnabled   bool   `gorm:"not null"`
+}
+
+func DefaultNotificationPreference(userID uint) *NotificationPreference {
+	return &NotificationPreference{
+		UserID:       userID,
+		EmailEnabled: true,
+	}
+}
+
 type UserRole string
 
 const (
 	RoleUser  UserRole = "user"
 	RoleAdmin UserRole = "admin"
+	// customer support, may look up orders
+	RoleSupport UserRole = "support"
 )
 
+// Permission is an action only some roles may take
+type Permission string
+
+const (
+	// create and change movies, showtimes, prices and promo codes
+	PermissionManageCatalog Permission = "catalog:manage"
+	// change the remaining tickets of a showtime by hand
+	PermissionAdjustInventory Permission = "inventory:adjust"
+	// compare redis with the orders and repair what's missing
+	PermissionReconcile Permission = "reconciliation:run"
+	// look up the orders of any user or showtime
+	PermissionViewOrders Permission = "orders:view"
+)
+
+// the permissions of each role, roles missing have none
+var rolePermissions = map[UserRole][]Permission{
+	RoleAdmin:   {PermissionManageCatalog, PermissionAdjustInventory, PermissionReconcile, PermissionViewOrders},
+	RoleSupport: {PermissionViewOrders},
+}
+
+// Can reports whether the role has the permission
+func (r UserRole) Can(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLog records a request that was refused because the user lacked the role or permission
+type AuditLog struct {
+	ID uint `gorm:"primaryKey"`
+	// zero if the request wasn't authenticated
+	UserID uint     `gorm:"not null;index"`
+	Role   UserRole `gorm:"type:varchar(16)"`
+	Method string   `gorm:"size:8;not null"`
+	Path   string   `gorm:"size:255;not null"`
+	// the role or permission the route required
+	Required  string    `gorm:"size:64;not null"`
+	ClientIP  string    `gorm:"size:64"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
 type Movie struct {
 	ID          uint   `gorm:"primaryKey"`
 	Title       string `gorm:"size:100;not null;uniqueIndex"`
@@ -28,10 +102,147 @@ type Showtime struct {
 	ID      uint      `gorm:"primaryKey"`
 	MovieID uint      `gorm:"not null;index"`
 	StartAt time.Time `gorm:"not null"`
+	// tickets on sale, loaded into redis when the showtime is created and at start
+	Capacity int `gorm:"not null;default:100"`
+}
+
+// tickets of a showtime created without a capacity
+const DefaultShowtimeCapacity = 100
+
+// ShowtimePrice is the price of a ticket category of a showtime
+type ShowtimePrice struct {
+	ID         uint           `gorm:"primaryKey"`
+	ShowtimeID uint           `gorm:"not null;uniqueIndex:idx_showtime_price_category"`
+	Category   TicketCategory `gorm:"type:varchar(16);not null;uniqueIndex:idx_showtime_price_category"`
+	// in the smallest currency unit
+	Amount   int    `gorm:"not null"`
+	Currency string `gorm:"type:char(3);not null;default:CNY"`
+}
+
+type TicketCategory string
+
+const (
+	TicketCategoryStandard TicketCategory = "standard"
+	TicketCategoryVIP      TicketCategory = "vip"
+	TicketCategoryStudent  TicketCategory = "student"
+)
+
+// Valid reports whether c is one of the known ticket categories
+func (c TicketCategory) Valid() bool {
+	switch c {
+	case TicketCategoryStandard, TicketCategoryVIP, TicketCategoryStudent:
+		return true
+	}
+	return false
 }
 
+// PromoCode is a discount code customers can reserve tickets with
+type PromoCode struct {
+	ID   uint   `gorm:"primaryKey"`
+	Code string `gorm:"size:32;not null;uniqueIndex"`
+
+	DiscountType DiscountType `gorm:"type:varchar(16);not null"`
+	// percent off for DiscountTypePercent, amount off in the smallest currency unit for DiscountTypeFixed
+	DiscountValue int `gorm:"not null"`
+
+	// usage caps, 0 means unlimited
+	MaxUses        int `gorm:"not null;default:0"`
+	MaxUsesPerUser int `gorm:"not null;default:0"`
+
+	// validity window, open ended if nil
+	ValidFrom  *time.Time
+	ValidUntil *time.Time
+
+	// the code only applies to the showtime or to the showtimes of the movie if set
+	ShowtimeID *uint `gorm:"index"`
+	MovieID    *uint `gorm:"index"`
+}
+
+type DiscountType string
+
+const (
+	DiscountTypePercent DiscountType = "percent"
+	DiscountTypeFixed   DiscountType = "fixed"
+)
+
+// Discount returns how much the code takes off amount, never more than amount
+func (p *PromoCode) Discount(amount int) int {
+	var discount int
+	switch p.DiscountType {
+	case DiscountTypePercent:
+		discount = amount * p.DiscountValue / 100
+	case DiscountTypeFixed:
+		discount = p.DiscountValue
+	}
+	return min(max(discount, 0), amount)
+}
+
+// ValidAt reports whether the code can be used at t
+func (p *PromoCode) ValidAt(t time.Time) bool {
+	if p.ValidFrom != nil && t.Before(*p.ValidFrom) {
+		return false
+	}
+	if p.ValidUntil != nil && !t.Before(*p.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// Order is a paid reservation, its ID is the reservation id
 type Order struct {
-	ID         uint `gorm:"primaryKey;autoIncrement:false"`
-	ShowtimeID uint `gorm:"not null;index"`
-	UserID     uint `gorm:"not null;index"`
+	ID         uint        `gorm:"primaryKey;autoIncrement:false"`
+	ShowtimeID uint        `gorm:"not null;index"`
+	UserID     uint        `gorm:"not null;index"`
+	Status     OrderStatus `gorm:"type:varchar(16);not null;default:PAID"`
+
+	Category TicketCategory `gorm:"type:varchar(16);not null;default:standard"`
+	// price paid, in the smallest currency unit
+	Amount   int    `gorm:"not null;default:0"`
+	Currency string `gorm:"type:char(3);not null;default:CNY"`
+	// promo code the order was discounted with, and the amount it took off
+	PromoCode string `gorm:"size:32;index"`
+	Discount  int    `gorm:"not null;default:0"`
+	// reference of the payment at the provider
+	PaymentProvider string `gorm:"size:32"`
+	PaymentIntentID string `gorm:"size:64;index"`
+
+	// audit timestamps, the one of a status is set when the order enters it
+	ReservedAt  time.Time
+	PaidAt      *time.Time
+	RefundedAt  *time.Time
+	CancelledAt *time.Time
+	CheckedInAt *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// currency of the prices when nothing else is configured
+const DefaultCurrency = "CNY"
+
+type OrderStatus string
+
+const (
+	// OrderStatusPaid is the status an order is created in
+	OrderStatusPaid OrderStatus = "PAID"
+	// OrderStatusRefunded means the payment was returned to the customer
+	OrderStatusRefunded OrderStatus = "REFUNDED"
+	// OrderStatusCancelled means the order was voided without a refund through the provider, e.g. by support
+	OrderStatusCancelled OrderStatus = "CANCELLED"
+	// OrderStatusCheckedIn means the ticket was used at the entrance
+	OrderStatusCheckedIn OrderStatus = "CHECKED_IN"
+)
+
+// the statuses an order can move to from each status, the ones missing are final
+var orderStatusTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPaid: {OrderStatusRefunded, OrderStatusCancelled, OrderStatusCheckedIn},
+}
+
+// CanTransitionTo reports whether an order in status s can move to status to
+func (s OrderStatus) CanTransitionTo(to OrderStatus) bool {
+	for _, next := range orderStatusTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,91 @@
+package mq
+
+import (
+	"fmt"
+
+	"github.com/qs-lzh/flash-sale/config"
+)
+
+// supported message transports, selected by config.Config.MQBackend
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendNATS     = "nats"
+)
+
+// Broker is the message transport used by the workflows.
+// Queues are addressed by the names in constants.go on every backend.
+type Broker interface {
+	// Setup declares every queue in constants.go and clears leftover messages from previous runs
+	Setup() error
+	// Publish sends the message as json, a message sent to a delay queue
+	// is delivered to its target queue once the delay expires
+	Publish(queueName string, message any) error
+	// Consume returns the deliveries of a queue, each one must be acked or nacked
+	Consume(queueName string) (<-chan Delivery, error)
+	// StopConsuming cancels every consumer, the delivery channels are closed once
+	// the messages already received are handed out. Acks still work until Close.
+	StopConsuming() error
+	Close() error
+}
+
+// Delivery is a message received from a Broker
+type Delivery struct {
+	MessageID string
+	Body      []byte
+
+	ack  func() error
+	nack func(requeue bool) error
+	// acks this delivery and every earlier one of the same consumer, nil if the backend can't
+	ackMultiple func() error
+}
+
+// NewDelivery returns a delivery acked and nacked through ack and nack,
+// for brokers outside this package such as the fakes in tests
+func NewDelivery(messageID string, body []byte, ack func() error, nack func(requeue bool) error) Delivery {
+	return Delivery{
+		MessageID: messageID,
+		Body:      body,
+		ack:       ack,
+		nack:      nack,
+	}
+}
+
+func (d Delivery) Ack() error {
+	return d.ack()
+}
+
+// AckAll acks a batch of deliveries read from the same channel, with a single ack when the backend supports it.
+// Every delivery received before the last one must be in the batch or already acked or nacked.
+func AckAll(deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if last := deliveries[len(deliveries)-1]; last.ackMultiple != nil {
+		return last.ackMultiple()
+	}
+
+	var firstErr error
+	for _, d := range deliveries {
+		if err := d.Ack(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Nack rejects the message, it's delivered again if requeue is true and dropped otherwise
+func (d Delivery) Nack(requeue bool) error {
+	return d.nack(requeue)
+}
+
+func NewBroker(cfg *config.Config) (Broker, error) {
+	delayQueues := NewDelayQueues(cfg.ReservationHoldTimeout, cfg.NotificationRetryDelay)
+	switch cfg.MQBackend {
+	case "", BackendRabbitMQ:
+		return NewRabbitMQBroker(cfg.MQURL, delayQueues)
+	case BackendNATS:
+		return NewNATSBroker(cfg.NATSURL, cfg.NATSStoreDir, delayQueues)
+	default:
+		return nil, fmt.Errorf("unknown mq backend %q", cfg.MQBackend)
+	}
+}
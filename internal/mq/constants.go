@@ -1,6 +1,9 @@
 package mq
 
+import "time"
+
 // Queue names and message definitions
+// queue names are dot separated, so they are used as subject names by the nats backend as well
 
 // immediate queue from reservation to payment service
 // deliver message to notify payment service to handle a payment of the reservation
@@ -35,3 +38,97 @@ const (
 type PaymentToOrderImmediateMessage struct {
 	ReservationID uint `json:"reservation_id"`
 }
+
+// parked queue of order creation
+// a paid reservation which can never be turned into an order is moved here for an operator to look at,
+// the messages are kept across restarts
+const (
+	OrderCreationParkedQueue = "payment.order.create.parked"
+)
+
+type OrderCreationParkedMessage struct {
+	ReservationID uint   `json:"reservation_id"`
+	Reason        string `json:"reason"`
+	ParkedAt      int64  `json:"parked_at"` // unix seconds
+}
+
+// immediate queue from the refund api to order service
+// deliver message to notify order service to refund a paid order
+const (
+	OrderRefundImmediateQueue = "order.refund.immediate"
+)
+
+type OrderRefundImmediateMessage struct {
+	OrderID uint `json:"order_id"`
+}
+
+// immediate queue of the notifications
+// deliver message to notify the notification workflow to send a notification to a customer
+const (
+	NotificationImmediateQueue = "notification.send.immediate"
+)
+
+// delay queue of the notifications
+// a notification which failed to send is sent again once the delay expires
+const (
+	NotificationRetryDelayQueue = "notification.send.retry.delay"
+	NotificationRetryExchange   = "notification.retry.exchange"
+	NotificationRetryRoutingKey = "notification.retry"
+)
+
+type NotificationImmediateMessage struct {
+	Kind          string            `json:"kind"`
+	UserID        uint              `json:"user_id"`
+	ReservationID uint              `json:"reservation_id"`
+	Data          map[string]string `json:"data,omitempty"`
+	// only this channel is sent if set, used by retries. Every channel the user enabled otherwise
+	Channel string `json:"channel,omitempty"`
+	// how many times the notification was tried before
+	Attempt int `json:"attempt"`
+}
+
+// DelayRoute describes where a message published to a delay queue goes once its delay expires
+type DelayRoute struct {
+	TargetQueue string
+	Delay       time.Duration
+}
+
+// NewDelayQueues returns all delay queues, keyed by the delay queue name.
+// reservationTimeout is how long a reservation waits for payment before it times out,
+// notificationRetryDelay is how long a failed notification waits before it's sent again.
+func NewDelayQueues(reservationTimeout time.Duration, notificationRetryDelay time.Duration) map[string]DelayRoute {
+	return map[string]DelayRoute{
+		ReservationToPaymentDelayQueue: {
+			TargetQueue: ReservationToPaymentTimeoutQueue,
+			Delay:       reservationTimeout,
+		},
+		NotificationRetryDelayQueue: {
+			TargetQueue: NotificationImmediateQueue,
+			Delay:       notificationRetryDelay,
+		},
+	}
+}
+
+// all queues a consumer can read from
+var ConsumableQueues = []string{
+	ReservationToPaymentImmediateQueue,
+	ReservationToPaymentTimeoutQueue,
+	PaymentToOrderImmediateQueue,
+	OrderRefundImmediateQueue,
+	OrderCreationParkedQueue,
+	NotificationImmediateQueue,
+}
+
+// queues whose messages are not cleared by Broker.Setup
+var ParkedQueues = []string{
+	OrderCreationParkedQueue,
+}
+
+func isParkedQueue(queueName string) bool {
+	for _, parked := range ParkedQueues {
+		if parked == queueName {
+			return true
+		}
+	}
+	return false
+}
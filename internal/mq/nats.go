@@ -0,0 +1,260 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// all queues are subjects of a single work queue stream,
+// so every message is removed from the stream once it's acked
+const NATSStreamName = "FLASH_SALE"
+
+// header holding the time (unix nanoseconds) before which a delayed message must not be handled
+const natsNotBeforeHeader = "Flash-Sale-Not-Before"
+
+// how long a consumer waits for the ack before the message is delivered again
+const natsAckWait = 30 * time.Second
+
+type natsBroker struct {
+	// embedded server, nil when connected to an external one
+	server *server.Server
+	conn   *nats.Conn
+	js     jetstream.JetStream
+
+	delayQueues map[string]DelayRoute
+
+	mu        sync.Mutex
+	iterators []jetstream.MessagesContext
+}
+
+var _ Broker = (*natsBroker)(nil)
+
+// NewNATSBroker connects to the nats server at url.
+// If url is empty an embedded server with jetstream enabled is started, storing its data in storeDir
+// (a temporary directory if storeDir is empty).
+func NewNATSBroker(url string, storeDir string, delayQueues map[string]DelayRoute) (*natsBroker, error) {
+	b := &natsBroker{
+		delayQueues: delayQueues,
+	}
+
+	var opts []nats.Option
+	if url == "" {
+		ns, err := StartEmbeddedNATSServer(storeDir)
+		if err != nil {
+			return nil, err
+		}
+		b.server = ns
+		opts = append(opts, nats.InProcessServer(ns))
+	}
+
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		b.shutdownServer()
+		return nil, err
+	}
+	b.conn = conn
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	b.js = js
+
+	return b, nil
+}
+
+// StartEmbeddedNATSServer runs a jetstream enabled nats server inside the process,
+// clients connect to it with nats.InProcessServer
+func StartEmbeddedNATSServer(storeDir string) (*server.Server, error) {
+	if storeDir == "" {
+		dir, err := os.MkdirTemp("", "flash-sale-nats-")
+		if err != nil {
+			return nil, err
+		}
+		storeDir = dir
+	}
+
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   storeDir,
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		ns.Shutdown()
+		return nil, errors.New("embedded nats server is not ready for connections")
+	}
+	return ns, nil
+}
+
+func (b *natsBroker) Setup() error {
+	ctx := context.Background()
+
+	stream, err := b.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      NATSStreamName,
+		Subjects:  ConsumableQueues,
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		return err
+	}
+
+	// one durable consumer per queue
+	for _, queueName := range ConsumableQueues {
+		if _, err := b.js.CreateOrUpdateConsumer(ctx, NATSStreamName, jetstream.ConsumerConfig{
+			Durable:       natsConsumerName(queueName),
+			FilterSubject: queueName,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       natsAckWait,
+			MaxDeliver:    -1,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// clear all leftover messages from the previous runs, parked messages are kept
+	for _, queueName := range ConsumableQueues {
+		if isParkedQueue(queueName) {
+			continue
+		}
+		if err := stream.Purge(ctx, jetstream.WithPurgeSubject(queueName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *natsBroker) Publish(queueName string, message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	msg := nats.NewMsg(queueName)
+	msg.Data = body
+
+	// a delay queue is a subject of its target queue with a not-before header,
+	// the consumer naks the message with a delay until it's due
+	if route, ok := b.delayQueues[queueName]; ok {
+		msg.Subject = route.TargetQueue
+		notBefore := time.Now().Add(route.Delay).UnixNano()
+		msg.Header.Set(natsNotBeforeHeader, strconv.FormatInt(notBefore, 10))
+	}
+
+	if _, err := b.js.PublishMsg(context.Background(), msg, jetstream.WithMsgID(newMessageID())); err != nil {
+		return fmt.Errorf("failed to publish message to subject %s: %w", msg.Subject, err)
+	}
+	return nil
+}
+
+func (b *natsBroker) Consume(queueName string) (<-chan Delivery, error) {
+	consumer, err := b.js.Consumer(context.Background(), NATSStreamName, natsConsumerName(queueName))
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := consumer.Messages()
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.iterators = append(b.iterators, iter)
+	b.mu.Unlock()
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			msg, err := iter.Next()
+			if err != nil {
+				// the iterator is drained or stopped
+				return
+			}
+
+			if delay := natsRemainingDelay(msg); delay > 0 {
+				msg.NakWithDelay(delay)
+				continue
+			}
+
+			deliveries <- Delivery{
+				MessageID: msg.Headers().Get(nats.MsgIdHdr),
+				Body:      msg.Data(),
+				ack:       msg.Ack,
+				nack: func(requeue bool) error {
+					if requeue {
+						return msg.Nak()
+					}
+					return msg.Term()
+				},
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// pending pull requests are drained, so messages already sent to the client are still handed out
+func (b *natsBroker) StopConsuming() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, iter := range b.iterators {
+		iter.Drain()
+	}
+	return nil
+}
+
+func (b *natsBroker) Close() error {
+	b.mu.Lock()
+	for _, iter := range b.iterators {
+		iter.Stop()
+	}
+	b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	b.shutdownServer()
+	return nil
+}
+
+func (b *natsBroker) shutdownServer() {
+	if b.server != nil {
+		b.server.Shutdown()
+		b.server.WaitForShutdown()
+	}
+}
+
+// durable names can't contain dots
+func natsConsumerName(queueName string) string {
+	return strings.ReplaceAll(queueName, ".", "_")
+}
+
+func natsRemainingDelay(msg jetstream.Msg) time.Duration {
+	value := msg.Headers().Get(natsNotBeforeHeader)
+	if value == "" {
+		return 0
+	}
+	notBefore, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.Unix(0, notBefore))
+}
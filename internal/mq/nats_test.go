@@ -0,0 +1,177 @@
+package mq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newTestNATSBroker(t *testing.T, delay time.Duration) *natsBroker {
+	t.Helper()
+
+	b, err := NewNATSBroker("", t.TempDir(), NewDelayQueues(delay, delay))
+	if err != nil {
+		t.Fatalf("Failed to start nats broker: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	if err := b.Setup(); err != nil {
+		t.Fatalf("Failed to setup nats broker: %v", err)
+	}
+	return b
+}
+
+func receive(t *testing.T, deliveries <-chan Delivery, timeout time.Duration) Delivery {
+	t.Helper()
+
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(timeout):
+		t.Fatalf("No delivery within %v", timeout)
+	}
+	return Delivery{}
+}
+
+func TestNATSBroker_AckAndRedelivery(t *testing.T) {
+	b := newTestNATSBroker(t, time.Minute)
+
+	deliveries, err := b.Consume(PaymentToOrderImmediateQueue)
+	if err != nil {
+		t.Fatalf("Failed to consume: %v", err)
+	}
+
+	if err := b.Publish(PaymentToOrderImmediateQueue, PaymentToOrderImmediateMessage{ReservationID: 7}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	first := receive(t, deliveries, 5*time.Second)
+	var message PaymentToOrderImmediateMessage
+	if err := json.Unmarshal(first.Body, &message); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if message.ReservationID != 7 {
+		t.Errorf("Expected reservation 7, got %d", message.ReservationID)
+	}
+	if first.MessageID == "" {
+		t.Errorf("Expected a message id")
+	}
+
+	// a requeued message is delivered again with the same id
+	first.Nack(true)
+	second := receive(t, deliveries, 5*time.Second)
+	if second.MessageID != first.MessageID {
+		t.Errorf("Expected redelivery of %s, got %s", first.MessageID, second.MessageID)
+	}
+	second.Ack()
+
+	select {
+	case d := <-deliveries:
+		t.Errorf("Unexpected delivery after ack: %s", d.MessageID)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestNATSBroker_DelayQueue(t *testing.T) {
+	const delay = 500 * time.Millisecond
+	b := newTestNATSBroker(t, delay)
+
+	deliveries, err := b.Consume(ReservationToPaymentTimeoutQueue)
+	if err != nil {
+		t.Fatalf("Failed to consume: %v", err)
+	}
+
+	start := time.Now()
+	if err := b.Publish(ReservationToPaymentDelayQueue, ReservationToPaymentDelayMessage{ReservationID: 3}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	d := receive(t, deliveries, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("Delayed message delivered after %v, expected at least %v", elapsed, delay)
+	}
+	d.Ack()
+}
+
+func TestNATSBroker_SetupKeepsParkedMessages(t *testing.T) {
+	b := newTestNATSBroker(t, time.Minute)
+
+	if err := b.Publish(PaymentToOrderImmediateQueue, PaymentToOrderImmediateMessage{ReservationID: 1}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if err := b.Publish(OrderCreationParkedQueue, OrderCreationParkedMessage{ReservationID: 2}); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	// a restart clears the leftover messages except the parked ones
+	if err := b.Setup(); err != nil {
+		t.Fatalf("Failed to setup nats broker: %v", err)
+	}
+
+	parked, err := b.Consume(OrderCreationParkedQueue)
+	if err != nil {
+		t.Fatalf("Failed to consume: %v", err)
+	}
+	d := receive(t, parked, 5*time.Second)
+	var message OrderCreationParkedMessage
+	if err := json.Unmarshal(d.Body, &message); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if message.ReservationID != 2 {
+		t.Errorf("Expected parked reservation 2, got %d", message.ReservationID)
+	}
+	d.Ack()
+
+	deliveries, err := b.Consume(PaymentToOrderImmediateQueue)
+	if err != nil {
+		t.Fatalf("Failed to consume: %v", err)
+	}
+	select {
+	case d := <-deliveries:
+		t.Errorf("Unexpected leftover delivery: %s", d.MessageID)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestNATSBroker_AckAll(t *testing.T) {
+	b := newTestNATSBroker(t, time.Minute)
+
+	deliveries, err := b.Consume(PaymentToOrderImmediateQueue)
+	if err != nil {
+		t.Fatalf("Failed to consume: %v", err)
+	}
+
+	for i := uint(1); i <= 3; i++ {
+		if err := b.Publish(PaymentToOrderImmediateQueue, PaymentToOrderImmediateMessage{ReservationID: i}); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+
+	var batch []Delivery
+	for range 3 {
+		batch = append(batch, receive(t, deliveries, 5*time.Second))
+	}
+	if err := AckAll(batch); err != nil {
+		t.Fatalf("Failed to ack batch: %v", err)
+	}
+
+	// acked messages are removed from the work queue stream
+	stream, err := b.js.Stream(t.Context(), NATSStreamName)
+	if err != nil {
+		t.Fatalf("Failed to get stream: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := stream.Info(t.Context())
+		if err != nil {
+			t.Fatalf("Failed to get stream info: %v", err)
+		}
+		if info.State.Msgs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every message to be acked, %d left", info.State.Msgs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/qs-lzh/flash-sale/internal/util"
 )
 
 func SendImmediateMessage(ch *amqp.Channel, queueName string, message any) error {
@@ -24,6 +26,7 @@ func SendImmediateMessage(ch *amqp.Channel, queueName string, message any) error
 		amqp.Publishing{
 			ContentType:  "application/json",
 			DeliveryMode: amqp.Persistent,
+			MessageId:    newMessageID(),
 			Body:         body,
 			Timestamp:    time.Now(),
 		},
@@ -50,8 +53,14 @@ func SendTimeoutMessage(ch *amqp.Channel, delayQueueName string, message any) er
 		amqp.Publishing{
 			ContentType:  "application/json",
 			DeliveryMode: amqp.Persistent,
+			MessageId:    newMessageID(),
 			Body:         body,
 			Timestamp:    time.Now(),
 		},
 	)
 }
+
+// every published message carries a unique id, so consumers can recognize redeliveries
+func newMessageID() string {
+	return util.RandomHex(16)
+}
@@ -1,10 +1,116 @@
 package mq
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func InitQueues(mqConn *amqp.Connection) error {
+type rabbitMQBroker struct {
+	conn *amqp.Connection
+	// channel shared by all publishers, amqp channels are safe for concurrent publishing
+	publishCh   *amqp.Channel
+	delayQueues map[string]DelayRoute
+
+	mu        sync.Mutex
+	consumers []rabbitMQConsumer
+}
+
+type rabbitMQConsumer struct {
+	ch  *amqp.Channel
+	tag string
+}
+
+var _ Broker = (*rabbitMQBroker)(nil)
+
+func NewRabbitMQBroker(url string, delayQueues map[string]DelayRoute) (*rabbitMQBroker, error) {
+	conn, err := NewMQConn(url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := NewChannel(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &rabbitMQBroker{
+		conn:        conn,
+		publishCh:   ch,
+		delayQueues: delayQueues,
+	}, nil
+}
+
+func (b *rabbitMQBroker) Setup() error {
+	return InitQueues(b.conn, b.delayQueues)
+}
+
+func (b *rabbitMQBroker) Publish(queueName string, message any) error {
+	if _, ok := b.delayQueues[queueName]; ok {
+		return SendTimeoutMessage(b.publishCh, queueName, message)
+	}
+	return SendImmediateMessage(b.publishCh, queueName, message)
+}
+
+func (b *rabbitMQBroker) Consume(queueName string) (<-chan Delivery, error) {
+	ch, err := NewChannel(b.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	tag := fmt.Sprintf("%s-%d", queueName, len(b.consumers))
+	b.consumers = append(b.consumers, rabbitMQConsumer{ch: ch, tag: tag})
+	b.mu.Unlock()
+
+	msgs, err := ch.Consume(queueName, tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+		for msg := range msgs {
+			deliveries <- Delivery{
+				MessageID: msg.MessageId,
+				Body:      msg.Body,
+				ack: func() error {
+					return msg.Ack(false)
+				},
+				nack: func(requeue bool) error {
+					return msg.Nack(false, requeue)
+				},
+				ackMultiple: func() error {
+					return msg.Ack(true)
+				},
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+func (b *rabbitMQBroker) StopConsuming() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var firstErr error
+	for _, consumer := range b.consumers {
+		if err := consumer.ch.Cancel(consumer.tag, false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (b *rabbitMQBroker) Close() error {
+	return b.conn.Close()
+}
+
+func InitQueues(mqConn *amqp.Connection, delayQueues map[string]DelayRoute) error {
 	ch, err := NewChannel(mqConn)
 	if err != nil {
 		return err
@@ -16,18 +122,34 @@ func InitQueues(mqConn *amqp.Connection) error {
 		return err
 	}
 	if err := SetupDelayQueue(ch, ReservationToPaymentDelayQueue, ReservationToPaymentTimeoutExchange,
-		ReservationToPaymentTimeoutQueue, ReservationToPaymentTimeoutRoutingKey); err != nil {
+		ReservationToPaymentTimeoutQueue, ReservationToPaymentTimeoutRoutingKey, delayQueues[ReservationToPaymentDelayQueue].Delay); err != nil {
 		return err
 	}
 	if err := SetupImmediateQueue(ch, PaymentToOrderImmediateQueue); err != nil {
 		return err
 	}
+	if err := SetupImmediateQueue(ch, OrderRefundImmediateQueue); err != nil {
+		return err
+	}
+	if err := SetupImmediateQueue(ch, OrderCreationParkedQueue); err != nil {
+		return err
+	}
+	if err := SetupImmediateQueue(ch, NotificationImmediateQueue); err != nil {
+		return err
+	}
+	if err := SetupDelayQueue(ch, NotificationRetryDelayQueue, NotificationRetryExchange,
+		NotificationImmediateQueue, NotificationRetryRoutingKey, delayQueues[NotificationRetryDelayQueue].Delay); err != nil {
+		return err
+	}
 
-	// clear all leftover messages in the queues from the previous runs
+	// clear all leftover messages in the queues from the previous runs, parked messages are kept
 	ClearQueue(mqConn, ReservationToPaymentImmediateQueue)
 	ClearQueue(mqConn, ReservationToPaymentDelayQueue)
 	ClearQueue(mqConn, ReservationToPaymentTimeoutQueue)
 	ClearQueue(mqConn, PaymentToOrderImmediateQueue)
+	ClearQueue(mqConn, OrderRefundImmediateQueue)
+	ClearQueue(mqConn, NotificationImmediateQueue)
+	ClearQueue(mqConn, NotificationRetryDelayQueue)
 
 	return nil
 }
@@ -55,9 +177,14 @@ func SetupImmediateQueue(ch *amqp.Channel, immediateQueueName string) error {
 
 // the delay queue consists three part: delay queue, timeout exchange, timeout queue
 // produce to the delay queue, and consume from the timeout queue
-func SetupDelayQueue(ch *amqp.Channel, delayQueueName, timeoutExchangeName, timeoutQueueName string, timeoutRoutingKey string) error {
+func SetupDelayQueue(ch *amqp.Channel, delayQueueName, timeoutExchangeName, timeoutQueueName string, timeoutRoutingKey string, delay time.Duration) error {
+	// the ttl of an existing queue can't be changed, and leftover messages are cleared anyway
+	if _, err := ch.QueueDelete(delayQueueName, false, false, false); err != nil {
+		return err
+	}
+
 	delayArgs := amqp.Table{
-		"x-message-ttl":             int32(15 * 60 * 1000), // 15 mins
+		"x-message-ttl":             int32(delay.Milliseconds()),
 		"x-dead-letter-exchange":    timeoutExchangeName,
 		"x-dead-letter-routing-key": timeoutRoutingKey,
 	}
@@ -0,0 +1,62 @@
+// Package notification tells customers what happens to their reservations and orders.
+// Notifications are rendered from a template per kind and sent through the channels the user enabled.
+package notification
+
+import (
+	"errors"
+)
+
+type Kind string
+
+const (
+	KindReserved            Kind = "RESERVED"
+	KindPaid                Kind = "PAID"
+	KindPaymentFailed       Kind = "PAYMENT_FAILED"
+	KindTimedOut            Kind = "TIMED_OUT"
+	KindRefunded            Kind = "REFUNDED"
+	KindLatePaymentHonored  Kind = "LATE_PAYMENT_HONORED"
+	KindLatePaymentRefunded Kind = "LATE_PAYMENT_REFUNDED"
+)
+
+// Notification is a message to a customer about one of their reservations
+type Notification struct {
+	Kind          Kind
+	UserID        uint
+	ReservationID uint
+	// extra values the templates can use, e.g. "amount"
+	Data map[string]string
+}
+
+// Notifier queues notifications, they are sent in the background
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// names of the channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Recipient is where a channel delivers a message to
+type Recipient struct {
+	UserID uint
+	// email address or phone number, depending on the channel
+	Address string
+}
+
+// Message is a rendered notification
+type Message struct {
+	// empty for sms
+	Subject string
+	Body    string
+}
+
+// Channel delivers messages to customers
+type Channel interface {
+	Name() string
+	Send(recipient Recipient, message Message) error
+}
+
+// ErrNoAddress means the user has no address for the channel, retrying can't help
+var ErrNoAddress = errors.New("recipient has no address for the channel")
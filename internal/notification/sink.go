@@ -0,0 +1,81 @@
+package notification
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink appends every message sent through its channels to a file as json lines,
+// it stands in for the real email and sms providers during development
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		path: path,
+	}
+}
+
+// Channel returns a channel named name that writes to the sink
+func (s *FileSink) Channel(name string) Channel {
+	return &fileSinkChannel{
+		name: name,
+		sink: s,
+	}
+}
+
+type sinkRecord struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	UserID  uint      `json:"user_id"`
+	To      string    `json:"to,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Body    string    `json:"body"`
+}
+
+func (s *FileSink) write(record sinkRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type fileSinkChannel struct {
+	name string
+	sink *FileSink
+}
+
+var _ Channel = (*fileSinkChannel)(nil)
+
+func (c *fileSinkChannel) Name() string {
+	return c.name
+}
+
+// the sink accepts recipients without an address, so notifications can be seen before users set one
+func (c *fileSinkChannel) Send(recipient Recipient, message Message) error {
+	return c.sink.write(sinkRecord{
+		Time:    time.Now(),
+		Channel: c.name,
+		UserID:  recipient.UserID,
+		To:      recipient.Address,
+		Subject: message.Subject,
+		Body:    message.Body,
+	})
+}
@@ -0,0 +1,49 @@
+package notification
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// EmailTransportSMTP selects the smtp email channel, emails go to the file sink otherwise
+const EmailTransportSMTP = "smtp"
+
+// smtpEmailChannel sends emails through an smtp server without authentication,
+// e.g. a local mailhog during development
+type smtpEmailChannel struct {
+	addr string
+	from string
+}
+
+var _ Channel = (*smtpEmailChannel)(nil)
+
+func NewSMTPEmailChannel(addr string, from string) *smtpEmailChannel {
+	return &smtpEmailChannel{
+		addr: addr,
+		from: from,
+	}
+}
+
+func (c *smtpEmailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (c *smtpEmailChannel) Send(recipient Recipient, message Message) error {
+	if recipient.Address == "" {
+		return ErrNoAddress
+	}
+	// addresses end up in the headers
+	if strings.ContainsAny(recipient.Address, "\r\n") {
+		return fmt.Errorf("invalid email address %q", recipient.Address)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", recipient.Address)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(message.Subject, "\n", " "))
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(c.addr, nil, c.from, []string{recipient.Address}, []byte(msg.String()))
+}
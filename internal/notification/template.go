@@ -0,0 +1,117 @@
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+type templateSet struct {
+	subject *template.Template
+	email   *template.Template
+	sms     *template.Template
+}
+
+// values the templates are executed with
+type templateData struct {
+	UserID        uint
+	ReservationID uint
+	Data          map[string]string
+}
+
+func newTemplateSet(subject, email, sms string) templateSet {
+	return templateSet{
+		subject: template.Must(template.New("subject").Option("missingkey=zero").Parse(subject)),
+		email:   template.Must(template.New("email").Option("missingkey=zero").Parse(email)),
+		sms:     template.Must(template.New("sms").Option("missingkey=zero").Parse(sms)),
+	}
+}
+
+var templates = map[Kind]templateSet{
+	KindReserved: newTemplateSet(
+		"Reservation {{.ReservationID}} is held for you",
+		"Your ticket is reserved (reservation {{.ReservationID}}).\n"+
+			"Please pay {{.Data.amount}} {{.Data.currency}} before {{.Data.expires_at}}, the ticket is released afterwards.\n",
+		"Ticket reserved ({{.ReservationID}}), pay {{.Data.amount}} {{.Data.currency}} before {{.Data.expires_at}}.",
+	),
+	KindPaid: newTemplateSet(
+		"Payment received for reservation {{.ReservationID}}",
+		"We received your payment, reservation {{.ReservationID}} is confirmed. Enjoy the show!\n",
+		"Payment received, reservation {{.ReservationID}} is confirmed.",
+	),
+	KindPaymentFailed: newTemplateSet(
+		"Payment declined for reservation {{.ReservationID}}",
+		"Your payment for reservation {{.ReservationID}} was declined and the ticket was released.\n"+
+			"You can reserve again while tickets last.\n",
+		"Payment declined, reservation {{.ReservationID}} was released.",
+	),
+	KindTimedOut: newTemplateSet(
+		"Reservation {{.ReservationID}} expired",
+		"Reservation {{.ReservationID}} wasn't paid in time and the ticket was released.\n",
+		"Reservation {{.ReservationID}} expired unpaid.",
+	),
+	KindRefunded: newTemplateSet(
+		"Refund for order {{.ReservationID}}",
+		"Order {{.ReservationID}} was refunded, the money is on its way back to you.\n",
+		"Order {{.ReservationID}} was refunded.",
+	),
+	KindLatePaymentHonored: newTemplateSet(
+		"Late payment accepted for reservation {{.ReservationID}}",
+		"Your payment arrived after reservation {{.ReservationID}} expired or was cancelled, but a ticket was still available.\n"+
+			"Your order is confirmed.\n",
+		"Late payment accepted, reservation {{.ReservationID}} is confirmed.",
+	),
+	KindLatePaymentRefunded: newTemplateSet(
+		"Late payment refunded for reservation {{.ReservationID}}",
+		"Your payment arrived after reservation {{.ReservationID}} expired or was cancelled and the showtime sold out meanwhile.\n"+
+			"The payment was refunded.\n",
+		"Reservation {{.ReservationID}} was released before payment, the payment was refunded.",
+	),
+}
+
+// Render renders the notification for a channel
+func Render(notification Notification, channel string) (Message, error) {
+	set, ok := templates[notification.Kind]
+	if !ok {
+		return Message{}, fmt.Errorf("no template for notification %s", notification.Kind)
+	}
+
+	data := templateData{
+		UserID:        notification.UserID,
+		ReservationID: notification.ReservationID,
+		Data:          notification.Data,
+	}
+	switch channel {
+	case ChannelEmail:
+		subject, err := execute(set.subject, data)
+		if err != nil {
+			return Message{}, err
+		}
+		body, err := execute(set.email, data)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Subject: subject, Body: body}, nil
+	case ChannelSMS:
+		body, err := execute(set.sms, data)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{Body: body}, nil
+	default:
+		return Message{}, fmt.Errorf("unknown notification channel %q", channel)
+	}
+}
+
+func execute(t *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// FormatAmount formats an amount in the smallest currency unit for the templates, e.g. 4500 as "45.00"
+func FormatAmount(amount int) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
@@ -0,0 +1,79 @@
+package notification
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	kinds := []Kind{KindReserved, KindPaid, KindPaymentFailed, KindTimedOut, KindRefunded,
+		KindLatePaymentHonored, KindLatePaymentRefunded}
+	n := Notification{
+		UserID:        7,
+		ReservationID: 42,
+		Data:          map[string]string{"amount": "45.00", "currency": "CNY", "expires_at": "12:00"},
+	}
+
+	for _, kind := range kinds {
+		n.Kind = kind
+		email, err := Render(n, ChannelEmail)
+		if err != nil {
+			t.Fatalf("Failed to render %s email: %v", kind, err)
+		}
+		if email.Subject == "" || !strings.Contains(email.Subject+email.Body, "42") {
+			t.Errorf("Expected the %s email to name the reservation, got %+v", kind, email)
+		}
+		sms, err := Render(n, ChannelSMS)
+		if err != nil {
+			t.Fatalf("Failed to render %s sms: %v", kind, err)
+		}
+		if sms.Subject != "" || !strings.Contains(sms.Body, "42") {
+			t.Errorf("Expected the %s sms to name the reservation without subject, got %+v", kind, sms)
+		}
+	}
+	if len(templates) != len(kinds) {
+		t.Errorf("Expected a template for each of the %d kinds, got %d", len(kinds), len(templates))
+	}
+}
+
+func TestRender_Data(t *testing.T) {
+	n := Notification{
+		Kind:          KindReserved,
+		ReservationID: 42,
+		Data:          map[string]string{"amount": "45.00", "currency": "CNY", "expires_at": "12:00"},
+	}
+	sms, err := Render(n, ChannelSMS)
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	if want := "Ticket reserved (42), pay 45.00 CNY before 12:00."; sms.Body != want {
+		t.Errorf("Expected %q, got %q", want, sms.Body)
+	}
+
+	// a missing value is left empty
+	n.Data = nil
+	sms, err = Render(n, ChannelSMS)
+	if err != nil {
+		t.Fatalf("Failed to render without data: %v", err)
+	}
+	if strings.Contains(sms.Body, "no value") {
+		t.Errorf("Expected missing values to be empty, got %q", sms.Body)
+	}
+}
+
+func TestRender_Unknown(t *testing.T) {
+	if _, err := Render(Notification{Kind: "UNKNOWN"}, ChannelEmail); err == nil {
+		t.Errorf("Expected an unknown kind to fail")
+	}
+	if _, err := Render(Notification{Kind: KindPaid}, "pigeon"); err == nil {
+		t.Errorf("Expected an unknown channel to fail")
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	for amount, want := range map[int]string{4500: "45.00", 5: "0.05", 0: "0.00", 123456: "1234.56"} {
+		if got := FormatAmount(amount); got != want {
+			t.Errorf("Expected %d as %q, got %q", amount, want, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package paystub is a local stand-in for a real payment provider.
+// It keeps payment intents in memory, completes each one after a short delay
+// and reports the result to the webhook of the flash-sale server.
+package paystub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/util"
+	"github.com/qs-lzh/flash-sale/internal/webhook"
+)
+
+// how often an event is delivered before the stand-in gives up
+const webhookRetries = 5
+
+type Server struct {
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+
+	mu      sync.Mutex
+	intents map[string]*domain.PaymentIntent
+}
+
+// events are signed with webhookSecret, which must match the server's secret of the "local" provider
+func NewServer(webhookURL string, webhookSecret string) *Server {
+	return &Server{
+		webhookURL:    webhookURL,
+		webhookSecret: webhookSecret,
+		client:        &http.Client{Timeout: 5 * time.Second},
+		intents:       make(map[string]*domain.PaymentIntent),
+	}
+}
+
+func (s *Server) Router() *gin.Engine {
+	r := gin.New()
+	r.POST("/intents", s.handleCreateIntent)
+	r.GET("/intents/:id", s.handleGetIntent)
+	r.POST("/intents/:id/refund", s.handleRefund)
+	return r
+}
+
+func (s *Server) handleCreateIntent(ctx *gin.Context) {
+	var req domain.PaymentIntent
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	intent := &domain.PaymentIntent{
+		ID:            "pi_" + util.RandomHex(12),
+		ReservationID: req.ReservationID,
+		Amount:        req.Amount,
+		Status:        domain.PaymentIntentStatusPending,
+	}
+	s.mu.Lock()
+	s.intents[intent.ID] = intent
+	s.mu.Unlock()
+
+	go s.complete(intent.ID)
+
+	ctx.JSON(201, intent)
+}
+
+func (s *Server) handleGetIntent(ctx *gin.Context) {
+	intent, ok := s.get(ctx.Param("id"))
+	if !ok {
+		ctx.JSON(404, gin.H{"error": "intent not found"})
+		return
+	}
+	ctx.JSON(200, intent)
+}
+
+func (s *Server) handleRefund(ctx *gin.Context) {
+	s.mu.Lock()
+	intent, ok := s.intents[ctx.Param("id")]
+	if ok {
+		intent.Status = domain.PaymentIntentStatusRefunded
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		ctx.JSON(404, gin.H{"error": "intent not found"})
+		return
+	}
+	ctx.JSON(200, gin.H{"status": domain.PaymentIntentStatusRefunded})
+}
+
+func (s *Server) get(id string) (domain.PaymentIntent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	intent, ok := s.intents[id]
+	if !ok {
+		return domain.PaymentIntent{}, false
+	}
+	return *intent, true
+}
+
+// complete finishes the payment after a customer-like delay and reports it to the webhook
+func (s *Server) complete(intentID string) {
+	time.Sleep(time.Duration(mathrand.Intn(901)+100) * time.Millisecond)
+
+	s.mu.Lock()
+	intent := s.intents[intentID]
+	intent.Status = domain.PaymentIntentStatusSucceeded
+	event := domain.PaymentEvent{
+		EventID:       "evt_" + util.RandomHex(12),
+		Provider:      domain.PaymentProviderLocal,
+		IntentID:      intent.ID,
+		ReservationID: intent.ReservationID,
+		Status:        intent.Status,
+	}
+	s.mu.Unlock()
+
+	s.deliver(event)
+}
+
+func (s *Server) deliver(event domain.PaymentEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal event %s: %v", event.EventID, err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookRetries; attempt++ {
+		err := s.post(body)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to deliver event %s (attempt %d): %v", event.EventID, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func (s *Server) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.ProviderHeader, domain.PaymentProviderLocal)
+	// signed on every attempt, so a retry carries a fresh timestamp
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(s.webhookSecret, time.Now(), body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Package realtime pushes reservation state changes to the customers watching them.
+// Events are published through redis pub/sub, so the instance holding a customer's connection
+// gets the event whichever instance handled the change.
+package realtime
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// Event is a change of a reservation's state
+type Event struct {
+	ReservationID uint                    `json:"reservation_id"`
+	UserID        uint                    `json:"user_id"`
+	State         domain.ReservationState `json:"status"`
+	// set once the reservation is domain.ReservationStatePersisted
+	OrderStatus model.OrderStatus `json:"order_status,omitempty"`
+	At          time.Time         `json:"at"`
+}
+
+// Publisher sends events to the subscribers on every instance
+type Publisher interface {
+	Publish(event Event) error
+}
+
+// events buffered for a subscriber, a subscriber that falls further behind misses events
+const subscriptionBuffer = 16
+
+// Subscription receives the events of one user, C is closed when the hub is closed
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	userID uint
+}
+
+// Hub relays the events received from redis to the subscribers on this instance
+type Hub struct {
+	cache  *cache.RedisCache
+	pubsub *redis.PubSub
+
+	mu            sync.Mutex
+	subscriptions map[uint]map[*Subscription]struct{}
+	closed        bool
+
+	wg sync.WaitGroup
+}
+
+var _ Publisher = (*Hub)(nil)
+
+func NewHub(cache *cache.RedisCache) *Hub {
+	return &Hub{
+		cache:         cache,
+		subscriptions: make(map[uint]map[*Subscription]struct{}),
+	}
+}
+
+// Start subscribes to the events in redis and relays them until Close is called
+func (h *Hub) Start() error {
+	pubsub, err := h.cache.SubscribeReservationEvents()
+	if err != nil {
+		return err
+	}
+	h.pubsub = pubsub
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for msg := range pubsub.Channel() {
+			var event Event
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.Printf("Failed to decode reservation event: %v", err)
+				continue
+			}
+			h.dispatch(event)
+		}
+	}()
+
+	return nil
+}
+
+func (h *Hub) Publish(event Event) error {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	return h.cache.PublishReservationEvent(event)
+}
+
+// Subscribe returns a subscription to the events of the user, it must be passed to Unsubscribe when done
+func (h *Hub) Subscribe(userID uint) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, userID: userID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(c)
+		return sub
+	}
+	if h.subscriptions[userID] == nil {
+		h.subscriptions[userID] = make(map[*Subscription]struct{})
+	}
+	h.subscriptions[userID][sub] = struct{}{}
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.subscriptions[sub.userID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscriptions, sub.userID)
+	}
+	close(sub.c)
+}
+
+func (h *Hub) dispatch(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscriptions[event.UserID] {
+		select {
+		case sub.c <- event:
+		default:
+			// the customer can still query the reservation
+			log.Printf("Drop reservation event of reservation %d, subscriber of user %d is too slow", event.ReservationID, event.UserID)
+		}
+	}
+}
+
+// Close stops relaying events and closes every subscription, so the streams waiting on them end
+func (h *Hub) Close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	for userID, subs := range h.subscriptions {
+		for sub := range subs {
+			close(sub.c)
+		}
+		delete(h.subscriptions, userID)
+	}
+	h.mu.Unlock()
+
+	if h.pubsub != nil {
+		if err := h.pubsub.Close(); err != nil {
+			log.Printf("Failed to close reservation events subscription: %v", err)
+		}
+	}
+	h.wg.Wait()
+}
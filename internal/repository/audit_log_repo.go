@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+type AuditLogRepo interface {
+	WithTx(tx *gorm.DB) AuditLogRepo
+	Create(entry *model.AuditLog) error
+}
+
+type auditLogRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ AuditLogRepo = (*auditLogRepoGorm)(nil)
+
+func NewAuditLogRepoGorm(db *gorm.DB) *auditLogRepoGorm {
+	return &auditLogRepoGorm{
+		db: db,
+	}
+}
+
+func (r *auditLogRepoGorm) WithTx(tx *gorm.DB) AuditLogRepo {
+	return &auditLogRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *auditLogRepoGorm) Create(entry *model.AuditLog) error {
+	ctx := context.Background()
+	if err := gorm.G[model.AuditLog](r.db).Create(ctx, entry); err != nil {
+		return err
+	}
+	return nil
+}
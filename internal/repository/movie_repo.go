@@ -13,7 +13,13 @@ type MovieRepo interface {
 	Create(movie *model.Movie) error
 	GetByID(id uint) (*model.Movie, error)
 	GetByTitle(title string) (*model.Movie, error)
+	GetByIDs(ids []uint) ([]model.Movie, error)
 	ListAll() ([]model.Movie, error)
+	// List returns a page of the movies ordered by id, and how many movies there are
+	List(offset, limit int) ([]model.Movie, int64, error)
+	// Update saves the title and description
+	Update(movie *model.Movie) error
+	Delete(id uint) error
 }
 
 type movieRepoGorm struct {
@@ -51,6 +57,18 @@ func (r *movieRepoGorm) GetByID(id uint) (*model.Movie, error) {
 	return &movie, nil
 }
 
+func (r *movieRepoGorm) GetByIDs(ids []uint) ([]model.Movie, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	movies, err := gorm.G[model.Movie](r.db).Where("id IN ?", ids).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
 func (r *movieRepoGorm) GetByTitle(title string) (*model.Movie, error) {
 	ctx := context.Background()
 	movie, err := gorm.G[model.Movie](r.db).Where(&model.Movie{Title: title}).First(ctx)
@@ -68,3 +86,40 @@ func (r *movieRepoGorm) ListAll() ([]model.Movie, error) {
 	}
 	return movies, nil
 }
+
+func (r *movieRepoGorm) Update(movie *model.Movie) error {
+	ctx := context.Background()
+	rows, err := gorm.G[model.Movie](r.db).Where("id = ?", movie.ID).Select("title", "description").Updates(ctx, *movie)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *movieRepoGorm) Delete(id uint) error {
+	ctx := context.Background()
+	rows, err := gorm.G[model.Movie](r.db).Where("id = ?", id).Delete(ctx)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *movieRepoGorm) List(offset, limit int) ([]model.Movie, int64, error) {
+	ctx := context.Background()
+	total, err := gorm.G[model.Movie](r.db).Count(ctx, "*")
+	if err != nil {
+		return nil, 0, err
+	}
+	movies, err := gorm.G[model.Movie](r.db).Order("id").Offset(offset).Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return movies, total, nil
+}
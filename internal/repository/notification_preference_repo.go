@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+type NotificationPreferenceRepo interface {
+	WithTx(tx *gorm.DB) NotificationPreferenceRepo
+	GetByUserID(userID uint) (*model.NotificationPreference, error)
+	// Upsert creates the preference of the user, or replaces the existing one
+	Upsert(preference *model.NotificationPreference) error
+}
+
+type notificationPreferenceRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ NotificationPreferenceRepo = (*notificationPreferenceRepoGorm)(nil)
+
+func NewNotificationPreferenceRepoGorm(db *gorm.DB) *notificationPreferenceRepoGorm {
+	return &notificationPreferenceRepoGorm{
+		db: db,
+	}
+}
+
+func (r *notificationPreferenceRepoGorm) WithTx(tx *gorm.DB) NotificationPreferenceRepo {
+	return &notificationPreferenceRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *notificationPreferenceRepoGorm) GetByUserID(userID uint) (*model.NotificationPreference, error) {
+	ctx := context.Background()
+	preference, err := gorm.G[model.NotificationPreference](r.db).Where("user_id = ?", userID).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+func (r *notificationPreferenceRepoGorm) Upsert(preference *model.NotificationPreference) error {
+	ctx := context.Background()
+	return gorm.G[model.NotificationPreference](r.db, clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"email", "phone", "email_enabled", "sms_enabled"}),
+	}).Create(ctx, preference)
+}
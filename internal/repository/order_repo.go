@@ -2,17 +2,41 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/qs-lzh/flash-sale/internal/model"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type OrderRepo interface {
 	WithTx(tx *gorm.DB) OrderRepo
 	Create(order *model.Order) error
+	// CreateBatch inserts the orders with multi-row inserts, orders whose id already exists are skipped
+	CreateBatch(orders []model.Order) error
 	GetByID(id uint) (*model.Order, error)
 	GetByUserID(userID uint) ([]model.Order, error)
 	GetByShowtimeID(showtimeID uint) ([]model.Order, error)
+	GetByIDs(ids []uint) ([]model.Order, error)
+	// ListByUserID and ListByShowtimeID return up to limit orders newest first, with ids below beforeID unless it's 0
+	ListByUserID(userID uint, beforeID uint, limit int) ([]model.Order, error)
+	ListByShowtimeID(showtimeID uint, beforeID uint, limit int) ([]model.Order, error)
+	// CountByShowtimeIDs counts the orders of any of the showtimes, whatever their status
+	CountByShowtimeIDs(showtimeIDs []uint) (int64, error)
+	// CountPromoUsage counts the orders of each user made with a promo code
+	CountPromoUsage() ([]PromoUsage, error)
+	// UpdateStatus moves the order from status from to status to and records the time of the transition,
+	// it returns false if the order isn't in status from
+	UpdateStatus(id uint, from model.OrderStatus, to model.OrderStatus) (bool, error)
+}
+
+// PromoUsage is how many orders a user made with a promo code
+type PromoUsage struct {
+	PromoCode string
+	UserID    uint
+	Count     int
 }
 
 type orderRepoGorm struct {
@@ -21,6 +45,11 @@ type orderRepoGorm struct {
 
 var _ OrderRepo = (*orderRepoGorm)(nil)
 
+// rows per insert statement of CreateBatch
+const orderInsertBatchSize = 500
+
+var ErrInvalidOrderTransition = errors.New("invalid order status transition")
+
 func NewOrderRepoGorm(db *gorm.DB) *orderRepoGorm {
 	return &orderRepoGorm{
 		db: db,
@@ -41,6 +70,14 @@ func (r *orderRepoGorm) Create(order *model.Order) error {
 	return nil
 }
 
+func (r *orderRepoGorm) CreateBatch(orders []model.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	return gorm.G[model.Order](r.db, clause.OnConflict{DoNothing: true}).CreateInBatches(ctx, &orders, orderInsertBatchSize)
+}
+
 func (r *orderRepoGorm) GetByID(id uint) (*model.Order, error) {
 	ctx := context.Background()
 	order, err := gorm.G[model.Order](r.db).Where(&model.Order{ID: id}).First(ctx)
@@ -67,3 +104,81 @@ func (r *orderRepoGorm) GetByShowtimeID(showtimeID uint) ([]model.Order, error)
 	}
 	return orders, nil
 }
+
+func (r *orderRepoGorm) GetByIDs(ids []uint) ([]model.Order, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	orders, err := gorm.G[model.Order](r.db).Where("id IN ?", ids).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (r *orderRepoGorm) ListByUserID(userID uint, beforeID uint, limit int) ([]model.Order, error) {
+	return r.listBefore("user_id = ?", userID, beforeID, limit)
+}
+
+func (r *orderRepoGorm) ListByShowtimeID(showtimeID uint, beforeID uint, limit int) ([]model.Order, error) {
+	return r.listBefore("showtime_id = ?", showtimeID, beforeID, limit)
+}
+
+func (r *orderRepoGorm) listBefore(cond string, value uint, beforeID uint, limit int) ([]model.Order, error) {
+	ctx := context.Background()
+	query := gorm.G[model.Order](r.db).Where(cond, value)
+	if beforeID > 0 {
+		query = query.Where("id < ?", beforeID)
+	}
+	orders, err := query.Order("id DESC").Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (r *orderRepoGorm) CountByShowtimeIDs(showtimeIDs []uint) (int64, error) {
+	if len(showtimeIDs) == 0 {
+		return 0, nil
+	}
+	ctx := context.Background()
+	return gorm.G[model.Order](r.db).Where("showtime_id IN ?", showtimeIDs).Count(ctx, "*")
+}
+
+func (r *orderRepoGorm) CountPromoUsage() ([]PromoUsage, error) {
+	var usage []PromoUsage
+	err := r.db.Model(&model.Order{}).
+		Select("promo_code, user_id, count(*) AS count").
+		Where("promo_code <> ''").
+		Group("promo_code, user_id").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (r *orderRepoGorm) UpdateStatus(id uint, from model.OrderStatus, to model.OrderStatus) (bool, error) {
+	if !from.CanTransitionTo(to) {
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidOrderTransition, from, to)
+	}
+
+	now := time.Now()
+	update := model.Order{Status: to}
+	switch to {
+	case model.OrderStatusRefunded:
+		update.RefundedAt = &now
+	case model.OrderStatusCancelled:
+		update.CancelledAt = &now
+	case model.OrderStatusCheckedIn:
+		update.CheckedInAt = &now
+	}
+
+	ctx := context.Background()
+	rows, err := gorm.G[model.Order](r.db).Where("id = ? AND status = ?", id, from).Updates(ctx, update)
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
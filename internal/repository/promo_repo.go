@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+type PromoCodeRepo interface {
+	WithTx(tx *gorm.DB) PromoCodeRepo
+	Create(promo *model.PromoCode) error
+	GetByCode(code string) (*model.PromoCode, error)
+	ListAll() ([]model.PromoCode, error)
+}
+
+type promoCodeRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ PromoCodeRepo = (*promoCodeRepoGorm)(nil)
+
+func NewPromoCodeRepoGorm(db *gorm.DB) *promoCodeRepoGorm {
+	return &promoCodeRepoGorm{
+		db: db,
+	}
+}
+
+func (r *promoCodeRepoGorm) WithTx(tx *gorm.DB) PromoCodeRepo {
+	return &promoCodeRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *promoCodeRepoGorm) Create(promo *model.PromoCode) error {
+	ctx := context.Background()
+	if err := gorm.G[model.PromoCode](r.db).Create(ctx, promo); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *promoCodeRepoGorm) GetByCode(code string) (*model.PromoCode, error) {
+	ctx := context.Background()
+	promo, err := gorm.G[model.PromoCode](r.db).Where(&model.PromoCode{Code: code}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &promo, nil
+}
+
+func (r *promoCodeRepoGorm) ListAll() ([]model.PromoCode, error) {
+	ctx := context.Background()
+	promos, err := gorm.G[model.PromoCode](r.db).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return promos, nil
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+type RefreshTokenRepo interface {
+	WithTx(tx *gorm.DB) RefreshTokenRepo
+	Create(token *model.RefreshToken) error
+	// Use marks the token with the hash used at now and returns it,
+	// it returns gorm.ErrRecordNotFound if there's no such token or it's expired or used already
+	Use(tokenHash string, now time.Time) (*model.RefreshToken, error)
+}
+
+type refreshTokenRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ RefreshTokenRepo = (*refreshTokenRepoGorm)(nil)
+
+func NewRefreshTokenRepoGorm(db *gorm.DB) *refreshTokenRepoGorm {
+	return &refreshTokenRepoGorm{
+		db: db,
+	}
+}
+
+func (r *refreshTokenRepoGorm) WithTx(tx *gorm.DB) RefreshTokenRepo {
+	return &refreshTokenRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *refreshTokenRepoGorm) Create(token *model.RefreshToken) error {
+	ctx := context.Background()
+	return gorm.G[model.RefreshToken](r.db).Create(ctx, token)
+}
+
+func (r *refreshTokenRepoGorm) Use(tokenHash string, now time.Time) (*model.RefreshToken, error) {
+	ctx := context.Background()
+	// the conditional update locks the row, of two concurrent uses only one updates it
+	rows, err := gorm.G[model.RefreshToken](r.db).
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).
+		Updates(ctx, model.RefreshToken{UsedAt: &now})
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	token, err := gorm.G[model.RefreshToken](r.db).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+type ShowtimePriceRepo interface {
+	WithTx(tx *gorm.DB) ShowtimePriceRepo
+	// Upsert creates the price of the showtime and category, or updates the existing one
+	Upsert(price *model.ShowtimePrice) error
+	Get(showtimeID uint, category model.TicketCategory) (*model.ShowtimePrice, error)
+	GetByShowtimeID(showtimeID uint) ([]model.ShowtimePrice, error)
+	ListAll() ([]model.ShowtimePrice, error)
+	// CreateMissing gives every showtime without a price of the category this one, it returns how many it priced
+	CreateMissing(category model.TicketCategory, amount int, currency string) (int64, error)
+	DeleteByShowtimeID(showtimeID uint) error
+}
+
+type showtimePriceRepoGorm struct {
+	db *gorm.DB
+}
+
+var _ ShowtimePriceRepo = (*showtimePriceRepoGorm)(nil)
+
+func NewShowtimePriceRepoGorm(db *gorm.DB) *showtimePriceRepoGorm {
+	return &showtimePriceRepoGorm{
+		db: db,
+	}
+}
+
+func (r *showtimePriceRepoGorm) WithTx(tx *gorm.DB) ShowtimePriceRepo {
+	return &showtimePriceRepoGorm{
+		db: tx,
+	}
+}
+
+func (r *showtimePriceRepoGorm) Upsert(price *model.ShowtimePrice) error {
+	ctx := context.Background()
+	return gorm.G[model.ShowtimePrice](r.db, clause.OnConflict{
+		Columns:   []clause.Column{{Name: "showtime_id"}, {Name: "category"}},
+		DoUpdates: clause.AssignmentColumns([]string{"amount", "currency"}),
+	}).Create(ctx, price)
+}
+
+func (r *showtimePriceRepoGorm) Get(showtimeID uint, category model.TicketCategory) (*model.ShowtimePrice, error) {
+	ctx := context.Background()
+	price, err := gorm.G[model.ShowtimePrice](r.db).Where(&model.ShowtimePrice{ShowtimeID: showtimeID, Category: category}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+func (r *showtimePriceRepoGorm) GetByShowtimeID(showtimeID uint) ([]model.ShowtimePrice, error) {
+	ctx := context.Background()
+	prices, err := gorm.G[model.ShowtimePrice](r.db).Where(&model.ShowtimePrice{ShowtimeID: showtimeID}).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func (r *showtimePriceRepoGorm) ListAll() ([]model.ShowtimePrice, error) {
+	ctx := context.Background()
+	prices, err := gorm.G[model.ShowtimePrice](r.db).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func (r *showtimePriceRepoGorm) CreateMissing(category model.TicketCategory, amount int, currency string) (int64, error) {
+	res := r.db.Exec(`INSERT INTO showtime_prices (showtime_id, category, amount, currency)
+		SELECT s.id, ?, ?, ? FROM showtimes s
+		WHERE NOT EXISTS (SELECT 1 FROM showtime_prices p WHERE p.showtime_id = s.id AND p.category = ?)`,
+		category, amount, currency, category)
+	return res.RowsAffected, res.Error
+}
+
+func (r *showtimePriceRepoGorm) DeleteByShowtimeID(showtimeID uint) error {
+	ctx := context.Background()
+	_, err := gorm.G[model.ShowtimePrice](r.db).Where("showtime_id = ?", showtimeID).Delete(ctx)
+	return err
+}
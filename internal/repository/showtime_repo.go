@@ -2,8 +2,11 @@ package repository
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/qs-lzh/flash-sale/internal/model"
 )
@@ -12,8 +15,24 @@ type ShowtimeRepo interface {
 	WithTx(tx *gorm.DB) ShowtimeRepo
 	Create(showtime *model.Showtime) error
 	GetByID(id uint) (*model.Showtime, error)
+	// GetByIDForUpdate reads the showtime and locks its row until the transaction ends
+	GetByIDForUpdate(id uint) (*model.Showtime, error)
 	GetByMovieID(movieID uint) ([]model.Showtime, error)
+	GetByIDs(ids []uint) ([]model.Showtime, error)
 	ListAll() ([]model.Showtime, error)
+	// List returns a page of the showtimes matching the filter ordered by start time, and how many match
+	List(filter ShowtimeFilter, offset, limit int) ([]model.Showtime, int64, error)
+	// Update saves the start time and capacity
+	Update(showtime *model.Showtime) error
+	Delete(id uint) error
+}
+
+// ShowtimeFilter narrows down showtimes, zero fields don't filter
+type ShowtimeFilter struct {
+	MovieID uint
+	// showtimes starting at or after From and before To
+	From time.Time
+	To   time.Time
 }
 
 type showtimeRepoGorm struct {
@@ -51,6 +70,28 @@ func (r *showtimeRepoGorm) GetByID(id uint) (*model.Showtime, error) {
 	return &showtime, nil
 }
 
+func (r *showtimeRepoGorm) GetByIDForUpdate(id uint) (*model.Showtime, error) {
+	ctx := context.Background()
+	showtime, err := gorm.G[model.Showtime](r.db, clause.Locking{Strength: clause.LockingStrengthUpdate}).
+		Where(&model.Showtime{ID: id}).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &showtime, nil
+}
+
+func (r *showtimeRepoGorm) GetByIDs(ids []uint) ([]model.Showtime, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	showtimes, err := gorm.G[model.Showtime](r.db).Where("id IN ?", ids).Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return showtimes, nil
+}
+
 func (r *showtimeRepoGorm) GetByMovieID(movieID uint) ([]model.Showtime, error) {
 	ctx := context.Background()
 	showtimes, err := gorm.G[model.Showtime](r.db).Where(&model.Showtime{MovieID: movieID}).Find(ctx)
@@ -68,3 +109,56 @@ func (r *showtimeRepoGorm) ListAll() ([]model.Showtime, error) {
 	}
 	return showtimes, nil
 }
+
+func (r *showtimeRepoGorm) Update(showtime *model.Showtime) error {
+	ctx := context.Background()
+	rows, err := gorm.G[model.Showtime](r.db).Where("id = ?", showtime.ID).Select("start_at", "capacity").Updates(ctx, *showtime)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *showtimeRepoGorm) Delete(id uint) error {
+	ctx := context.Background()
+	rows, err := gorm.G[model.Showtime](r.db).Where("id = ?", id).Delete(ctx)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *showtimeRepoGorm) List(filter ShowtimeFilter, offset, limit int) ([]model.Showtime, int64, error) {
+	ctx := context.Background()
+	conds := []string{"TRUE"}
+	var args []any
+	if filter.MovieID != 0 {
+		conds = append(conds, "movie_id = ?")
+		args = append(args, filter.MovieID)
+	}
+	if !filter.From.IsZero() {
+		conds = append(conds, "start_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conds = append(conds, "start_at < ?")
+		args = append(args, filter.To)
+	}
+	query := gorm.G[model.Showtime](r.db).Where(strings.Join(conds, " AND "), args...)
+
+	total, err := query.Count(ctx, "*")
+	if err != nil {
+		return nil, 0, err
+	}
+	showtimes, err := query.Order("start_at, id").Offset(offset).Limit(limit).Find(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return showtimes, total, nil
+}
@@ -9,8 +9,10 @@ import (
 
 type UserRepo interface {
 	WithTx(tx *gorm.DB) UserRepo
+	// Create returns gorm.ErrDuplicatedKey if the name is taken
 	Create(user *model.User) error
 	GetByName(name string) (*model.User, error)
+	GetByID(id uint) (*model.User, error)
 }
 
 type userRepoGorm struct {
@@ -35,11 +37,19 @@ func (r *userRepoGorm) WithTx(tx *gorm.DB) UserRepo {
 func (r *userRepoGorm) Create(user *model.User) error {
 	ctx := context.Background()
 	if err := gorm.G[model.User](r.db).Create(ctx, user); err != nil {
-		return err
+		return translateError(r.db, err)
 	}
 	return nil
 }
 
+// translateError turns a driver error into gorm's, e.g. a unique violation into gorm.ErrDuplicatedKey
+func translateError(db *gorm.DB, err error) error {
+	if translator, ok := db.Dialector.(gorm.ErrorTranslator); ok {
+		return translator.Translate(err)
+	}
+	return err
+}
+
 func (r *userRepoGorm) GetByName(name string) (*model.User, error) {
 	ctx := context.Background()
 	user, err := gorm.G[model.User](r.db).Where(model.User{Name: name}).First(ctx)
@@ -48,3 +58,12 @@ func (r *userRepoGorm) GetByName(name string) (*model.User, error) {
 	}
 	return &user, nil
 }
+
+func (r *userRepoGorm) GetByID(id uint) (*model.User, error) {
+	ctx := context.Background()
+	user, err := gorm.G[model.User](r.db).Where("id = ?", id).First(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
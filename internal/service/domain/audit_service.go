@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+)
+
+type AuditService interface {
+	// RecordDenial records a request refused for lacking a role or permission
+	RecordDenial(entry *model.AuditLog) error
+}
+
+type auditService struct {
+	repo repository.AuditLogRepo
+}
+
+var _ AuditService = (*auditService)(nil)
+
+func NewAuditService(auditLogRepo repository.AuditLogRepo) *auditService {
+	return &auditService{
+		repo: auditLogRepo,
+	}
+}
+
+func (s *auditService) RecordDenial(entry *model.AuditLog) error {
+	return s.repo.Create(entry)
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/challenge"
+)
+
+// LocalCaptchaResponse is the only captcha response the local stand-in accepts
+const LocalCaptchaResponse = "local-pass"
+
+// httpCaptchaVerifier checks captcha responses with a siteverify style api,
+// the form "secret=...&response=..." is posted and {"success": true} comes back for a solved captcha
+type httpCaptchaVerifier struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+var _ ChallengeVerifier = (*httpCaptchaVerifier)(nil)
+
+func NewHTTPCaptchaVerifier(verifyURL string, secret string) *httpCaptchaVerifier {
+	return &httpCaptchaVerifier{
+		verifyURL: verifyURL,
+		secret:    secret,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (v *httpCaptchaVerifier) Verify(_ *challenge.Challenge, _ string, solution string) error {
+	resp, err := v.client.PostForm(v.verifyURL, url.Values{
+		"secret":   {v.secret},
+		"response": {solution},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verify api returned %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return challenge.ErrWrongSolution
+	}
+	return nil
+}
+
+// localCaptchaVerifier stands in for a captcha provider during development,
+// it accepts LocalCaptchaResponse and nothing else
+type localCaptchaVerifier struct{}
+
+var _ ChallengeVerifier = localCaptchaVerifier{}
+
+func NewLocalCaptchaVerifier() localCaptchaVerifier {
+	return localCaptchaVerifier{}
+}
+
+func (localCaptchaVerifier) Verify(_ *challenge.Challenge, _ string, solution string) error {
+	if solution != LocalCaptchaResponse {
+		return challenge.ErrWrongSolution
+	}
+	return nil
+}
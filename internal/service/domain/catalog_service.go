@@ -0,0 +1,313 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+)
+
+// CatalogService serves the public movie and showtime listings.
+// The listings are cached for a short while, the remaining tickets are read from redis on every call
+type CatalogService interface {
+	ListMovies(query PageQuery) (*MoviePage, error)
+	GetMovie(movieID uint) (*CatalogMovie, error)
+	ListShowtimes(filter repository.ShowtimeFilter, query PageQuery) (*ShowtimePage, error)
+	GetShowtime(showtimeID uint) (*CatalogShowtime, error)
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var ErrInvalidCatalogQuery = errors.New("invalid page, page size or date range")
+
+// PageQuery selects a page, zero fields mean the first page and the default size
+type PageQuery struct {
+	Page     int
+	PageSize int
+}
+
+type SaleStatus string
+
+const (
+	SaleStatusOnSale  SaleStatus = "ON_SALE"
+	SaleStatusSoldOut SaleStatus = "SOLD_OUT"
+	// the tickets aren't loaded in redis, reserving fails as if it were sold out
+	SaleStatusOffSale SaleStatus = "OFF_SALE"
+)
+
+type CatalogMovie struct {
+	ID          uint   `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type CatalogShowtime struct {
+	ID       uint      `json:"id"`
+	MovieID  uint      `json:"movie_id"`
+	StartAt  time.Time `json:"start_at"`
+	Capacity int       `json:"capacity"`
+	// read live from redis, nil if the tickets aren't loaded
+	RemainingTickets *int       `json:"remaining_tickets"`
+	SaleStatus       SaleStatus `json:"sale_status"`
+}
+
+type MoviePage struct {
+	Items    []CatalogMovie `json:"items"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"page_size"`
+	Total    int64          `json:"total"`
+}
+
+type ShowtimePage struct {
+	Items    []CatalogShowtime `json:"items"`
+	Page     int               `json:"page"`
+	PageSize int               `json:"page_size"`
+	Total    int64             `json:"total"`
+}
+
+type catalogService struct {
+	cache        *cache.RedisCache
+	movieRepo    repository.MovieRepo
+	showtimeRepo repository.ShowtimeRepo
+	ttl          time.Duration
+	// concurrent misses of a query share one load
+	loads singleflight.Group
+}
+
+var _ CatalogService = (*catalogService)(nil)
+
+func NewCatalogService(cache *cache.RedisCache, movieRepo repository.MovieRepo, showtimeRepo repository.ShowtimeRepo,
+	ttl time.Duration) *catalogService {
+	return &catalogService{
+		cache:        cache,
+		movieRepo:    movieRepo,
+		showtimeRepo: showtimeRepo,
+		ttl:          ttl,
+	}
+}
+
+func (s *catalogService) ListMovies(query PageQuery) (*MoviePage, error) {
+	query, err := normalizePageQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return cached(s, fmt.Sprintf("movies:%d:%d", query.Page, query.PageSize), func() (*MoviePage, error) {
+		movies, total, err := s.movieRepo.List((query.Page-1)*query.PageSize, query.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		page := &MoviePage{
+			Items:    make([]CatalogMovie, len(movies)),
+			Page:     query.Page,
+			PageSize: query.PageSize,
+			Total:    total,
+		}
+		for i := range movies {
+			page.Items[i] = newCatalogMovie(&movies[i])
+		}
+		return page, nil
+	})
+}
+
+func (s *catalogService) GetMovie(movieID uint) (*CatalogMovie, error) {
+	return cached(s, fmt.Sprintf("movie:%d", movieID), func() (*CatalogMovie, error) {
+		movie, err := s.movieRepo.GetByID(movieID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, service.ErrNotFound
+			}
+			return nil, err
+		}
+		m := newCatalogMovie(movie)
+		return &m, nil
+	})
+}
+
+func (s *catalogService) ListShowtimes(filter repository.ShowtimeFilter, query PageQuery) (*ShowtimePage, error) {
+	query, err := normalizePageQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return nil, ErrInvalidCatalogQuery
+	}
+
+	key := fmt.Sprintf("showtimes:%d:%d:%d:%d:%d", filter.MovieID, unixOrZero(filter.From), unixOrZero(filter.To),
+		query.Page, query.PageSize)
+	page, err := cached(s, key, func() (*ShowtimePage, error) {
+		showtimes, total, err := s.showtimeRepo.List(filter, (query.Page-1)*query.PageSize, query.PageSize)
+		if err != nil {
+			return nil, err
+		}
+		page := &ShowtimePage{
+			Items:    make([]CatalogShowtime, len(showtimes)),
+			Page:     query.Page,
+			PageSize: query.PageSize,
+			Total:    total,
+		}
+		for i := range showtimes {
+			page.Items[i] = newCatalogShowtime(&showtimes[i])
+		}
+		return page, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.fillRemainingTickets(page.Items); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (s *catalogService) GetShowtime(showtimeID uint) (*CatalogShowtime, error) {
+	showtime, err := cached(s, fmt.Sprintf("showtime:%d", showtimeID), func() (*CatalogShowtime, error) {
+		showtime, err := s.showtimeRepo.GetByID(showtimeID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, service.ErrNotFound
+			}
+			return nil, err
+		}
+		st := newCatalogShowtime(showtime)
+		return &st, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []CatalogShowtime{*showtime}
+	if err := s.fillRemainingTickets(items); err != nil {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+// fillRemainingTickets sets the live remaining tickets and sale status of the showtimes
+func (s *catalogService) fillRemainingTickets(showtimes []CatalogShowtime) error {
+	ids := make([]uint, len(showtimes))
+	for i, showtime := range showtimes {
+		ids[i] = showtime.ID
+	}
+	remaining, err := s.cache.GetRemainingTicketsBatch(ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range showtimes {
+		remain, ok := remaining[showtimes[i].ID]
+		switch {
+		case !ok:
+			showtimes[i].RemainingTickets = nil
+			showtimes[i].SaleStatus = SaleStatusOffSale
+		case remain <= 0:
+			showtimes[i].RemainingTickets = &remain
+			showtimes[i].SaleStatus = SaleStatusSoldOut
+		default:
+			showtimes[i].RemainingTickets = &remain
+			showtimes[i].SaleStatus = SaleStatusOnSale
+		}
+	}
+	return nil
+}
+
+// catalogEntry is a cached query result, NotFound caches a load that returned service.ErrNotFound
+type catalogEntry[T any] struct {
+	Value    *T   `json:"value,omitempty"`
+	NotFound bool `json:"not_found,omitempty"`
+}
+
+// cached returns the cached result of the query, or loads and caches it.
+// Concurrent misses of the same query wait for a single load, and service.ErrNotFound is cached like a result.
+// Every caller gets its own copy of the result, which it may change.
+// Redis failures only cost a trip to postgres, they aren't returned
+func cached[T any](s *catalogService, query string, load func() (*T, error)) (*T, error) {
+	var entry catalogEntry[T]
+	err := s.cache.GetCatalogQuery(query, &entry)
+	if err == nil && entry.NotFound {
+		return nil, service.ErrNotFound
+	}
+	if err == nil && entry.Value != nil {
+		return entry.Value, nil
+	}
+	if err != nil && !errors.Is(err, cache.ErrCacheMiss) {
+		log.Printf("Failed to read catalog query %s from cache: %v", query, err)
+	}
+
+	// the callers share the encoded entry, not the loaded value
+	data, err, _ := s.loads.Do(query, func() (any, error) {
+		loaded, err := load()
+		if err != nil && !errors.Is(err, service.ErrNotFound) {
+			return nil, err
+		}
+		data, err := json.Marshal(catalogEntry[T]{Value: loaded, NotFound: err != nil})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.cache.SetCatalogQuery(query, json.RawMessage(data), s.ttl); err != nil {
+			log.Printf("Failed to cache catalog query %s: %v", query, err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry = catalogEntry[T]{}
+	if err := json.Unmarshal(data.([]byte), &entry); err != nil {
+		return nil, err
+	}
+	if entry.NotFound {
+		return nil, service.ErrNotFound
+	}
+	return entry.Value, nil
+}
+
+func normalizePageQuery(query PageQuery) (PageQuery, error) {
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	if query.PageSize == 0 {
+		query.PageSize = defaultPageSize
+	}
+	if query.Page < 1 || query.PageSize < 1 || query.PageSize > maxPageSize {
+		return query, ErrInvalidCatalogQuery
+	}
+	return query, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func newCatalogMovie(movie *model.Movie) CatalogMovie {
+	return CatalogMovie{
+		ID:          movie.ID,
+		Title:       movie.Title,
+		Description: movie.Description,
+	}
+}
+
+func newCatalogShowtime(showtime *model.Showtime) CatalogShowtime {
+	return CatalogShowtime{
+		ID:       showtime.ID,
+		MovieID:  showtime.MovieID,
+		StartAt:  showtime.StartAt,
+		Capacity: showtime.Capacity,
+	}
+}
@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+// countingMovieRepo counts the GetByID calls, which take delay, the movies it doesn't have aren't found
+type countingMovieRepo struct {
+	repository.MovieRepo
+	delay  time.Duration
+	movies map[uint]*model.Movie
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *countingMovieRepo) GetByID(id uint) (*model.Movie, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	if movie, ok := r.movies[id]; ok {
+		return movie, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *countingMovieRepo) loads() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+// slowShowtimeRepo lists the same showtimes for every filter, each List call takes delay
+type slowShowtimeRepo struct {
+	repository.ShowtimeRepo
+	delay     time.Duration
+	showtimes []model.Showtime
+}
+
+func (r *slowShowtimeRepo) List(_ repository.ShowtimeFilter, _, _ int) ([]model.Showtime, int64, error) {
+	time.Sleep(r.delay)
+	return r.showtimes, int64(len(r.showtimes)), nil
+}
+
+func TestCatalogService_CoalescesLoads(t *testing.T) {
+	movie := &model.Movie{ID: testutil.ID(), Title: "Coalesced"}
+	repo := &countingMovieRepo{delay: 100 * time.Millisecond, movies: map[uint]*model.Movie{movie.ID: movie}}
+	s := NewCatalogService(testutil.Redis(t), repo, nil, time.Minute)
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var got *CatalogMovie
+			got, errs[i] = s.GetMovie(movie.ID)
+			if errs[i] == nil && got.Title != movie.Title {
+				errs[i] = errors.New("wrong movie " + got.Title)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to get movie: %v", err)
+		}
+	}
+	if loads := repo.loads(); loads != 1 {
+		t.Errorf("Expected one load, got %d", loads)
+	}
+}
+
+func TestCatalogService_CachesNotFound(t *testing.T) {
+	repo := &countingMovieRepo{}
+	s := NewCatalogService(testutil.Redis(t), repo, nil, time.Minute)
+	movieID := testutil.ID()
+
+	for range 3 {
+		if _, err := s.GetMovie(movieID); !errors.Is(err, service.ErrNotFound) {
+			t.Fatalf("Expected the movie not to be found, got %v", err)
+		}
+	}
+	if loads := repo.loads(); loads != 1 {
+		t.Errorf("Expected one load, got %d", loads)
+	}
+}
+
+// the callers of a coalesced load fill in the remaining tickets of their own page, run with -race
+func TestCatalogService_ConcurrentListShowtimes(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	movieID := testutil.ID()
+	repo := &slowShowtimeRepo{delay: 50 * time.Millisecond}
+	for i := range 3 {
+		showtime := model.Showtime{ID: testutil.ID(), MovieID: movieID, StartAt: time.Now().Add(time.Hour), Capacity: 10}
+		if err := redisCache.SetRemainingTickets(showtime.ID, i); err != nil {
+			t.Fatalf("Failed to set tickets: %v", err)
+		}
+		repo.showtimes = append(repo.showtimes, showtime)
+	}
+	s := NewCatalogService(redisCache, nil, repo, time.Minute)
+
+	const n = 10
+	pages := make([]*ShowtimePage, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pages[i], errs[i] = s.ListShowtimes(repository.ShowtimeFilter{MovieID: movieID}, PageQuery{})
+		}()
+	}
+	wg.Wait()
+
+	for i, page := range pages {
+		if errs[i] != nil {
+			t.Fatalf("Failed to list showtimes: %v", errs[i])
+		}
+		if len(page.Items) != 3 {
+			t.Fatalf("Expected 3 showtimes, got %+v", page.Items)
+		}
+		for j, item := range page.Items {
+			if item.RemainingTickets == nil || *item.RemainingTickets != j {
+				t.Errorf("Expected %d tickets left of showtime %d, got %v", j, item.ID, item.RemainingTickets)
+			}
+		}
+		if i > 0 && page == pages[0] {
+			t.Errorf("Expected every caller to get its own page")
+		}
+	}
+}
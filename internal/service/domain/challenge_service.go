@@ -0,0 +1,185 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/challenge"
+	"github.com/qs-lzh/flash-sale/internal/service"
+)
+
+// challenge modes, selected by config.Config.ChallengeMode, an empty mode turns the challenges off
+const (
+	ChallengeModeProofOfWork = "pow"
+	ChallengeModeCaptcha     = "captcha"
+	// captchas checked by the local stand-in, for development only
+	ChallengeModeCaptchaLocal = "captcha-local"
+)
+
+// IssuedChallenge is what a client has to solve before reserving a ticket of the showtime
+type IssuedChallenge struct {
+	Challenge string `json:"challenge"`
+	Mode      string `json:"mode"`
+	// leading zero bits sha256("<challenge>:<solution>") needs, only for proof-of-work
+	Difficulty int       `json:"difficulty,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type ChallengeService interface {
+	// Enabled reports whether reserving requires a solved challenge
+	Enabled() bool
+	// IssueChallenge returns a challenge for the user to reserve a ticket of the showtime,
+	// it returns service.ErrNotFound if the showtime's tickets aren't on sale
+	IssueChallenge(userID uint, showtimeID uint) (*IssuedChallenge, error)
+	// VerifySolution checks that the solution solves a challenge issued to the user for the showtime,
+	// and uses the challenge up, every challenge lets one reservation through
+	VerifySolution(userID uint, showtimeID uint, token string, solution string) error
+	// GetDifficulty returns the proof-of-work difficulty of a showtime
+	GetDifficulty(showtimeID uint) (int, error)
+	// SetDifficulty raises the proof-of-work difficulty of a showtime's new challenges, 0 resets it to the default
+	SetDifficulty(showtimeID uint, difficulty int) error
+}
+
+var (
+	ErrChallengeRequired          = errors.New("a solved challenge is required")
+	ErrInvalidChallenge           = errors.New("the challenge is invalid, expired or not issued for the reservation")
+	ErrChallengeUsed              = errors.New("the challenge was already used")
+	ErrWrongChallengeSolution     = errors.New("the challenge solution is wrong")
+	ErrInvalidChallengeDifficulty = fmt.Errorf("challenge difficulty must be between 0 and %d", challenge.MaxDifficulty)
+)
+
+// ChallengeVerifier checks the solution of a challenge, token is the signed challenge the client got
+type ChallengeVerifier interface {
+	Verify(c *challenge.Challenge, token string, solution string) error
+}
+
+type challengeService struct {
+	cache *cache.RedisCache
+
+	showtimeService ShowtimeService
+
+	mode       string
+	signer     *challenge.Signer
+	verifier   ChallengeVerifier
+	difficulty int
+	ttl        time.Duration
+}
+
+var _ ChallengeService = (*challengeService)(nil)
+
+// NewChallengeService issues challenges of mode, an empty mode turns them off
+func NewChallengeService(cache *cache.RedisCache, showtimeService ShowtimeService, mode string, secret string,
+	verifier ChallengeVerifier, difficulty int, ttl time.Duration) *challengeService {
+	return &challengeService{
+		cache:           cache,
+		showtimeService: showtimeService,
+		mode:            mode,
+		signer:          challenge.NewSigner(secret),
+		verifier:        verifier,
+		difficulty:      difficulty,
+		ttl:             ttl,
+	}
+}
+
+func (s *challengeService) Enabled() bool {
+	return s.mode != ""
+}
+
+func (s *challengeService) IssueChallenge(userID uint, showtimeID uint) (*IssuedChallenge, error) {
+	// every showtime on sale has its tickets in redis, so the database isn't asked during a sale
+	if _, err := s.cache.GetRemainingTickets(showtimeID); err != nil {
+		if errors.Is(err, cache.ErrCacheMiss) {
+			return nil, service.ErrNotFound
+		}
+		return nil, err
+	}
+
+	difficulty := 0
+	if s.mode == ChallengeModeProofOfWork {
+		var err error
+		if difficulty, err = s.GetDifficulty(showtimeID); err != nil {
+			return nil, err
+		}
+	}
+
+	c := challenge.New(userID, showtimeID, difficulty, s.ttl, time.Now())
+	token, err := s.signer.Sign(c)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedChallenge{
+		Challenge:  token,
+		Mode:       s.mode,
+		Difficulty: difficulty,
+		ExpiresAt:  time.Unix(c.ExpiresAt, 0),
+	}, nil
+}
+
+func (s *challengeService) VerifySolution(userID uint, showtimeID uint, token string, solution string) error {
+	if token == "" || solution == "" {
+		return ErrChallengeRequired
+	}
+	c, err := s.signer.Parse(token, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidChallenge, err)
+	}
+	if c.UserID != userID || c.ShowtimeID != showtimeID {
+		return ErrInvalidChallenge
+	}
+
+	if err := s.verifier.Verify(c, token, solution); err != nil {
+		if errors.Is(err, challenge.ErrWrongSolution) {
+			return ErrWrongChallengeSolution
+		}
+		return err
+	}
+
+	// the challenge is kept until it expires, it's rejected by Parse afterwards
+	ok, err := s.cache.UseChallenge(c.ID, time.Until(time.Unix(c.ExpiresAt, 0)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChallengeUsed
+	}
+	return nil
+}
+
+func (s *challengeService) GetDifficulty(showtimeID uint) (int, error) {
+	difficulty, err := s.cache.GetChallengeDifficulty(showtimeID)
+	if err != nil {
+		if errors.Is(err, cache.ErrCacheMiss) {
+			return s.difficulty, nil
+		}
+		return 0, err
+	}
+	return difficulty, nil
+}
+
+func (s *challengeService) SetDifficulty(showtimeID uint, difficulty int) error {
+	if difficulty < 0 || difficulty > challenge.MaxDifficulty {
+		return ErrInvalidChallengeDifficulty
+	}
+	if _, err := s.showtimeService.GetShowtimeByID(showtimeID); err != nil {
+		return err
+	}
+	if difficulty == 0 {
+		return s.cache.DeleteChallengeDifficulty(showtimeID)
+	}
+	return s.cache.SetChallengeDifficulty(showtimeID, difficulty)
+}
+
+// proofOfWorkVerifier accepts solutions with as many leading zero bits as the challenge was issued with
+type proofOfWorkVerifier struct{}
+
+var _ ChallengeVerifier = proofOfWorkVerifier{}
+
+func NewProofOfWorkVerifier() proofOfWorkVerifier {
+	return proofOfWorkVerifier{}
+}
+
+func (proofOfWorkVerifier) Verify(c *challenge.Challenge, token string, solution string) error {
+	return challenge.VerifyProofOfWork(token, solution, c.Difficulty)
+}
@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+// issueTestChallenge issues a local captcha challenge of a new showtime on sale, valid for ttl
+func issueTestChallenge(t *testing.T, ttl time.Duration) (*challengeService, uint, uint, string) {
+	t.Helper()
+
+	redisCache := testutil.Redis(t)
+	s := NewChallengeService(redisCache, nil, ChallengeModeCaptchaLocal, "secret", NewLocalCaptchaVerifier(), 0, ttl)
+	userID, showtimeID := testutil.ID(), testutil.ID()
+	if err := redisCache.SetRemainingTickets(showtimeID, 1); err != nil {
+		t.Fatalf("Failed to set tickets: %v", err)
+	}
+	issued, err := s.IssueChallenge(userID, showtimeID)
+	if err != nil {
+		t.Fatalf("Failed to issue challenge: %v", err)
+	}
+	if issued.Mode != ChallengeModeCaptchaLocal || issued.Difficulty != 0 {
+		t.Errorf("Expected a local captcha challenge, got %+v", issued)
+	}
+	return s, userID, showtimeID, issued.Challenge
+}
+
+func TestChallengeService_VerifySolutionOnce(t *testing.T) {
+	s, userID, showtimeID, token := issueTestChallenge(t, time.Minute)
+
+	if err := s.VerifySolution(userID, showtimeID, token, LocalCaptchaResponse); err != nil {
+		t.Fatalf("Expected the solution to be accepted, got %v", err)
+	}
+	if err := s.VerifySolution(userID, showtimeID, token, LocalCaptchaResponse); !errors.Is(err, ErrChallengeUsed) {
+		t.Errorf("Expected the challenge to be used up, got %v", err)
+	}
+}
+
+func TestChallengeService_VerifySolutionBinding(t *testing.T) {
+	s, userID, showtimeID, token := issueTestChallenge(t, time.Minute)
+
+	if err := s.VerifySolution(userID+1, showtimeID, token, LocalCaptchaResponse); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("Expected the challenge of another user to be rejected, got %v", err)
+	}
+	if err := s.VerifySolution(userID, showtimeID+1, token, LocalCaptchaResponse); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("Expected the challenge of another showtime to be rejected, got %v", err)
+	}
+	if err := s.VerifySolution(userID, showtimeID, token+"x", LocalCaptchaResponse); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("Expected a tampered challenge to be rejected, got %v", err)
+	}
+	// the rejections didn't use the challenge up
+	if err := s.VerifySolution(userID, showtimeID, token, LocalCaptchaResponse); err != nil {
+		t.Errorf("Expected the solution to be accepted, got %v", err)
+	}
+}
+
+func TestChallengeService_VerifyWrongSolution(t *testing.T) {
+	s, userID, showtimeID, token := issueTestChallenge(t, time.Minute)
+
+	if err := s.VerifySolution(userID, showtimeID, token, "wrong"); !errors.Is(err, ErrWrongChallengeSolution) {
+		t.Errorf("Expected a wrong solution to be rejected, got %v", err)
+	}
+	if err := s.VerifySolution(userID, showtimeID, token, ""); !errors.Is(err, ErrChallengeRequired) {
+		t.Errorf("Expected a missing solution to be rejected, got %v", err)
+	}
+	if err := s.VerifySolution(userID, showtimeID, token, LocalCaptchaResponse); err != nil {
+		t.Errorf("Expected the right solution to be accepted after a wrong one, got %v", err)
+	}
+}
+
+func TestChallengeService_VerifyExpiredChallenge(t *testing.T) {
+	s, userID, showtimeID, token := issueTestChallenge(t, -time.Minute)
+
+	if err := s.VerifySolution(userID, showtimeID, token, LocalCaptchaResponse); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("Expected the expired challenge to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fakeProvider creates intents that stay pending until the test sets their status, and records the refunds.
+// Refunding an intent again is a no-op like at a real provider
+type fakeProvider struct {
+	mu       sync.Mutex
+	created  int
+	statuses map[string]PaymentIntentStatus
+	refunded map[string]int
+	// returned by the next Refund calls, one error per call
+	refundErrs []error
+	// returned by the next CreateIntent calls, one error per call
+	createErrs []error
+	// how long CreateIntent takes
+	createDelay time.Duration
+}
+
+var _ PaymentProvider = (*fakeProvider)(nil)
+
+var errProviderUnavailable = errors.New("provider unavailable")
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		statuses: make(map[string]PaymentIntentStatus),
+		refunded: make(map[string]int),
+	}
+}
+
+func (p *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakeProvider) CreateIntent(reservationID uint, amount int) (*PaymentIntent, error) {
+	time.Sleep(p.createDelay)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.createErrs) > 0 {
+		err := p.createErrs[0]
+		p.createErrs = p.createErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.created++
+	return &PaymentIntent{
+		ID:            fmt.Sprintf("pi_fake_%d", reservationID),
+		ReservationID: reservationID,
+		Amount:        amount,
+		Status:        PaymentIntentStatusPending,
+	}, nil
+}
+
+func (p *fakeProvider) QueryStatus(intentID string) (PaymentIntentStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if status, ok := p.statuses[intentID]; ok {
+		return status, nil
+	}
+	return PaymentIntentStatusPending, nil
+}
+
+// setStatus is what the customer did at the provider
+func (p *fakeProvider) setStatus(intentID string, status PaymentIntentStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.statuses[intentID] = status
+}
+
+func (p *fakeProvider) Refund(intentID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.refundErrs) > 0 {
+		err := p.refundErrs[0]
+		p.refundErrs = p.refundErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	p.refunded[intentID]++
+	p.statuses[intentID] = PaymentIntentStatusRefunded
+	return nil
+}
+
+// intents returns how many intents were created
+func (p *fakeProvider) intents() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.created
+}
+
+// refunds returns how often the intent was refunded
+func (p *fakeProvider) refunds(intentID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refunded[intentID]
+}
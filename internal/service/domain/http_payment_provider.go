@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// httpPaymentProvider talks to a payment provider over http,
+// the provider reports results by calling the /payments/webhook endpoint.
+// The api is the one of the local stand-in in cmd/payment-stub.
+type httpPaymentProvider struct {
+	name    string
+	baseURL string
+	client  *http.Client
+}
+
+var _ PaymentProvider = (*httpPaymentProvider)(nil)
+
+func NewHTTPPaymentProvider(name string, baseURL string) *httpPaymentProvider {
+	return &httpPaymentProvider{
+		name:    name,
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (p *httpPaymentProvider) Name() string {
+	return p.name
+}
+
+func (p *httpPaymentProvider) CreateIntent(reservationID uint, amount int) (*PaymentIntent, error) {
+	var intent PaymentIntent
+	if err := p.do(http.MethodPost, "/intents", PaymentIntent{
+		ReservationID: reservationID,
+		Amount:        amount,
+	}, &intent); err != nil {
+		return nil, err
+	}
+	return &intent, nil
+}
+
+func (p *httpPaymentProvider) QueryStatus(intentID string) (PaymentIntentStatus, error) {
+	var intent PaymentIntent
+	if err := p.do(http.MethodGet, "/intents/"+intentID, nil, &intent); err != nil {
+		return "", err
+	}
+	return intent.Status, nil
+}
+
+func (p *httpPaymentProvider) Refund(intentID string) error {
+	return p.do(http.MethodPost, "/intents/"+intentID+"/refund", nil, nil)
+}
+
+func (p *httpPaymentProvider) do(method string, path string, reqBody any, respBody any) error {
+	var body bytes.Buffer
+	if reqBody != nil {
+		if err := json.NewEncoder(&body).Encode(reqBody); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("payment provider %s: %w", p.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrPaymentIntentNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("payment provider %s: %s %s returned %d", p.name, method, path, resp.StatusCode)
+	}
+
+	if respBody == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(respBody)
+}
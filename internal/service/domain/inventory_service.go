@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"errors"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+)
+
+type InventoryService interface {
+	// AdjustInventory adds delta tickets to the remaining tickets of a showtime, or removes them if it's negative,
+	// and returns the tickets left. It returns cache.ErrNotEnoughTickets if fewer tickets remain than would be removed.
+	AdjustInventory(showtimeID uint, delta int) (int, error)
+}
+
+var (
+	ErrInvalidInventoryAdjustment = errors.New("inventory adjustment must not be zero")
+	ErrInventoryNotLoaded         = errors.New("the showtime's tickets aren't loaded")
+)
+
+type inventoryService struct {
+	cache *cache.RedisCache
+
+	showtimeService ShowtimeService
+}
+
+var _ InventoryService = (*inventoryService)(nil)
+
+func NewInventoryService(cache *cache.RedisCache, showtimeService ShowtimeService) *inventoryService {
+	return &inventoryService{
+		cache:           cache,
+		showtimeService: showtimeService,
+	}
+}
+
+func (s *inventoryService) AdjustInventory(showtimeID uint, delta int) (int, error) {
+	if delta == 0 {
+		return 0, ErrInvalidInventoryAdjustment
+	}
+	if _, err := s.showtimeService.GetShowtimeByID(showtimeID); err != nil {
+		return 0, err
+	}
+
+	remain, err := s.cache.AdjustRemainingTickets(showtimeID, delta)
+	if err != nil {
+		if errors.Is(err, cache.ErrCacheMiss) {
+			return 0, ErrInventoryNotLoaded
+		}
+		return remain, err
+	}
+	return remain, nil
+}
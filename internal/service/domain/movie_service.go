@@ -2,6 +2,7 @@ package domain
 
 import (
 	"errors"
+	"strings"
 
 	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/repository"
@@ -11,35 +12,106 @@ import (
 
 type MovieService interface {
 	CreateMovie(movie *model.Movie) error
+	// UpdateMovie changes the title and description,
+	// it returns ErrRelatedResourceExists if any showtime of the movie has orders
+	UpdateMovie(movie *model.Movie) error
+	// DeleteMovie returns ErrRelatedResourceExists if the movie has showtimes, they are deleted first
+	DeleteMovie(id uint) error
 	GetMovieByID(id uint) (*model.Movie, error)
 	GetAllMovies() ([]model.Movie, error)
 }
 
+var ErrInvalidMovieTitle = errors.New("movie title must be 1 to 100 characters")
+
 type movieService struct {
 	db              *gorm.DB
 	repo            repository.MovieRepo
+	orderRepo       repository.OrderRepo
 	showtimeService ShowtimeService
 }
 
 var _ MovieService = (*movieService)(nil)
 
-func NewMovieService(db *gorm.DB, movieRepo repository.MovieRepo, showtimeService ShowtimeService) *movieService {
+func NewMovieService(db *gorm.DB, movieRepo repository.MovieRepo, orderRepo repository.OrderRepo,
+	showtimeService ShowtimeService) *movieService {
 	return &movieService{
 		db:              db,
 		repo:            movieRepo,
+		orderRepo:       orderRepo,
 		showtimeService: showtimeService,
 	}
 }
 
 func (s *movieService) CreateMovie(movie *model.Movie) error {
-	if err := s.repo.Create(movie); err != nil {
+	if err := validateMovie(movie); err != nil {
 		return err
 	}
-	return nil
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkTitleFree(tx, movie); err != nil {
+			return err
+		}
+		return s.repo.WithTx(tx).Create(movie)
+	})
 }
 
 var ErrRelatedResourceExists = errors.New("There's are related resources, so can't change")
 
+func (s *movieService) UpdateMovie(movie *model.Movie) error {
+	if err := validateMovie(movie); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByID(movie.ID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrNotFound
+			}
+			return err
+		}
+		if err := s.checkTitleFree(tx, movie); err != nil {
+			return err
+		}
+
+		showtimes, err := s.showtimeService.GetShowtimesByMovieIDTx(tx, movie.ID)
+		if err != nil {
+			return err
+		}
+		showtimeIDs := make([]uint, len(showtimes))
+		for i, showtime := range showtimes {
+			showtimeIDs[i] = showtime.ID
+		}
+		count, err := s.orderRepo.WithTx(tx).CountByShowtimeIDs(showtimeIDs)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRelatedResourceExists
+		}
+
+		return s.repo.WithTx(tx).Update(movie)
+	})
+}
+
+func (s *movieService) DeleteMovie(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByID(id); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrNotFound
+			}
+			return err
+		}
+		showtimes, err := s.showtimeService.GetShowtimesByMovieIDTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if len(showtimes) > 0 {
+			return ErrRelatedResourceExists
+		}
+		return s.repo.WithTx(tx).Delete(id)
+	})
+}
+
 func (s *movieService) GetMovieByID(id uint) (*model.Movie, error) {
 	movie, err := s.repo.GetByID(id)
 	if err != nil {
@@ -58,3 +130,26 @@ func (s *movieService) GetAllMovies() ([]model.Movie, error) {
 	}
 	return movies, nil
 }
+
+// checkTitleFree returns service.ErrAlreadyExists if another movie has the title
+func (s *movieService) checkTitleFree(tx *gorm.DB, movie *model.Movie) error {
+	existing, err := s.repo.WithTx(tx).GetByTitle(movie.Title)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if existing.ID != movie.ID {
+		return service.ErrAlreadyExists
+	}
+	return nil
+}
+
+func validateMovie(movie *model.Movie) error {
+	movie.Title = strings.TrimSpace(movie.Title)
+	if movie.Title == "" || len([]rune(movie.Title)) > 100 {
+		return ErrInvalidMovieTitle
+	}
+	return nil
+}
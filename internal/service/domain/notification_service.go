@@ -0,0 +1,121 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+)
+
+type NotificationService interface {
+	// Channels returns the channels the user wants notifications on
+	Channels(userID uint) ([]string, error)
+	// Send renders the notification and sends it through one channel
+	Send(n notification.Notification, channel string) error
+	GetPreference(userID uint) (*model.NotificationPreference, error)
+	SetPreference(preference *model.NotificationPreference) error
+}
+
+var (
+	ErrInvalidEmail = errors.New("invalid email address")
+	ErrInvalidPhone = errors.New("invalid phone number")
+)
+
+// E.164 like, e.g. +8613800138000
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+
+type notificationService struct {
+	db       *gorm.DB
+	repo     repository.NotificationPreferenceRepo
+	channels map[string]notification.Channel
+}
+
+var _ NotificationService = (*notificationService)(nil)
+
+func NewNotificationService(db *gorm.DB, preferenceRepo repository.NotificationPreferenceRepo,
+	channels ...notification.Channel) *notificationService {
+	byName := make(map[string]notification.Channel, len(channels))
+	for _, channel := range channels {
+		byName[channel.Name()] = channel
+	}
+	return &notificationService{
+		db:       db,
+		repo:     preferenceRepo,
+		channels: byName,
+	}
+}
+
+func (s *notificationService) Channels(userID uint) ([]string, error) {
+	preference, err := s.GetPreference(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []string
+	if preference.EmailEnabled {
+		channels = append(channels, notification.ChannelEmail)
+	}
+	if preference.SMSEnabled {
+		channels = append(channels, notification.ChannelSMS)
+	}
+	return channels, nil
+}
+
+func (s *notificationService) Send(n notification.Notification, channelName string) error {
+	channel, ok := s.channels[channelName]
+	if !ok {
+		return fmt.Errorf("unknown notification channel %q", channelName)
+	}
+
+	preference, err := s.GetPreference(n.UserID)
+	if err != nil {
+		return err
+	}
+	message, err := notification.Render(n, channelName)
+	if err != nil {
+		return err
+	}
+
+	recipient := notification.Recipient{UserID: n.UserID}
+	switch channelName {
+	case notification.ChannelEmail:
+		recipient.Address = preference.Email
+	case notification.ChannelSMS:
+		recipient.Address = preference.Phone
+	}
+	return channel.Send(recipient, message)
+}
+
+func (s *notificationService) GetPreference(userID uint) (*model.NotificationPreference, error) {
+	preference, err := s.repo.GetByUserID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.DefaultNotificationPreference(userID), nil
+		}
+		return nil, err
+	}
+	return preference, nil
+}
+
+func (s *notificationService) SetPreference(preference *model.NotificationPreference) error {
+	if preference.Email != "" {
+		address, err := mail.ParseAddress(preference.Email)
+		// a bare address only, no display name
+		if err != nil || address.Address != preference.Email {
+			return ErrInvalidEmail
+		}
+	}
+	if preference.Phone != "" && !phonePattern.MatchString(preference.Phone) {
+		return ErrInvalidPhone
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return s.repo.WithTx(tx).Upsert(preference)
+	})
+}
@@ -0,0 +1,235 @@
+package domain
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+)
+
+// OrderHistoryService lists orders together with the reservations still held or paid in redis
+// whose orders aren't written yet, newest first. Pages continue below the NextCursor of the previous page
+type OrderHistoryService interface {
+	ListUserOrders(userID uint, cursor uint, limit int) (*OrderHistoryPage, error)
+	ListShowtimeOrders(showtimeID uint, cursor uint, limit int) (*OrderHistoryPage, error)
+}
+
+var ErrInvalidOrderHistoryLimit = errors.New("limit must be 1 to 100")
+
+// OrderHistoryItem is an order or a pending reservation with the showtime it's for
+type OrderHistoryItem struct {
+	ReservationStatus
+	// zero if the showtime was deleted
+	MovieID    uint
+	MovieTitle string
+	StartAt    time.Time
+}
+
+type OrderHistoryPage struct {
+	Items []OrderHistoryItem
+	// reservation id to continue from, 0 if there's nothing more
+	NextCursor uint
+}
+
+type orderHistoryService struct {
+	cache        *cache.RedisCache
+	orderRepo    repository.OrderRepo
+	showtimeRepo repository.ShowtimeRepo
+	movieRepo    repository.MovieRepo
+}
+
+var _ OrderHistoryService = (*orderHistoryService)(nil)
+
+func NewOrderHistoryService(cache *cache.RedisCache, orderRepo repository.OrderRepo,
+	showtimeRepo repository.ShowtimeRepo, movieRepo repository.MovieRepo) *orderHistoryService {
+	return &orderHistoryService{
+		cache:        cache,
+		orderRepo:    orderRepo,
+		showtimeRepo: showtimeRepo,
+		movieRepo:    movieRepo,
+	}
+}
+
+func (s *orderHistoryService) ListUserOrders(userID uint, cursor uint, limit int) (*OrderHistoryPage, error) {
+	return s.list(cache.MakeUserReservationsKey(userID), true, func(beforeID uint, limit int) ([]model.Order, error) {
+		return s.orderRepo.ListByUserID(userID, beforeID, limit)
+	}, cursor, limit)
+}
+
+func (s *orderHistoryService) ListShowtimeOrders(showtimeID uint, cursor uint, limit int) (*OrderHistoryPage, error) {
+	// reconciliation reads every reservation of the showtime from its index, so only missing ones are dropped
+	return s.list(cache.MakeShowtimeReservationsKey(showtimeID), false, func(beforeID uint, limit int) ([]model.Order, error) {
+		return s.orderRepo.ListByShowtimeID(showtimeID, beforeID, limit)
+	}, cursor, limit)
+}
+
+// list merges the newest orders below cursor with the pending reservations of the redis index.
+// Redis is read first, a reservation persisted in between then shows up in both and the order wins.
+// pruneSettled is passed on to pendingReservations
+func (s *orderHistoryService) list(indexKey string, pruneSettled bool, listOrders func(beforeID uint, limit int) ([]model.Order, error),
+	cursor uint, limit int) (*OrderHistoryPage, error) {
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 1 || limit > maxPageSize {
+		return nil, ErrInvalidOrderHistoryLimit
+	}
+
+	pending, err := s.pendingReservations(indexKey, pruneSettled, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := listOrders(cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]OrderHistoryItem, 0, len(orders)+len(pending))
+	persisted := make(map[uint]bool, len(orders))
+	for i := range orders {
+		persisted[orders[i].ID] = true
+		items = append(items, OrderHistoryItem{ReservationStatus: *newOrderReservationStatus(&orders[i])})
+	}
+	for _, status := range pending {
+		if !persisted[status.ReservationID] {
+			items = append(items, OrderHistoryItem{ReservationStatus: *status})
+		}
+	}
+	slices.SortFunc(items, func(a, b OrderHistoryItem) int {
+		return cmp.Compare(b.ReservationID, a.ReservationID)
+	})
+
+	page := &OrderHistoryPage{}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	if len(items) == limit {
+		page.NextCursor = items[len(items)-1].ReservationID
+	}
+	if err := s.addShowtimes(items); err != nil {
+		return nil, err
+	}
+	page.Items = items
+	return page, nil
+}
+
+// pendingReservations returns up to limit reservations of the index below cursor which are held,
+// or paid without an order. Reservations missing from redis are dropped from the index on the way, and so are
+// the others if pruneSettled is set, so it doesn't keep growing
+func (s *orderHistoryService) pendingReservations(indexKey string, pruneSettled bool, cursor uint, limit int) ([]*ReservationStatus, error) {
+	var pending []*ReservationStatus
+	before := cursor
+	for len(pending) < limit {
+		ids, err := s.cache.ListReservationIndex(indexKey, before, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		before = ids[len(ids)-1]
+
+		reservations, err := s.cache.LookupReservations(ids)
+		if err != nil {
+			return nil, err
+		}
+		var paid []uint
+		for i, reservation := range reservations {
+			if reservation != nil && reservation.Status == cache.ReservationStatusPaid {
+				paid = append(paid, ids[i])
+			}
+		}
+		orders, err := s.orderRepo.GetByIDs(paid)
+		if err != nil {
+			return nil, err
+		}
+		ordered := make(map[uint]bool, len(orders))
+		for _, order := range orders {
+			ordered[order.ID] = true
+		}
+
+		var stale []uint
+		for i, reservation := range reservations {
+			switch {
+			case reservation == nil:
+				stale = append(stale, ids[i])
+			case reservation.Status == cache.ReservationStatusReserved:
+				pending = append(pending, newPendingReservationStatus(ids[i], reservation, ReservationStateReserved))
+			case reservation.Status == cache.ReservationStatusPaid && !ordered[ids[i]]:
+				pending = append(pending, newPendingReservationStatus(ids[i], reservation, ReservationStatePaid))
+			case pruneSettled:
+				stale = append(stale, ids[i])
+			}
+		}
+		if err := s.cache.RemoveFromReservationIndex(indexKey, stale); err != nil {
+			log.Printf("Failed to clean reservation index %s: %v", indexKey, err)
+		}
+
+		if len(ids) < limit {
+			break
+		}
+	}
+	return pending, nil
+}
+
+// addShowtimes fills in the movie and start time of the items
+func (s *orderHistoryService) addShowtimes(items []OrderHistoryItem) error {
+	var showtimeIDs []uint
+	for _, item := range items {
+		if !slices.Contains(showtimeIDs, item.ShowtimeID) {
+			showtimeIDs = append(showtimeIDs, item.ShowtimeID)
+		}
+	}
+	showtimes, err := s.showtimeRepo.GetByIDs(showtimeIDs)
+	if err != nil {
+		return err
+	}
+
+	showtimeByID := make(map[uint]*model.Showtime, len(showtimes))
+	var movieIDs []uint
+	for i := range showtimes {
+		showtimeByID[showtimes[i].ID] = &showtimes[i]
+		if !slices.Contains(movieIDs, showtimes[i].MovieID) {
+			movieIDs = append(movieIDs, showtimes[i].MovieID)
+		}
+	}
+	movies, err := s.movieRepo.GetByIDs(movieIDs)
+	if err != nil {
+		return err
+	}
+	titles := make(map[uint]string, len(movies))
+	for _, movie := range movies {
+		titles[movie.ID] = movie.Title
+	}
+
+	for i := range items {
+		showtime, ok := showtimeByID[items[i].ShowtimeID]
+		if !ok {
+			continue
+		}
+		items[i].MovieID = showtime.MovieID
+		items[i].MovieTitle = titles[showtime.MovieID]
+		items[i].StartAt = showtime.StartAt
+	}
+	return nil
+}
+
+func newPendingReservationStatus(reservationID uint, value *cache.ReservationCacheValue, state ReservationState) *ReservationStatus {
+	return &ReservationStatus{
+		ReservationID: reservationID,
+		UserID:        value.UserID,
+		ShowtimeID:    value.ShowtimeID,
+		State:         state,
+		ExpiresAt:     time.Unix(value.ExpiresAt, 0),
+		Category:      model.TicketCategory(value.Category),
+		Amount:        value.Amount,
+		Currency:      value.Currency,
+		PromoCode:     value.PromoCode,
+		Discount:      value.Discount,
+	}
+}
@@ -1,68 +1,230 @@
 package domain
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"gorm.io/gorm"
 
 	"github.com/qs-lzh/flash-sale/internal/cache"
 	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
 )
 
 type OrderService interface {
-	CreateOrderFromReservation(reservationID uint) error
+	// CreateOrderFromReservation persists the order of a PAID reservation, an order that already exists is left as is.
+	// It returns cache.ErrReservationNotFound, cache.ErrInvalidReservationStatus or ErrIncompleteReservation
+	// if the reservation can never become an order, other errors are worth retrying.
+	CreateOrderFromReservation(reservationID uint) (*model.Order, error)
+	// CreateOrdersFromReservations persists the orders of many PAID reservations with multi-row inserts.
+	// It fails as a whole, the caller falls back to CreateOrderFromReservation to find out which one is broken.
+	CreateOrdersFromReservations(reservationIDs []uint) ([]model.Order, error)
+	// GetRefundableOrder returns a paid order of the user, it returns service.ErrNotFound for orders of other users
+	GetRefundableOrder(orderID uint, userID uint) (*model.Order, error)
+	// RefundOrder refunds the payment, marks the order REFUNDED and returns the ticket if redis still holds it
+	RefundOrder(orderID uint) (*model.Order, error)
 }
 
 type orderService struct {
 	DB    *gorm.DB
 	Cache *cache.RedisCache
 
-	Repo repository.OrderRepo
+	Repo            repository.OrderRepo
+	ShowtimeService ShowtimeService
+	Provider        PaymentProvider
 }
 
 var _ OrderService = (*orderService)(nil)
 
-func NewOrderService(db *gorm.DB, cache *cache.RedisCache, orderRepo repository.OrderRepo) *orderService {
+var (
+	ErrInvalidOrderStatus = errors.New("invalid order status")
+	// ErrIncompleteReservation means the reservation misses data an order can't be created without
+	ErrIncompleteReservation = errors.New("reservation is incomplete")
+)
+
+func NewOrderService(db *gorm.DB, cache *cache.RedisCache, orderRepo repository.OrderRepo,
+	showtimeService ShowtimeService, provider PaymentProvider) *orderService {
 	return &orderService{
-		DB:    db,
-		Cache: cache,
-		Repo:  orderRepo,
+		DB:              db,
+		Cache:           cache,
+		Repo:            orderRepo,
+		ShowtimeService: showtimeService,
+		Provider:        provider,
 	}
 }
 
-func (s *orderService) CreateOrderFromReservation(reservationID uint) error {
-	return s.DB.Transaction(func(tx *gorm.DB) error {
-		// 使用 HGetAll 读取 Hash 类型的 reservation 数据
-		reservationData, err := s.Cache.GetReservationInfo(reservationID)
-		if err != nil {
-			return err
-		}
+func (s *orderService) CreateOrderFromReservation(reservationID uint) (*model.Order, error) {
+	reservation, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOrderable(reservation); err != nil {
+		return nil, err
+	}
+
+	var order *model.Order
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		repo := s.Repo.WithTx(tx)
 
 		// 检查订单是否已存在
-		_, err = s.Repo.GetByID(reservationID)
+		existing, err := repo.GetByID(reservationID)
 		if err == nil {
+			order = existing
 			return nil // 订单已存在，返回成功
 		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		order = newOrder(reservationID, reservation, s.Provider.Name())
+		return repo.Create(order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
 
-		// 从 map 中提取数据（需要类型转换）
-		var showtimeID, userID uint
-		if val, ok := reservationData["showtime_id"]; ok {
-			var id uint64
-			fmt.Sscanf(val, "%d", &id)
-			showtimeID = uint(id)
+func (s *orderService) CreateOrdersFromReservations(reservationIDs []uint) ([]model.Order, error) {
+	reservations, err := s.Cache.GetReservations(reservationIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]model.Order, len(reservationIDs))
+	for i, reservation := range reservations {
+		if err := checkOrderable(reservation); err != nil {
+			return nil, fmt.Errorf("reservation %d: %w", reservationIDs[i], err)
 		}
-		if val, ok := reservationData["user_id"]; ok {
-			var id uint64
-			fmt.Sscanf(val, "%d", &id)
-			userID = uint(id)
+		orders[i] = *newOrder(reservationIDs[i], reservation, s.Provider.Name())
+	}
+
+	// orders written by an earlier delivery are skipped by the insert
+	if err := s.Repo.CreateBatch(orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// checkOrderable checks the reservation is paid and has the data its order needs
+func checkOrderable(reservation *cache.ReservationCacheValue) error {
+	if reservation.Status != cache.ReservationStatusPaid {
+		return fmt.Errorf("%w: %s", cache.ErrInvalidReservationStatus, reservation.Status)
+	}
+	if reservation.ShowtimeID == 0 || reservation.UserID == 0 {
+		return ErrIncompleteReservation
+	}
+	return nil
+}
+
+// newOrder builds the order of a paid reservation
+func newOrder(reservationID uint, reservation *cache.ReservationCacheValue, provider string) *model.Order {
+	order := &model.Order{
+		ID:              reservationID,
+		ShowtimeID:      reservation.ShowtimeID,
+		UserID:          reservation.UserID,
+		Status:          model.OrderStatusPaid,
+		Category:        model.TicketCategory(reservation.Category),
+		Amount:          reservation.Amount,
+		Currency:        reservation.Currency,
+		PromoCode:       reservation.PromoCode,
+		Discount:        reservation.Discount,
+		PaymentProvider: provider,
+		PaymentIntentID: reservation.PaymentIntentID,
+		ReservedAt:      time.Unix(reservation.ReservedAt, 0),
+	}
+	if order.Category == "" {
+		order.Category = model.TicketCategoryStandard
+	}
+	if order.Currency == "" {
+		order.Currency = model.DefaultCurrency
+	}
+	if reservation.PaidAt != 0 {
+		paidAt := time.Unix(reservation.PaidAt, 0)
+		order.PaidAt = &paidAt
+	}
+	return order
+}
+
+func (s *orderService) GetRefundableOrder(orderID uint, userID uint) (*model.Order, error) {
+	order, err := s.Repo.GetByID(orderID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, service.ErrNotFound
 		}
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, service.ErrNotFound
+	}
 
-		s.Repo.Create(&model.Order{
-			ID:         reservationID,
-			ShowtimeID: showtimeID,
-			UserID:     userID,
-		})
-		return nil
-	})
+	if order.Status != model.OrderStatusPaid {
+		return nil, ErrInvalidOrderStatus
+	}
+	return order, nil
+}
+
+// every step is safe to repeat, so a failed refund message can simply be delivered again.
+// Only the order is needed, the reservation in redis is gone once redis was flushed by a restart
+func (s *orderService) RefundOrder(orderID uint) (*model.Order, error) {
+	order, err := s.Repo.GetByID(orderID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, service.ErrNotFound
+		}
+		return nil, err
+	}
+
+	switch order.Status {
+	case model.OrderStatusPaid:
+		intentID, err := s.paymentIntentID(order)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Provider.Refund(intentID); err != nil {
+			return nil, err
+		}
+		if _, err := s.Repo.UpdateStatus(orderID, model.OrderStatusPaid, model.OrderStatusRefunded); err != nil {
+			return nil, err
+		}
+		order.Status = model.OrderStatusRefunded
+	case model.OrderStatusRefunded:
+		// refunded by an earlier delivery, redis may still need updating
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOrderStatus, order.Status)
+	}
+
+	// the ticket can only be sold again if the showtime hasn't started
+	showtime, err := s.ShowtimeService.GetShowtimeByID(order.ShowtimeID)
+	if err != nil {
+		return nil, err
+	}
+	restock := time.Now().Before(showtime.StartAt)
+
+	// without the reservation redis doesn't count the ticket as sold, there's nothing to return
+	if err := s.Cache.MarkTicketAsRefunded(orderID, restock); err != nil && !errors.Is(err, cache.ErrReservationNotFound) {
+		return nil, err
+	}
+	return order, nil
+}
+
+// paymentIntentID returns the payment of the order, orders written before the intent was stored on them
+// fall back to the reservation
+func (s *orderService) paymentIntentID(order *model.Order) (string, error) {
+	if order.PaymentIntentID != "" {
+		return order.PaymentIntentID, nil
+	}
+	reservation, err := s.Cache.GetReservation(order.ID)
+	if err != nil {
+		if errors.Is(err, cache.ErrReservationNotFound) {
+			return "", ErrPaymentIntentNotFound
+		}
+		return "", err
+	}
+	if reservation.PaymentIntentID == "" {
+		return "", ErrPaymentIntentNotFound
+	}
+	return reservation.PaymentIntentID, nil
 }
@@ -0,0 +1,176 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+func newTestOrderService(t *testing.T, provider PaymentProvider) (*orderService, *gorm.DB, *cache.RedisCache) {
+	t.Helper()
+
+	db := testutil.Postgres(t)
+	redisCache := testutil.Redis(t)
+	orderRepo := repository.NewOrderRepoGorm(db)
+	showtimeService := NewShowtimeService(db, redisCache, repository.NewShowtimeRepoGorm(db),
+		repository.NewMovieRepoGorm(db), orderRepo, repository.NewShowtimePriceRepoGorm(db), 4500)
+	return NewOrderService(db, redisCache, orderRepo, showtimeService, provider), db, redisCache
+}
+
+func createTestShowtime(t *testing.T, db *gorm.DB, startAt time.Time) *model.Showtime {
+	t.Helper()
+
+	showtime := &model.Showtime{ID: testutil.ID(), MovieID: testutil.ID(), StartAt: startAt, Capacity: 1}
+	if err := db.Create(showtime).Error; err != nil {
+		t.Fatalf("Failed to create showtime: %v", err)
+	}
+	return showtime
+}
+
+// createTestOrder writes a paid order that redis knows nothing about, like after a restart
+func createTestOrder(t *testing.T, db *gorm.DB, showtimeID uint, userID uint) *model.Order {
+	t.Helper()
+
+	order := &model.Order{
+		ID:              testutil.ID(),
+		ShowtimeID:      showtimeID,
+		UserID:          userID,
+		Status:          model.OrderStatusPaid,
+		Amount:          4500,
+		Currency:        model.DefaultCurrency,
+		PaymentProvider: "fake",
+		PaymentIntentID: "pi_test",
+		ReservedAt:      time.Now(),
+	}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	return order
+}
+
+func TestOrderService_GetRefundableOrder(t *testing.T) {
+	s, db, _ := newTestOrderService(t, newFakeProvider())
+	showtime := createTestShowtime(t, db, time.Now().Add(time.Hour))
+	userID := testutil.ID()
+	order := createTestOrder(t, db, showtime.ID, userID)
+
+	if _, err := s.GetRefundableOrder(order.ID, userID); err != nil {
+		t.Fatalf("Expected the order to be refundable, got %v", err)
+	}
+	if _, err := s.GetRefundableOrder(order.ID, userID+1); !errors.Is(err, service.ErrNotFound) {
+		t.Errorf("Expected the order of another user not to be found, got %v", err)
+	}
+	if _, err := s.GetRefundableOrder(testutil.ID(), userID); !errors.Is(err, service.ErrNotFound) {
+		t.Errorf("Expected a missing order not to be found, got %v", err)
+	}
+
+	if _, err := s.RefundOrder(order.ID); err != nil {
+		t.Fatalf("Failed to refund order: %v", err)
+	}
+	if _, err := s.GetRefundableOrder(order.ID, userID); !errors.Is(err, ErrInvalidOrderStatus) {
+		t.Errorf("Expected a refunded order not to be refundable, got %v", err)
+	}
+}
+
+func TestOrderService_RefundOrderWithoutReservation(t *testing.T) {
+	provider := newFakeProvider()
+	provider.refundErrs = []error{errProviderUnavailable}
+	s, db, _ := newTestOrderService(t, provider)
+	showtime := createTestShowtime(t, db, time.Now().Add(time.Hour))
+	order := createTestOrder(t, db, showtime.ID, testutil.ID())
+
+	if _, err := s.RefundOrder(order.ID); !errors.Is(err, errProviderUnavailable) {
+		t.Fatalf("Expected the provider error, got %v", err)
+	}
+	if got, _ := repository.NewOrderRepoGorm(db).GetByID(order.ID); got.Status != model.OrderStatusPaid {
+		t.Fatalf("Expected the order to stay PAID while the provider fails, got %s", got.Status)
+	}
+
+	// delivered again
+	refunded, err := s.RefundOrder(order.ID)
+	if err != nil {
+		t.Fatalf("Failed to refund order: %v", err)
+	}
+	if refunded.Status != model.OrderStatusRefunded {
+		t.Errorf("Expected the order to be REFUNDED, got %s", refunded.Status)
+	}
+	// e.g. the ack was lost
+	if _, err := s.RefundOrder(order.ID); err != nil {
+		t.Fatalf("Expected refunding again to succeed, got %v", err)
+	}
+	if n := provider.refunds(order.PaymentIntentID); n != 1 {
+		t.Errorf("Expected the payment to be refunded once, got %d", n)
+	}
+
+	got, err := repository.NewOrderRepoGorm(db).GetByID(order.ID)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if got.Status != model.OrderStatusRefunded || got.RefundedAt == nil {
+		t.Errorf("Expected the order to be stored REFUNDED, got %s at %v", got.Status, got.RefundedAt)
+	}
+}
+
+func TestOrderService_RefundOrderRestock(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		startAt time.Duration
+		remain  int
+	}{
+		{"upcoming showtime", time.Hour, 1},
+		{"started showtime", -time.Hour, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := newFakeProvider()
+			s, db, redisCache := newTestOrderService(t, provider)
+			showtime := createTestShowtime(t, db, time.Now().Add(tc.startAt))
+			if err := redisCache.SetRemainingTickets(showtime.ID, 1); err != nil {
+				t.Fatalf("Failed to set tickets: %v", err)
+			}
+
+			reservationID, err := redisCache.ReserveTicket(showtime.ID, testutil.ID(), "token", time.Now().Add(time.Minute),
+				string(model.TicketCategoryStandard), cache.ShowtimePriceCacheValue{Amount: 4500, Currency: model.DefaultCurrency}, nil)
+			if err != nil {
+				t.Fatalf("Failed to reserve: %v", err)
+			}
+			if err := redisCache.SetReservationPayment(reservationID, "pi_restock"); err != nil {
+				t.Fatalf("Failed to set payment: %v", err)
+			}
+			if _, _, err := redisCache.MarkTicketAsPaid(reservationID, time.Now()); err != nil {
+				t.Fatalf("Failed to mark paid: %v", err)
+			}
+			if _, err := s.CreateOrderFromReservation(reservationID); err != nil {
+				t.Fatalf("Failed to create order: %v", err)
+			}
+
+			if _, err := s.RefundOrder(reservationID); err != nil {
+				t.Fatalf("Failed to refund order: %v", err)
+			}
+			if n := provider.refunds("pi_restock"); n != 1 {
+				t.Errorf("Expected the payment to be refunded once, got %d", n)
+			}
+			reservation, err := redisCache.GetReservation(reservationID)
+			if err != nil {
+				t.Fatalf("Failed to get reservation: %v", err)
+			}
+			if reservation.Status != cache.ReservationStatusRefunded {
+				t.Errorf("Expected the reservation to be REFUNDED, got %s", reservation.Status)
+			}
+			remain, err := redisCache.GetRemainingTickets(showtime.ID)
+			if err != nil {
+				t.Fatalf("Failed to get tickets: %v", err)
+			}
+			if remain != tc.remain {
+				t.Errorf("Expected %d tickets left, got %d", tc.remain, remain)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package domain
+
+import (
+	"errors"
+	"log"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/util"
+)
+
+type PaymentIntentStatus string
+
+const (
+	PaymentIntentStatusPending   PaymentIntentStatus = "PENDING"
+	PaymentIntentStatusSucceeded PaymentIntentStatus = "SUCCEEDED"
+	PaymentIntentStatusFailed    PaymentIntentStatus = "FAILED"
+	PaymentIntentStatusRefunded  PaymentIntentStatus = "REFUNDED"
+)
+
+// PaymentIntent is a payment of a reservation created at the provider
+type PaymentIntent struct {
+	ID            string              `json:"id"`
+	ReservationID uint                `json:"reservation_id"`
+	Amount        int                 `json:"amount"`
+	Status        PaymentIntentStatus `json:"status"`
+}
+
+// PaymentEvent is the result of a payment intent, reported by the provider through the webhook
+type PaymentEvent struct {
+	EventID       string              `json:"event_id"`
+	Provider      string              `json:"provider"`
+	IntentID      string              `json:"intent_id"`
+	ReservationID uint                `json:"reservation_id"`
+	Status        PaymentIntentStatus `json:"status"`
+}
+
+// PaymentProvider charges the customer. Creating an intent only starts the payment,
+// the result is reported asynchronously as a PaymentEvent.
+type PaymentProvider interface {
+	Name() string
+	CreateIntent(reservationID uint, amount int) (*PaymentIntent, error)
+	QueryStatus(intentID string) (PaymentIntentStatus, error)
+	Refund(intentID string) error
+}
+
+var ErrPaymentIntentNotFound = errors.New("payment intent not found")
+
+// names of the payment providers, selected by config.Config.PaymentProvider
+const (
+	PaymentProviderMock  = "mock"
+	PaymentProviderLocal = "local"
+)
+
+// how often the mock provider retries delivering an event the handler failed on
+const mockEventRetries = 3
+
+// MockPaymentOptions controls how the mock provider behaves
+type MockPaymentOptions struct {
+	// share of payments that are declined, between 0 and 1
+	DeclineRate float64
+	// each payment finishes after a random latency in [MinLatency, MaxLatency]
+	MinLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// mockPaymentProvider runs in the process, a payment succeeds or is declined after a random latency,
+// and the event is handed to onEvent instead of being sent over http
+type mockPaymentProvider struct {
+	onEvent func(PaymentEvent) error
+	options MockPaymentOptions
+
+	mu      sync.Mutex
+	intents map[string]*PaymentIntent
+
+	// payments in progress
+	wg sync.WaitGroup
+}
+
+var _ PaymentProvider = (*mockPaymentProvider)(nil)
+
+func NewMockPaymentProvider(onEvent func(PaymentEvent) error, options MockPaymentOptions) *mockPaymentProvider {
+	if options.MaxLatency < options.MinLatency {
+		options.MaxLatency = options.MinLatency
+	}
+	return &mockPaymentProvider{
+		onEvent: onEvent,
+		options: options,
+		intents: make(map[string]*PaymentIntent),
+	}
+}
+
+func (p *mockPaymentProvider) Name() string {
+	return PaymentProviderMock
+}
+
+func (p *mockPaymentProvider) CreateIntent(reservationID uint, amount int) (*PaymentIntent, error) {
+	intent := &PaymentIntent{
+		ID:            "mock_" + util.RandomHex(12),
+		ReservationID: reservationID,
+		Amount:        amount,
+		Status:        PaymentIntentStatusPending,
+	}
+
+	p.mu.Lock()
+	p.intents[intent.ID] = intent
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		time.Sleep(p.latency())
+
+		status := PaymentIntentStatusSucceeded
+		if mathrand.Float64() < p.options.DeclineRate {
+			status = PaymentIntentStatusFailed
+		}
+		p.setStatus(intent.ID, status)
+		p.notify(PaymentEvent{
+			EventID:       "evt_" + util.RandomHex(12),
+			Provider:      p.Name(),
+			IntentID:      intent.ID,
+			ReservationID: reservationID,
+			Status:        status,
+		})
+	}()
+
+	created := *intent
+	return &created, nil
+}
+
+func (p *mockPaymentProvider) QueryStatus(intentID string) (PaymentIntentStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return "", ErrPaymentIntentNotFound
+	}
+	return intent.Status, nil
+}
+
+func (p *mockPaymentProvider) Refund(intentID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return ErrPaymentIntentNotFound
+	}
+	intent.Status = PaymentIntentStatusRefunded
+	return nil
+}
+
+// Wait blocks until every payment in progress has reported its result
+func (p *mockPaymentProvider) Wait() {
+	p.wg.Wait()
+}
+
+func (p *mockPaymentProvider) latency() time.Duration {
+	spread := p.options.MaxLatency - p.options.MinLatency
+	if spread <= 0 {
+		return p.options.MinLatency
+	}
+	return p.options.MinLatency + time.Duration(mathrand.Int63n(int64(spread)+1))
+}
+
+func (p *mockPaymentProvider) setStatus(intentID string, status PaymentIntentStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if intent, ok := p.intents[intentID]; ok {
+		intent.Status = status
+	}
+}
+
+func (p *mockPaymentProvider) notify(event PaymentEvent) {
+	for attempt := 1; attempt <= mockEventRetries; attempt++ {
+		err := p.onEvent(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to deliver payment event %s (attempt %d): %v", event.EventID, attempt, err)
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
@@ -1,42 +1,231 @@
 package domain
 
 import (
-	"math/rand"
+	"errors"
+	"fmt"
+	"log"
 	"time"
 
 	"github.com/qs-lzh/flash-sale/internal/cache"
 )
 
 type PaymentService interface {
-	StartMockPay(reservationID uint) error
-	MarkTimeout(reservationID uint) error
+	// StartPayment creates a payment intent at the provider for a RESERVED reservation,
+	// amount must be the price locked in the reservation. Only one caller creates the intent,
+	// the others get ErrPaymentInProgress while it's created and the intent afterwards
+	StartPayment(reservationID uint, amount int) (*PaymentIntent, error)
+	// ConfirmPayment verifies a successful payment event with the provider and marks the reservation PAID.
+	// A payment arriving after the hold expired or the reservation was cancelled is honored
+	// if there's a ticket left and refunded otherwise
+	ConfirmPayment(event PaymentEvent) (*PaymentConfirmation, error)
+	// FailPayment verifies a declined payment event with the provider and releases the reservation,
+	// released is false if an earlier delivery of the event released it
+	FailPayment(event PaymentEvent) (userID uint, released bool, err error)
+	// MarkTimeout releases the reservation if it's still unpaid, timedOut is false otherwise
+	MarkTimeout(reservationID uint) (userID uint, timedOut bool, err error)
 }
 
 type paymentService struct {
-	Cache *cache.RedisCache
+	Cache    *cache.RedisCache
+	Provider PaymentProvider
 }
 
-func NewPaymentService(cache *cache.RedisCache) *paymentService {
+func NewPaymentService(cache *cache.RedisCache, provider PaymentProvider) *paymentService {
 	return &paymentService{
-		Cache: cache,
+		Cache:    cache,
+		Provider: provider,
 	}
 }
 
 var _ PaymentService = (*paymentService)(nil)
 
-func (s *paymentService) StartMockPay(reservationID uint) error {
-	time.Sleep(time.Duration(rand.Intn(901)+100) * time.Millisecond)
+type PaymentOutcome string
 
-	if err := s.markPaid(reservationID); err != nil {
-		return err
+const (
+	PaymentOutcomePaid         PaymentOutcome = "PAID"
+	PaymentOutcomeLateHonored  PaymentOutcome = "LATE_HONORED"
+	PaymentOutcomeLateRefunded PaymentOutcome = "LATE_REFUNDED"
+)
+
+// PaymentConfirmation is what a successful payment did to its reservation
+type PaymentConfirmation struct {
+	ReservationID uint
+	UserID        uint
+	Outcome       PaymentOutcome
+	// the event was handled before
+	Duplicate bool
+}
+
+var (
+	ErrPaymentNotVerified     = errors.New("payment event doesn't match the provider")
+	ErrPaymentIntentMismatch  = errors.New("payment intent doesn't belong to the reservation")
+	ErrPaymentEventNotSuccess = errors.New("payment event is not a successful payment")
+	ErrPaymentEventNotFailure = errors.New("payment event is not a failed payment")
+	ErrPaymentAmountMismatch  = errors.New("payment amount doesn't match the reservation price")
+	ErrPaymentInProgress      = errors.New("the payment intent is being created")
+)
+
+func (s *paymentService) StartPayment(reservationID uint, amount int) (*PaymentIntent, error) {
+	reservation, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the payment was started by an earlier delivery of the same message
+	if intentID := reservation.PaymentIntentID; intentID != "" {
+		status, err := s.Provider.QueryStatus(intentID)
+		if err != nil {
+			return nil, err
+		}
+		return &PaymentIntent{
+			ID:            intentID,
+			ReservationID: reservationID,
+			Amount:        amount,
+			Status:        status,
+		}, nil
+	}
+
+	if reservation.Status != cache.ReservationStatusReserved {
+		return nil, fmt.Errorf("%w: %s", cache.ErrInvalidReservationStatus, reservation.Status)
+	}
+	// the customer pays the price locked at reserve time
+	if amount != reservation.Amount {
+		return nil, fmt.Errorf("%w: %d, locked %d", ErrPaymentAmountMismatch, amount, reservation.Amount)
+	}
+
+	// a second intent would replace the first, whose payment couldn't be verified anymore.
+	// A claim left by a crash keeps the payment from starting, the hold times out then
+	claimed, err := s.Cache.ClaimPayment(reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrPaymentInProgress
+	}
+	intent, err := s.Provider.CreateIntent(reservationID, amount)
+	if err != nil {
+		if releaseErr := s.Cache.ReleasePaymentClaim(reservationID); releaseErr != nil {
+			log.Printf("Failed to release the payment claim of reservation %d: %v", reservationID, releaseErr)
+		}
+		return nil, err
+	}
+	if err := s.Cache.SetReservationPayment(reservationID, intent.ID); err != nil {
+		return nil, err
+	}
+	return intent, nil
+}
+
+func (s *paymentService) ConfirmPayment(event PaymentEvent) (*PaymentConfirmation, error) {
+	if event.Status != PaymentIntentStatusSucceeded {
+		return nil, ErrPaymentEventNotSuccess
+	}
+
+	reservation, err := s.Cache.GetReservation(event.ReservationID)
+	if err != nil {
+		return nil, err
+	}
+	confirmation := &PaymentConfirmation{
+		ReservationID: event.ReservationID,
+		UserID:        reservation.UserID,
+	}
+
+	// a late payment refunded by an earlier delivery, the provider reports it REFUNDED now
+	if reservation.Status == cache.ReservationStatusRefunded && reservation.LatePayment &&
+		reservation.PaymentIntentID == event.IntentID {
+		confirmation.Outcome = PaymentOutcomeLateRefunded
+		confirmation.Duplicate = true
+		return confirmation, nil
+	}
+
+	// an earlier delivery refunded the late payment but failed before recording it
+	if (reservation.Status == cache.ReservationStatusTimeout || reservation.Status == cache.ReservationStatusCancelled) &&
+		reservation.PaymentIntentID == event.IntentID {
+		status, err := s.Provider.QueryStatus(event.IntentID)
+		if err != nil {
+			return nil, err
+		}
+		if status == PaymentIntentStatusRefunded {
+			if err := s.Cache.MarkLatePaymentAsRefunded(event.ReservationID); err != nil {
+				return nil, err
+			}
+			confirmation.Outcome = PaymentOutcomeLateRefunded
+			return confirmation, nil
+		}
+	}
+
+	if _, err := s.verifyEvent(event); err != nil {
+		return nil, err
+	}
+
+	late, duplicate, err := s.Cache.MarkTicketAsPaid(event.ReservationID, time.Now())
+	if errors.Is(err, cache.ErrSoldOut) {
+		// the ticket was sold again after it was released, give the money back
+		if err := s.Provider.Refund(event.IntentID); err != nil {
+			return nil, err
+		}
+		if err := s.Cache.MarkLatePaymentAsRefunded(event.ReservationID); err != nil {
+			return nil, err
+		}
+		confirmation.Outcome = PaymentOutcomeLateRefunded
+		return confirmation, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation.Outcome = PaymentOutcomePaid
+	if late {
+		confirmation.Outcome = PaymentOutcomeLateHonored
 	}
-	return nil
+	confirmation.Duplicate = duplicate
+	return confirmation, nil
 }
 
-func (s *paymentService) markPaid(reservationID uint) error {
-	return s.Cache.MarkTicketAsPaid(reservationID)
+func (s *paymentService) FailPayment(event PaymentEvent) (uint, bool, error) {
+	if event.Status != PaymentIntentStatusFailed {
+		return 0, false, ErrPaymentEventNotFailure
+	}
+
+	reservation, err := s.verifyEvent(event)
+	if err != nil {
+		return 0, false, err
+	}
+	released, err := s.Cache.MarkTicketAsFailed(event.ReservationID)
+	if err != nil {
+		return 0, false, err
+	}
+	return reservation.UserID, released, nil
 }
 
-func (s *paymentService) MarkTimeout(reservationID uint) error {
-	return s.Cache.MarkTicketAsTimeout(reservationID)
+// verifyEvent checks the event belongs to the reservation's payment and has the status the provider reports
+func (s *paymentService) verifyEvent(event PaymentEvent) (*cache.ReservationCacheValue, error) {
+	reservation, err := s.Cache.GetReservation(event.ReservationID)
+	if err != nil {
+		return nil, err
+	}
+	if reservation.PaymentIntentID != event.IntentID {
+		return nil, ErrPaymentIntentMismatch
+	}
+
+	// don't trust the event itself, ask the provider
+	status, err := s.Provider.QueryStatus(event.IntentID)
+	if err != nil {
+		return nil, err
+	}
+	if status != event.Status {
+		return nil, ErrPaymentNotVerified
+	}
+	return reservation, nil
+}
+
+func (s *paymentService) MarkTimeout(reservationID uint) (uint, bool, error) {
+	reservation, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		return 0, false, err
+	}
+	timedOut, err := s.Cache.MarkTicketAsTimeout(reservationID)
+	if err != nil {
+		return 0, false, err
+	}
+	return reservation.UserID, timedOut, nil
 }
@@ -0,0 +1,396 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+const testReservationToken = "token"
+
+// reserveTestTicket reserves one of tickets of a new showtime, it returns the reservation and the showtime
+func reserveTestTicket(t *testing.T, c *cache.RedisCache, tickets int) (uint, uint) {
+	t.Helper()
+
+	showtimeID := testutil.ID()
+	if err := c.SetRemainingTickets(showtimeID, tickets); err != nil {
+		t.Fatalf("Failed to set tickets: %v", err)
+	}
+	reservationID, err := c.ReserveTicket(showtimeID, testutil.ID(), testReservationToken, time.Now().Add(time.Minute),
+		string(model.TicketCategoryStandard), cache.ShowtimePriceCacheValue{Amount: 4500, Currency: model.DefaultCurrency}, nil)
+	if err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	return reservationID, showtimeID
+}
+
+func remainingTickets(t *testing.T, c *cache.RedisCache, showtimeID uint) int {
+	t.Helper()
+
+	remain, err := c.GetRemainingTickets(showtimeID)
+	if err != nil {
+		t.Fatalf("Failed to get tickets: %v", err)
+	}
+	return remain
+}
+
+func TestReservationService_CancelRefusedOncePaymentRequested(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	reservations := NewReservationService(redisCache, nil, nil, nil, time.Minute)
+	payments := NewPaymentService(redisCache, newFakeProvider())
+	reservationID, showtimeID := reserveTestTicket(t, redisCache, 1)
+
+	if _, _, err := reservations.RequestPayment(reservationID, testReservationToken); err != nil {
+		t.Fatalf("Failed to request payment: %v", err)
+	}
+	// the payment message is still queued, no intent exists yet
+	if _, err := reservations.Cancel(reservationID, testReservationToken); !errors.Is(err, cache.ErrInvalidReservationStatus) {
+		t.Fatalf("Expected the cancel to be refused, got %v", err)
+	}
+	if _, err := payments.StartPayment(reservationID, 4500); err != nil {
+		t.Fatalf("Expected the payment to start, got %v", err)
+	}
+	if remain := remainingTickets(t, redisCache, showtimeID); remain != 0 {
+		t.Errorf("Expected the ticket to stay held, %d left", remain)
+	}
+}
+
+func TestReservationService_PaymentRefusedOnceCancelled(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	reservations := NewReservationService(redisCache, nil, nil, nil, time.Minute)
+	reservationID, _ := reserveTestTicket(t, redisCache, 1)
+
+	if _, err := reservations.Cancel(reservationID, testReservationToken); err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+	if _, _, err := reservations.RequestPayment(reservationID, testReservationToken); !errors.Is(err, cache.ErrInvalidReservationStatus) {
+		t.Errorf("Expected the payment to be refused, got %v", err)
+	}
+}
+
+func TestReservationService_RequestPaymentOnce(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	reservations := NewReservationService(redisCache, nil, nil, nil, time.Minute)
+	reservationID, _ := reserveTestTicket(t, redisCache, 1)
+
+	for i, want := range []bool{true, false} {
+		_, requested, err := reservations.RequestPayment(reservationID, testReservationToken)
+		if err != nil {
+			t.Fatalf("Failed to request payment: %v", err)
+		}
+		if requested != want {
+			t.Errorf("Expected request %d to report requested %v", i+1, want)
+		}
+	}
+
+	// e.g. the payment message couldn't be published
+	if err := reservations.WithdrawPaymentRequest(reservationID); err != nil {
+		t.Fatalf("Failed to withdraw: %v", err)
+	}
+	if _, requested, err := reservations.RequestPayment(reservationID, testReservationToken); err != nil || !requested {
+		t.Errorf("Expected the payment to be requested again, got %v, %v", requested, err)
+	}
+}
+
+func TestReservationService_PayCancelRace(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	reservations := NewReservationService(redisCache, nil, nil, nil, time.Minute)
+
+	for range 50 {
+		reservationID, showtimeID := reserveTestTicket(t, redisCache, 1)
+
+		var payErr, cancelErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _, payErr = reservations.RequestPayment(reservationID, testReservationToken)
+		}()
+		go func() {
+			defer wg.Done()
+			_, cancelErr = reservations.Cancel(reservationID, testReservationToken)
+		}()
+		wg.Wait()
+
+		// exactly one of them wins, the loser is told the reservation moved on
+		if (payErr == nil) == (cancelErr == nil) {
+			t.Fatalf("Expected exactly one of pay and cancel to succeed, got %v and %v", payErr, cancelErr)
+		}
+		loser := payErr
+		if loser == nil {
+			loser = cancelErr
+		}
+		if !errors.Is(loser, cache.ErrInvalidReservationStatus) {
+			t.Fatalf("Expected the loser to get ErrInvalidReservationStatus, got %v", loser)
+		}
+
+		wantRemain := 0
+		if cancelErr == nil {
+			wantRemain = 1
+		}
+		if remain := remainingTickets(t, redisCache, showtimeID); remain != wantRemain {
+			t.Fatalf("Expected %d tickets left, got %d", wantRemain, remain)
+		}
+	}
+}
+
+func TestPaymentService_ConcurrentStartPayment(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	provider := newFakeProvider()
+	provider.createDelay = 50 * time.Millisecond
+	payments := NewPaymentService(redisCache, provider)
+	reservationID, _ := reserveTestTicket(t, redisCache, 1)
+
+	const n = 2
+	intents := make([]*PaymentIntent, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			intents[i], errs[i] = payments.StartPayment(reservationID, 4500)
+		}()
+	}
+	wg.Wait()
+
+	if created := provider.intents(); created != 1 {
+		t.Fatalf("Expected one intent, got %d", created)
+	}
+	started := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			started++
+			if intents[i].ID != fmt.Sprintf("pi_fake_%d", reservationID) {
+				t.Errorf("Unexpected intent %+v", intents[i])
+			}
+		case !errors.Is(err, ErrPaymentInProgress):
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if started == 0 {
+		t.Errorf("Expected a payment to start, got %v", errs)
+	}
+
+	// a redelivery gets the intent that was created
+	intent, err := payments.StartPayment(reservationID, 4500)
+	if err != nil || intent.ID != fmt.Sprintf("pi_fake_%d", reservationID) {
+		t.Errorf("Expected the created intent, got %+v, %v", intent, err)
+	}
+	if created := provider.intents(); created != 1 {
+		t.Errorf("Expected no second intent, got %d", created)
+	}
+}
+
+func TestPaymentService_StartPaymentRetriesAfterProviderFailure(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	provider := newFakeProvider()
+	provider.createErrs = []error{errProviderUnavailable}
+	payments := NewPaymentService(redisCache, provider)
+	reservationID, _ := reserveTestTicket(t, redisCache, 1)
+
+	if _, err := payments.StartPayment(reservationID, 4500); !errors.Is(err, errProviderUnavailable) {
+		t.Fatalf("Expected the provider error, got %v", err)
+	}
+	// the claim was released, the redelivery creates the intent
+	if _, err := payments.StartPayment(reservationID, 4500); err != nil {
+		t.Fatalf("Expected the payment to start, got %v", err)
+	}
+	if created := provider.intents(); created != 1 {
+		t.Errorf("Expected one intent, got %d", created)
+	}
+}
+
+// cancelWithIntent cancels the reservation and then attaches a payment to it,
+// like a payment the customer finished at the provider although the reservation was cancelled
+func cancelWithIntent(t *testing.T, c *cache.RedisCache, reservationID uint, intentID string) {
+	t.Helper()
+
+	if err := c.CancelReservation(reservationID); err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+	if err := c.SetReservationPayment(reservationID, intentID); err != nil {
+		t.Fatalf("Failed to set payment: %v", err)
+	}
+}
+
+func TestPaymentService_ConfirmPaymentOfCancelledReservation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		tickets int
+		outcome PaymentOutcome
+		remain  int
+	}{
+		// the cancel returned the ticket, it's taken again
+		{"honored", 1, PaymentOutcomeLateHonored, 0},
+		// someone else reserved the returned ticket
+		{"refunded", 0, PaymentOutcomeLateRefunded, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			redisCache := testutil.Redis(t)
+			provider := newFakeProvider()
+			payments := NewPaymentService(redisCache, provider)
+			reservationID, showtimeID := reserveTestTicket(t, redisCache, 1)
+			const intentID = "pi_cancelled"
+			cancelWithIntent(t, redisCache, reservationID, intentID)
+			if err := redisCache.SetRemainingTickets(showtimeID, tc.tickets); err != nil {
+				t.Fatalf("Failed to set tickets: %v", err)
+			}
+			provider.setStatus(intentID, PaymentIntentStatusSucceeded)
+
+			confirmation, err := payments.ConfirmPayment(PaymentEvent{
+				IntentID:      intentID,
+				ReservationID: reservationID,
+				Status:        PaymentIntentStatusSucceeded,
+			})
+			if err != nil {
+				t.Fatalf("Failed to confirm payment: %v", err)
+			}
+			if confirmation.Outcome != tc.outcome {
+				t.Errorf("Expected %s, got %s", tc.outcome, confirmation.Outcome)
+			}
+			if remain := remainingTickets(t, redisCache, showtimeID); remain != tc.remain {
+				t.Errorf("Expected %d tickets left, got %d", tc.remain, remain)
+			}
+			wantRefunds := 0
+			if tc.outcome == PaymentOutcomeLateRefunded {
+				wantRefunds = 1
+			}
+			if n := provider.refunds(intentID); n != wantRefunds {
+				t.Errorf("Expected %d refunds, got %d", wantRefunds, n)
+			}
+		})
+	}
+}
+
+// timeOutWithIntent lets the hold of a reservation whose payment was started expire
+func timeOutWithIntent(t *testing.T, c *cache.RedisCache, reservationID uint, intentID string) {
+	t.Helper()
+
+	if err := c.SetReservationPayment(reservationID, intentID); err != nil {
+		t.Fatalf("Failed to set payment: %v", err)
+	}
+	if _, err := c.MarkTicketAsTimeout(reservationID); err != nil {
+		t.Fatalf("Failed to time out: %v", err)
+	}
+}
+
+func TestPaymentService_ConfirmLatePayment(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// tickets left when the payment arrives, the timeout returned the reservation's one
+		tickets int
+		// an earlier delivery refunded the payment but failed before recording it
+		refundedBefore bool
+		outcome        PaymentOutcome
+		status         cache.ReservationStatus
+		remain         int
+		refunds        int
+	}{
+		{"honored", 1, false, PaymentOutcomeLateHonored, cache.ReservationStatusPaid, 0, 0},
+		{"refunded because sold out", 0, false, PaymentOutcomeLateRefunded, cache.ReservationStatusRefunded, 0, 1},
+		{"refund of an earlier delivery recovered", 1, true, PaymentOutcomeLateRefunded, cache.ReservationStatusRefunded, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			redisCache := testutil.Redis(t)
+			provider := newFakeProvider()
+			payments := NewPaymentService(redisCache, provider)
+			reservationID, showtimeID := reserveTestTicket(t, redisCache, 1)
+			const intentID = "pi_late"
+			timeOutWithIntent(t, redisCache, reservationID, intentID)
+			if err := redisCache.SetRemainingTickets(showtimeID, tc.tickets); err != nil {
+				t.Fatalf("Failed to set tickets: %v", err)
+			}
+			provider.setStatus(intentID, PaymentIntentStatusSucceeded)
+			if tc.refundedBefore {
+				provider.setStatus(intentID, PaymentIntentStatusRefunded)
+			}
+			event := PaymentEvent{IntentID: intentID, ReservationID: reservationID, Status: PaymentIntentStatusSucceeded}
+
+			confirmation, err := payments.ConfirmPayment(event)
+			if err != nil {
+				t.Fatalf("Failed to confirm payment: %v", err)
+			}
+			if confirmation.Outcome != tc.outcome || confirmation.Duplicate {
+				t.Errorf("Expected %s, got %s (duplicate %v)", tc.outcome, confirmation.Outcome, confirmation.Duplicate)
+			}
+
+			// the provider delivers the event again
+			confirmation, err = payments.ConfirmPayment(event)
+			if err != nil {
+				t.Fatalf("Failed to confirm redelivered payment: %v", err)
+			}
+			if confirmation.Outcome != tc.outcome || !confirmation.Duplicate {
+				t.Errorf("Expected a duplicate %s, got %s (duplicate %v)", tc.outcome, confirmation.Outcome, confirmation.Duplicate)
+			}
+
+			reservation, err := redisCache.GetReservation(reservationID)
+			if err != nil {
+				t.Fatalf("Failed to get reservation: %v", err)
+			}
+			if reservation.Status != tc.status || !reservation.LatePayment {
+				t.Errorf("Expected a late %s reservation, got %s (late %v)", tc.status, reservation.Status, reservation.LatePayment)
+			}
+			if remain := remainingTickets(t, redisCache, showtimeID); remain != tc.remain {
+				t.Errorf("Expected %d tickets left, got %d", tc.remain, remain)
+			}
+			if n := provider.refunds(intentID); n != tc.refunds {
+				t.Errorf("Expected %d refunds, got %d", tc.refunds, n)
+			}
+		})
+	}
+}
+
+func TestPaymentService_ConfirmPaymentDuplicate(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	provider := newFakeProvider()
+	payments := NewPaymentService(redisCache, provider)
+	reservationID, showtimeID := reserveTestTicket(t, redisCache, 1)
+	intent, err := payments.StartPayment(reservationID, 4500)
+	if err != nil {
+		t.Fatalf("Failed to start payment: %v", err)
+	}
+	provider.setStatus(intent.ID, PaymentIntentStatusSucceeded)
+	event := PaymentEvent{IntentID: intent.ID, ReservationID: reservationID, Status: PaymentIntentStatusSucceeded}
+
+	for i, duplicate := range []bool{false, true} {
+		confirmation, err := payments.ConfirmPayment(event)
+		if err != nil {
+			t.Fatalf("Failed to confirm delivery %d: %v", i+1, err)
+		}
+		if confirmation.Outcome != PaymentOutcomePaid || confirmation.Duplicate != duplicate {
+			t.Errorf("Expected delivery %d to be PAID with duplicate %v, got %s with %v",
+				i+1, duplicate, confirmation.Outcome, confirmation.Duplicate)
+		}
+	}
+	if remain := remainingTickets(t, redisCache, showtimeID); remain != 0 {
+		t.Errorf("Expected the ticket to stay sold, %d left", remain)
+	}
+}
+
+func TestPaymentService_ConfirmPaymentUnverified(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	payments := NewPaymentService(redisCache, newFakeProvider())
+	reservationID, _ := reserveTestTicket(t, redisCache, 1)
+	intent, err := payments.StartPayment(reservationID, 4500)
+	if err != nil {
+		t.Fatalf("Failed to start payment: %v", err)
+	}
+
+	// the provider still reports the intent pending
+	_, err = payments.ConfirmPayment(PaymentEvent{IntentID: intent.ID, ReservationID: reservationID, Status: PaymentIntentStatusSucceeded})
+	if !errors.Is(err, ErrPaymentNotVerified) {
+		t.Errorf("Expected the event not to be verified, got %v", err)
+	}
+	_, err = payments.ConfirmPayment(PaymentEvent{IntentID: "pi_other", ReservationID: reservationID, Status: PaymentIntentStatusSucceeded})
+	if !errors.Is(err, ErrPaymentIntentMismatch) {
+		t.Errorf("Expected the intent of another payment to be rejected, got %v", err)
+	}
+}
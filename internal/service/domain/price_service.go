@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+)
+
+type PriceService interface {
+	// GetPrice returns the price of a ticket category of a showtime, from redis if it's cached.
+	// It returns ErrPriceNotFound if the showtime doesn't sell the category
+	GetPrice(showtimeID uint, category model.TicketCategory) (*model.ShowtimePrice, error)
+	// SetPrice creates or changes a price, reservations made before keep the price they were made with
+	SetPrice(showtimeID uint, category model.TicketCategory, amount int, currency string) error
+	// LoadPrices gives the showtimes without a standard price the default one and caches every price in redis
+	LoadPrices() error
+}
+
+const (
+	// how long a price stays cached, prices are refreshed when they are set so it's only a safety net
+	priceCacheTTL = time.Hour
+	// how long a missing price stays cached, setting the price replaces it right away
+	priceNotFoundTTL = time.Minute
+)
+
+var (
+	ErrPriceNotFound         = errors.New("no price for the ticket category")
+	ErrInvalidTicketCategory = errors.New("invalid ticket category")
+	ErrInvalidPriceAmount    = errors.New("price amount must not be negative")
+)
+
+type priceService struct {
+	db    *gorm.DB
+	cache *cache.RedisCache
+	repo  repository.ShowtimePriceRepo
+	// standard price of showtimes nobody priced
+	defaultPrice int
+}
+
+var _ PriceService = (*priceService)(nil)
+
+func NewPriceService(db *gorm.DB, cache *cache.RedisCache, priceRepo repository.ShowtimePriceRepo, defaultPrice int) *priceService {
+	return &priceService{
+		db:           db,
+		cache:        cache,
+		repo:         priceRepo,
+		defaultPrice: defaultPrice,
+	}
+}
+
+func (s *priceService) GetPrice(showtimeID uint, category model.TicketCategory) (*model.ShowtimePrice, error) {
+	if !category.Valid() {
+		return nil, ErrInvalidTicketCategory
+	}
+
+	cached, err := s.cache.GetShowtimePrice(showtimeID, string(category))
+	if err == nil {
+		if cached.NotFound {
+			return nil, ErrPriceNotFound
+		}
+		return &model.ShowtimePrice{
+			ShowtimeID: showtimeID,
+			Category:   category,
+			Amount:     cached.Amount,
+			Currency:   cached.Currency,
+		}, nil
+	}
+	if !errors.Is(err, cache.ErrCacheMiss) {
+		return nil, err
+	}
+
+	price, err := s.repo.Get(showtimeID, category)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := s.cache.SetShowtimePrice(showtimeID, string(category),
+				cache.ShowtimePriceCacheValue{NotFound: true}, priceNotFoundTTL); err != nil {
+				return nil, err
+			}
+			return nil, ErrPriceNotFound
+		}
+		return nil, err
+	}
+	if err := s.cachePrice(price); err != nil {
+		return nil, err
+	}
+	return price, nil
+}
+
+func (s *priceService) SetPrice(showtimeID uint, category model.TicketCategory, amount int, currency string) error {
+	if !category.Valid() {
+		return ErrInvalidTicketCategory
+	}
+	if amount < 0 {
+		return ErrInvalidPriceAmount
+	}
+	if currency == "" {
+		currency = model.DefaultCurrency
+	}
+
+	price := &model.ShowtimePrice{
+		ShowtimeID: showtimeID,
+		Category:   category,
+		Amount:     amount,
+		Currency:   currency,
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		return s.repo.WithTx(tx).Upsert(price)
+	}); err != nil {
+		return err
+	}
+	return s.cachePrice(price)
+}
+
+func (s *priceService) LoadPrices() error {
+	// showtimes created before they were priced on creation
+	if _, err := s.repo.CreateMissing(model.TicketCategoryStandard, s.defaultPrice, model.DefaultCurrency); err != nil {
+		return err
+	}
+
+	prices, err := s.repo.ListAll()
+	if err != nil {
+		return err
+	}
+	for i := range prices {
+		if err := s.cachePrice(&prices[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *priceService) cachePrice(price *model.ShowtimePrice) error {
+	return cachePrice(s.cache, price)
+}
+
+// cachePrice caches a price that was written, replacing a cached missing price
+func cachePrice(c *cache.RedisCache, price *model.ShowtimePrice) error {
+	return c.SetShowtimePrice(price.ShowtimeID, string(price.Category), cache.ShowtimePriceCacheValue{
+		Amount:   price.Amount,
+		Currency: price.Currency,
+	}, priceCacheTTL)
+}
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+const testDefaultPrice = 3900
+
+func TestShowtimeService_CreateShowtimeWithDefaultPrice(t *testing.T) {
+	db := testutil.Postgres(t)
+	redisCache := testutil.Redis(t)
+	priceRepo := repository.NewShowtimePriceRepoGorm(db)
+	showtimeService := NewShowtimeService(db, redisCache, repository.NewShowtimeRepoGorm(db), repository.NewMovieRepoGorm(db),
+		repository.NewOrderRepoGorm(db), priceRepo, testDefaultPrice)
+	priceService := NewPriceService(db, redisCache, priceRepo, testDefaultPrice)
+
+	movie := &model.Movie{Title: fmt.Sprintf("Price test %d", testutil.ID())}
+	if err := db.Create(movie).Error; err != nil {
+		t.Fatalf("Failed to create movie: %v", err)
+	}
+	showtime := &model.Showtime{MovieID: movie.ID, StartAt: time.Now().Add(time.Hour), Capacity: 1}
+	if err := showtimeService.CreateShowtime(showtime); err != nil {
+		t.Fatalf("Failed to create showtime: %v", err)
+	}
+
+	price, err := priceService.GetPrice(showtime.ID, model.TicketCategoryStandard)
+	if err != nil {
+		t.Fatalf("Expected the showtime to be priced, got %v", err)
+	}
+	if price.Amount != testDefaultPrice || price.Currency != model.DefaultCurrency {
+		t.Errorf("Expected the default price, got %d %s", price.Amount, price.Currency)
+	}
+	if _, err := priceService.GetPrice(showtime.ID, model.TicketCategoryVIP); !errors.Is(err, ErrPriceNotFound) {
+		t.Errorf("Expected only the standard category to be priced, got %v", err)
+	}
+}
+
+func TestPriceService_CachesMissingPrice(t *testing.T) {
+	db := testutil.Postgres(t)
+	priceRepo := repository.NewShowtimePriceRepoGorm(db)
+	s := NewPriceService(db, testutil.Redis(t), priceRepo, testDefaultPrice)
+	showtime := createTestShowtime(t, db, time.Now().Add(time.Hour))
+
+	if _, err := s.GetPrice(showtime.ID, model.TicketCategoryStandard); !errors.Is(err, ErrPriceNotFound) {
+		t.Fatalf("Expected no price, got %v", err)
+	}
+	// written around the service, the missing price is still cached
+	if err := priceRepo.Upsert(&model.ShowtimePrice{ShowtimeID: showtime.ID, Category: model.TicketCategoryStandard,
+		Amount: 1000, Currency: model.DefaultCurrency}); err != nil {
+		t.Fatalf("Failed to write price: %v", err)
+	}
+	if _, err := s.GetPrice(showtime.ID, model.TicketCategoryStandard); !errors.Is(err, ErrPriceNotFound) {
+		t.Errorf("Expected the missing price to be cached, got %v", err)
+	}
+
+	if err := s.SetPrice(showtime.ID, model.TicketCategoryStandard, 2000, ""); err != nil {
+		t.Fatalf("Failed to set price: %v", err)
+	}
+	price, err := s.GetPrice(showtime.ID, model.TicketCategoryStandard)
+	if err != nil {
+		t.Fatalf("Expected setting the price to replace the cached miss, got %v", err)
+	}
+	if price.Amount != 2000 {
+		t.Errorf("Expected 2000, got %d", price.Amount)
+	}
+}
+
+func TestPriceService_LoadPricesPricesUnpricedShowtimes(t *testing.T) {
+	db := testutil.Postgres(t)
+	s := NewPriceService(db, testutil.Redis(t), repository.NewShowtimePriceRepoGorm(db), testDefaultPrice)
+	unpriced := createTestShowtime(t, db, time.Now().Add(time.Hour))
+	priced := createTestShowtime(t, db, time.Now().Add(time.Hour))
+	if err := s.SetPrice(priced.ID, model.TicketCategoryStandard, 1000, ""); err != nil {
+		t.Fatalf("Failed to set price: %v", err)
+	}
+
+	if err := s.LoadPrices(); err != nil {
+		t.Fatalf("Failed to load prices: %v", err)
+	}
+	for showtimeID, want := range map[uint]int{unpriced.ID: testDefaultPrice, priced.ID: 1000} {
+		price, err := s.GetPrice(showtimeID, model.TicketCategoryStandard)
+		if err != nil {
+			t.Fatalf("Failed to get price of showtime %d: %v", showtimeID, err)
+		}
+		if price.Amount != want {
+			t.Errorf("Expected showtime %d to cost %d, got %d", showtimeID, want, price.Amount)
+		}
+	}
+}
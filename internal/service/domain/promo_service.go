@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+)
+
+type PromoService interface {
+	// ApplyPromo checks the code can be used for the showtime now and works out its discount on amount.
+	// The use isn't claimed yet, that happens together with the reservation
+	ApplyPromo(code string, showtimeID uint, amount int) (*cache.PromoClaim, error)
+	CreatePromoCode(promo *model.PromoCode) error
+	// LoadUsage rebuilds the usage counters in redis from the orders made with promo codes
+	LoadUsage() error
+}
+
+// how long a promo code stays cached, codes can't be changed so it only limits the memory used
+const promoCacheTTL = time.Hour
+
+// codes are part of redis keys, so they are limited to a safe alphabet
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{1,32}$`)
+
+var (
+	ErrPromoNotFound      = errors.New("promo code not found")
+	ErrPromoNotApplicable = errors.New("promo code doesn't apply to the showtime now")
+	ErrInvalidPromoCode   = errors.New("invalid promo code")
+)
+
+type promoService struct {
+	db        *gorm.DB
+	cache     *cache.RedisCache
+	repo      repository.PromoCodeRepo
+	orderRepo repository.OrderRepo
+
+	showtimeService ShowtimeService
+}
+
+var _ PromoService = (*promoService)(nil)
+
+func NewPromoService(db *gorm.DB, cache *cache.RedisCache, promoRepo repository.PromoCodeRepo,
+	orderRepo repository.OrderRepo, showtimeService ShowtimeService) *promoService {
+	return &promoService{
+		db:              db,
+		cache:           cache,
+		repo:            promoRepo,
+		orderRepo:       orderRepo,
+		showtimeService: showtimeService,
+	}
+}
+
+// NormalizePromoCode makes codes case insensitive
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (s *promoService) ApplyPromo(code string, showtimeID uint, amount int) (*cache.PromoClaim, error) {
+	promo, err := s.getPromoCode(NormalizePromoCode(code))
+	if err != nil {
+		return nil, err
+	}
+
+	if !promo.ValidAt(time.Now()) {
+		return nil, ErrPromoNotApplicable
+	}
+	if promo.ShowtimeID != nil && *promo.ShowtimeID != showtimeID {
+		return nil, ErrPromoNotApplicable
+	}
+	if promo.MovieID != nil {
+		showtime, err := s.showtimeService.GetShowtimeByID(showtimeID)
+		if err != nil {
+			return nil, err
+		}
+		if showtime.MovieID != *promo.MovieID {
+			return nil, ErrPromoNotApplicable
+		}
+	}
+
+	return &cache.PromoClaim{
+		Code:           promo.Code,
+		Discount:       promo.Discount(amount),
+		MaxUses:        promo.MaxUses,
+		MaxUsesPerUser: promo.MaxUsesPerUser,
+	}, nil
+}
+
+func (s *promoService) CreatePromoCode(promo *model.PromoCode) error {
+	promo.Code = NormalizePromoCode(promo.Code)
+	if !promoCodePattern.MatchString(promo.Code) {
+		return ErrInvalidPromoCode
+	}
+	switch promo.DiscountType {
+	case model.DiscountTypePercent:
+		if promo.DiscountValue < 1 || promo.DiscountValue > 100 {
+			return ErrInvalidPromoCode
+		}
+	case model.DiscountTypeFixed:
+		if promo.DiscountValue < 1 {
+			return ErrInvalidPromoCode
+		}
+	default:
+		return ErrInvalidPromoCode
+	}
+	if promo.MaxUses < 0 || promo.MaxUsesPerUser < 0 {
+		return ErrInvalidPromoCode
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := s.repo.WithTx(tx).GetByCode(promo.Code); err == nil {
+			return service.ErrAlreadyExists
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return s.repo.WithTx(tx).Create(promo)
+	})
+}
+
+func (s *promoService) LoadUsage() error {
+	usage, err := s.orderRepo.CountPromoUsage()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]int)
+	userUsed := make(map[string]map[uint]int)
+	for _, u := range usage {
+		used[u.PromoCode] += u.Count
+		if userUsed[u.PromoCode] == nil {
+			userUsed[u.PromoCode] = make(map[uint]int)
+		}
+		userUsed[u.PromoCode][u.UserID] = u.Count
+	}
+	return s.cache.SetPromoUsage(used, userUsed)
+}
+
+func (s *promoService) getPromoCode(code string) (*model.PromoCode, error) {
+	if !promoCodePattern.MatchString(code) {
+		return nil, ErrPromoNotFound
+	}
+
+	var promo model.PromoCode
+	err := s.cache.GetPromoCode(code, &promo)
+	if err == nil {
+		return &promo, nil
+	}
+	if !errors.Is(err, cache.ErrCacheMiss) {
+		return nil, err
+	}
+
+	found, err := s.repo.GetByCode(code)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPromoNotFound
+		}
+		return nil, err
+	}
+	if err := s.cache.SetPromoCode(code, found, promoCacheTTL); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
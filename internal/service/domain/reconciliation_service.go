@@ -0,0 +1,120 @@
+package domain
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+)
+
+type ReconciliationService interface {
+	// ReconcileShowtime compares the reservations of a showtime kept in redis with its orders
+	ReconcileShowtime(showtimeID uint) (*ReconciliationReport, error)
+	// RepairShowtime creates the missing orders of paid reservations, and returns the report from before the repair
+	// and the ids of the orders it created
+	RepairShowtime(showtimeID uint) (*ReconciliationReport, []uint, error)
+}
+
+// ReconciliationReport is the state of a showtime in redis and in postgres
+type ReconciliationReport struct {
+	ShowtimeID uint `json:"showtime_id"`
+	// remaining tickets in redis, nil if they aren't loaded
+	RemainingTickets *int `json:"remaining_tickets"`
+	// reservations in redis and orders in postgres, counted by status
+	Reservations map[cache.ReservationStatus]int `json:"reservations"`
+	Orders       map[model.OrderStatus]int       `json:"orders"`
+	// paid reservations the order workflow hasn't persisted, they are repairable
+	PaidWithoutOrder []uint `json:"paid_without_order"`
+	// orders whose reservation is gone from redis, expected after a restart since redis is flushed
+	OrdersWithoutReservation []uint `json:"orders_without_reservation"`
+}
+
+type reconciliationService struct {
+	cache     *cache.RedisCache
+	orderRepo repository.OrderRepo
+
+	showtimeService ShowtimeService
+	orderService    OrderService
+}
+
+var _ ReconciliationService = (*reconciliationService)(nil)
+
+func NewReconciliationService(cache *cache.RedisCache, orderRepo repository.OrderRepo,
+	showtimeService ShowtimeService, orderService OrderService) *reconciliationService {
+	return &reconciliationService{
+		cache:           cache,
+		orderRepo:       orderRepo,
+		showtimeService: showtimeService,
+		orderService:    orderService,
+	}
+}
+
+func (s *reconciliationService) ReconcileShowtime(showtimeID uint) (*ReconciliationReport, error) {
+	if _, err := s.showtimeService.GetShowtimeByID(showtimeID); err != nil {
+		return nil, err
+	}
+
+	report := &ReconciliationReport{
+		ShowtimeID:               showtimeID,
+		Reservations:             make(map[cache.ReservationStatus]int),
+		Orders:                   make(map[model.OrderStatus]int),
+		PaidWithoutOrder:         []uint{},
+		OrdersWithoutReservation: []uint{},
+	}
+
+	remain, err := s.cache.GetRemainingTickets(showtimeID)
+	if err == nil {
+		report.RemainingTickets = &remain
+	} else if !errors.Is(err, cache.ErrCacheMiss) {
+		return nil, err
+	}
+
+	reservations, err := s.cache.ScanReservations(showtimeID)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := s.orderRepo.GetByShowtimeID(showtimeID)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := make(map[uint]bool, len(orders))
+	for _, order := range orders {
+		ordered[order.ID] = true
+		report.Orders[order.Status]++
+		if _, ok := reservations[order.ID]; !ok {
+			report.OrdersWithoutReservation = append(report.OrdersWithoutReservation, order.ID)
+		}
+	}
+	for id, reservation := range reservations {
+		report.Reservations[reservation.Status]++
+		if reservation.Status == cache.ReservationStatusPaid && !ordered[id] {
+			report.PaidWithoutOrder = append(report.PaidWithoutOrder, id)
+		}
+	}
+	slices.Sort(report.PaidWithoutOrder)
+	slices.Sort(report.OrdersWithoutReservation)
+
+	return report, nil
+}
+
+func (s *reconciliationService) RepairShowtime(showtimeID uint) (*ReconciliationReport, []uint, error) {
+	report, err := s.ReconcileShowtime(showtimeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// creating an order is idempotent, so racing the order workflow is harmless
+	repaired := []uint{}
+	var errs []error
+	for _, reservationID := range report.PaidWithoutOrder {
+		if _, err := s.orderService.CreateOrderFromReservation(reservationID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		repaired = append(repaired, reservationID)
+	}
+	return report, repaired, errors.Join(errs...)
+}
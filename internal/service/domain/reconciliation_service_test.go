@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+func TestReconciliationService_ReadsShowtimeIndex(t *testing.T) {
+	orderService, db, redisCache := newTestOrderService(t, newFakeProvider())
+	orderRepo := repository.NewOrderRepoGorm(db)
+	reconciliation := NewReconciliationService(redisCache, orderRepo, orderService.ShowtimeService, orderService)
+	history := NewOrderHistoryService(redisCache, orderRepo, repository.NewShowtimeRepoGorm(db), repository.NewMovieRepoGorm(db))
+
+	showtime := createTestShowtime(t, db, time.Now().Add(time.Hour))
+	if err := redisCache.SetRemainingTickets(showtime.ID, 3); err != nil {
+		t.Fatalf("Failed to set tickets: %v", err)
+	}
+	reserve := func(showtimeID uint) uint {
+		reservationID, err := redisCache.ReserveTicket(showtimeID, testutil.ID(), testReservationToken, time.Now().Add(time.Minute),
+			string(model.TicketCategoryStandard), cache.ShowtimePriceCacheValue{Amount: 4500, Currency: model.DefaultCurrency}, nil)
+		if err != nil {
+			t.Fatalf("Failed to reserve: %v", err)
+		}
+		return reservationID
+	}
+	ordered, paid, cancelled := reserve(showtime.ID), reserve(showtime.ID), reserve(showtime.ID)
+	// a reservation of another showtime isn't reported
+	otherReservationID, _ := reserveTestTicket(t, redisCache, 1)
+
+	for _, id := range []uint{ordered, paid, otherReservationID} {
+		if _, _, err := redisCache.MarkTicketAsPaid(id, time.Now()); err != nil {
+			t.Fatalf("Failed to pay: %v", err)
+		}
+	}
+	if err := redisCache.CancelReservation(cancelled); err != nil {
+		t.Fatalf("Failed to cancel: %v", err)
+	}
+	order := &model.Order{ID: ordered, ShowtimeID: showtime.ID, UserID: testutil.ID(), Status: model.OrderStatusPaid,
+		Amount: 4500, Currency: model.DefaultCurrency, PaymentProvider: "fake", PaymentIntentID: "pi_test", ReservedAt: time.Now()}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+	// listing the showtime's orders must not drop the settled reservations from its index
+	if _, err := history.ListShowtimeOrders(showtime.ID, 0, 10); err != nil {
+		t.Fatalf("Failed to list orders: %v", err)
+	}
+
+	report, err := reconciliation.ReconcileShowtime(showtime.ID)
+	if err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if report.Reservations[cache.ReservationStatusPaid] != 2 || report.Reservations[cache.ReservationStatusCancelled] != 1 ||
+		len(report.Reservations) != 2 {
+		t.Errorf("Expected 2 paid and 1 cancelled reservations, got %v", report.Reservations)
+	}
+	if !slices.Equal(report.PaidWithoutOrder, []uint{paid}) {
+		t.Errorf("Expected reservation %d to be paid without order, got %v", paid, report.PaidWithoutOrder)
+	}
+	if len(report.OrdersWithoutReservation) != 0 {
+		t.Errorf("Expected every order to have its reservation, got %v", report.OrdersWithoutReservation)
+	}
+}
@@ -1,37 +1,300 @@
 package domain
 
 import (
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
 
 	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/util"
 )
 
 type ReservationService interface {
-	Reserve(userID, showtimeID uint) (orderID uint, err error)
+	// Reserve holds a ticket of the category, at the price the category has now,
+	// discounted by the promo code if it's not empty
+	Reserve(userID, showtimeID uint, category model.TicketCategory, promoCode string) (*Reservation, error)
+	// RequestPayment checks the token of a reservation which is still waiting for payment
+	// and marks it as being paid, so it can't be cancelled while the payment is started.
+	// requested is false if an earlier request asked to pay already
+	RequestPayment(reservationID uint, token string) (reservation *Reservation, requested bool, err error)
+	// WithdrawPaymentRequest undoes RequestPayment when the payment couldn't be started, the customer can ask again
+	WithdrawPaymentRequest(reservationID uint) error
+	// Cancel releases a reservation nobody asked to pay yet, with its ticket and promo code use
+	Cancel(reservationID uint, token string) (*Reservation, error)
+	// GetStatus tells the owner of a reservation what happened to it,
+	// from redis while the reservation is there and from its order otherwise.
+	// A reservation of another user is reported as cache.ErrReservationNotFound.
+	GetStatus(reservationID, userID uint) (*ReservationStatus, error)
+}
+
+// Reservation is a ticket held for a user until it's paid or the hold expires
+type Reservation struct {
+	ID         uint
+	UserID     uint
+	ShowtimeID uint
+	Status     cache.ReservationStatus
+	// Token is the secret the customer pays the reservation with
+	Token     string
+	ExpiresAt time.Time
+	// price locked when the ticket was reserved
+	Category model.TicketCategory
+	Amount   int
+	Currency string
+	// promo code the price was discounted with, Amount is the price after the discount
+	PromoCode string
+	Discount  int
+}
+
+// ReservationState is what a customer sees of a reservation
+type ReservationState string
+
+const (
+	// waiting for payment until ExpiresAt
+	ReservationStateReserved ReservationState = "RESERVED"
+	// paid, the order isn't written yet
+	ReservationStatePaid ReservationState = "PAID"
+	// the order is written, ReservationStatus.OrderStatus tells what happened to it since
+	ReservationStatePersisted ReservationState = "PERSISTED"
+	ReservationStateTimeout   ReservationState = "TIMEOUT"
+	// the payment was declined
+	ReservationStateFailed    ReservationState = "FAILED"
+	ReservationStateCancelled ReservationState = "CANCELLED"
+	// a payment that arrived after the hold expired was refunded, no order was written
+	ReservationStateRefunded ReservationState = "REFUNDED"
+)
+
+// ReservationStatus is the state of a reservation and the price it was reserved at
+type ReservationStatus struct {
+	ReservationID uint
+	UserID        uint
+	ShowtimeID    uint
+	State         ReservationState
+	// zero until the reservation is ReservationStatePersisted
+	OrderStatus model.OrderStatus
+	// zero when the reservation comes from the order
+	ExpiresAt time.Time
+	Category  model.TicketCategory
+	Amount    int
+	Currency  string
+	PromoCode string
+	Discount  int
 }
 
+var ErrInvalidReservationToken = errors.New("invalid reservation token")
+
 type reservationService struct {
-	Cache *cache.RedisCache
+	Cache        *cache.RedisCache
+	PriceService PriceService
+	PromoService PromoService
+	OrderRepo    repository.OrderRepo
+	// how long a reservation is held for payment
+	HoldTimeout time.Duration
 }
 
-func NewReservationService(cache *cache.RedisCache) *reservationService {
+func NewReservationService(cache *cache.RedisCache, priceService PriceService, promoService PromoService,
+	orderRepo repository.OrderRepo, holdTimeout time.Duration) *reservationService {
 	return &reservationService{
-		Cache: cache,
+		Cache:        cache,
+		PriceService: priceService,
+		PromoService: promoService,
+		OrderRepo:    orderRepo,
+		HoldTimeout:  holdTimeout,
 	}
 }
 
 var _ ReservationService = (*reservationService)(nil)
 
-func (s *reservationService) Reserve(userID, showtimeID uint) (orderID uint, err error) {
-	orderID, err = s.Cache.ReserveTicket(showtimeID, userID)
+func (s *reservationService) Reserve(userID, showtimeID uint, category model.TicketCategory, promoCode string) (*Reservation, error) {
+	price, err := s.PriceService.GetPrice(showtimeID, category)
+	if err != nil {
+		return nil, err
+	}
+
+	var promo *cache.PromoClaim
+	if promoCode != "" {
+		promo, err = s.PromoService.ApplyPromo(promoCode, showtimeID, price.Amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	amount := price.Amount
+	if promo != nil {
+		amount -= promo.Discount
+	}
+
+	token := util.RandomHex(16)
+	expiresAt := time.Now().Add(s.HoldTimeout)
+
+	reservationID, err := s.Cache.ReserveTicket(showtimeID, userID, token, expiresAt, string(category),
+		cache.ShowtimePriceCacheValue{
+			Amount:   amount,
+			Currency: price.Currency,
+		}, promo)
 	if err != nil {
 		if errors.Is(err, cache.ErrSoldOut) {
-			return 0, cache.ErrSoldOut
+			return nil, cache.ErrSoldOut
 		}
 		if errors.Is(err, cache.ErrAlreadyOrdered) {
-			return 0, cache.ErrAlreadyOrdered
+			return nil, cache.ErrAlreadyOrdered
+		}
+		return nil, err
+	}
+	reservation := &Reservation{
+		ID:         reservationID,
+		UserID:     userID,
+		ShowtimeID: showtimeID,
+		Status:     cache.ReservationStatusReserved,
+		Token:      token,
+		ExpiresAt:  expiresAt,
+		Category:   category,
+		Amount:     amount,
+		Currency:   price.Currency,
+	}
+	if promo != nil {
+		reservation.PromoCode = promo.Code
+		reservation.Discount = promo.Discount
+	}
+	return reservation, nil
+}
+
+func (s *reservationService) RequestPayment(reservationID uint, token string) (*Reservation, bool, error) {
+	value, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		return nil, false, err
+	}
+	if !checkToken(value.Token, token) {
+		return nil, false, ErrInvalidReservationToken
+	}
+	// checked again by the script, a cancel may come in between
+	requested, err := s.Cache.MarkPaymentPending(reservationID)
+	if err != nil {
+		return nil, false, err
+	}
+	return newReservation(reservationID, value), requested, nil
+}
+
+func (s *reservationService) WithdrawPaymentRequest(reservationID uint) error {
+	return s.Cache.UnmarkPaymentPending(reservationID)
+}
+
+func (s *reservationService) Cancel(reservationID uint, token string) (*Reservation, error) {
+	value, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		return nil, err
+	}
+	if !checkToken(value.Token, token) {
+		return nil, ErrInvalidReservationToken
+	}
+	if err := s.Cache.CancelReservation(reservationID); err != nil {
+		return nil, err
+	}
+
+	reservation := newReservation(reservationID, value)
+	reservation.Status = cache.ReservationStatusCancelled
+	return reservation, nil
+}
+
+func (s *reservationService) GetStatus(reservationID, userID uint) (*ReservationStatus, error) {
+	value, err := s.Cache.GetReservation(reservationID)
+	if err != nil {
+		if !errors.Is(err, cache.ErrReservationNotFound) {
+			return nil, err
+		}
+		// redis was flushed, only reservations which became orders are left
+		order, err := s.OrderRepo.GetByID(reservationID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, cache.ErrReservationNotFound
+			}
+			return nil, err
+		}
+		if order.UserID != userID {
+			return nil, cache.ErrReservationNotFound
 		}
-		return 0, err
+		return newOrderReservationStatus(order), nil
+	}
+	if value.UserID != userID {
+		return nil, cache.ErrReservationNotFound
+	}
+
+	status := &ReservationStatus{
+		ReservationID: reservationID,
+		UserID:        value.UserID,
+		ShowtimeID:    value.ShowtimeID,
+		ExpiresAt:     time.Unix(value.ExpiresAt, 0),
+		Category:      model.TicketCategory(value.Category),
+		Amount:        value.Amount,
+		Currency:      value.Currency,
+		PromoCode:     value.PromoCode,
+		Discount:      value.Discount,
+	}
+	switch value.Status {
+	case cache.ReservationStatusReserved:
+		status.State = ReservationStateReserved
+	case cache.ReservationStatusTimeout:
+		status.State = ReservationStateTimeout
+	case cache.ReservationStatusFailed:
+		status.State = ReservationStateFailed
+	case cache.ReservationStatusCancelled:
+		status.State = ReservationStateCancelled
+	case cache.ReservationStatusPaid, cache.ReservationStatusRefunded:
+		// the order is the truth once it's written, a refunded order is REFUNDED in redis as well
+		order, err := s.OrderRepo.GetByID(reservationID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		switch {
+		case err == nil:
+			status.State = ReservationStatePersisted
+			status.OrderStatus = order.Status
+		case value.Status == cache.ReservationStatusPaid:
+			status.State = ReservationStatePaid
+		default:
+			status.State = ReservationStateRefunded
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", cache.ErrInvalidReservationStatus, value.Status)
+	}
+	return status, nil
+}
+
+func newOrderReservationStatus(order *model.Order) *ReservationStatus {
+	return &ReservationStatus{
+		ReservationID: order.ID,
+		UserID:        order.UserID,
+		ShowtimeID:    order.ShowtimeID,
+		State:         ReservationStatePersisted,
+		OrderStatus:   order.Status,
+		Category:      order.Category,
+		Amount:        order.Amount,
+		Currency:      order.Currency,
+		PromoCode:     order.PromoCode,
+		Discount:      order.Discount,
+	}
+}
+
+// checkToken compares the token the customer sent with the one of the reservation in constant time
+func checkToken(expected, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+func newReservation(reservationID uint, value *cache.ReservationCacheValue) *Reservation {
+	return &Reservation{
+		ID:         reservationID,
+		UserID:     value.UserID,
+		ShowtimeID: value.ShowtimeID,
+		Status:     value.Status,
+		Token:      value.Token,
+		ExpiresAt:  time.Unix(value.ExpiresAt, 0),
+		Category:   model.TicketCategory(value.Category),
+		Amount:     value.Amount,
+		Currency:   value.Currency,
+		PromoCode:  value.PromoCode,
+		Discount:   value.Discount,
 	}
-	return orderID, nil
 }
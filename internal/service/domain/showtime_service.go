@@ -2,44 +2,192 @@ package domain
 
 import (
 	"errors"
-	"time"
+	"log"
 
 	"gorm.io/gorm"
 
+	"github.com/qs-lzh/flash-sale/internal/cache"
 	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/repository"
 	"github.com/qs-lzh/flash-sale/internal/service"
 )
 
 type ShowtimeService interface {
-	CreateShowtime(movieID uint, startTime time.Time) error
+	// CreateShowtime creates the showtime with the default standard price and puts its tickets on sale in redis right away,
+	// a zero capacity means model.DefaultShowtimeCapacity
+	CreateShowtime(showtime *model.Showtime) error
+	// UpdateShowtime changes the start time and capacity, a change of capacity is applied to the tickets left in redis.
+	// It returns ErrRelatedResourceExists if the showtime has orders,
+	// and cache.ErrNotEnoughTickets if more tickets are held than the new capacity allows
+	UpdateShowtime(showtime *model.Showtime) error
+	// DeleteShowtime deletes the showtime with its prices and takes it off sale.
+	// It returns ErrRelatedResourceExists if the showtime has orders or reservations being paid
+	DeleteShowtime(showtimeID uint) error
 	GetShowtimeByID(showtimeID uint) (*model.Showtime, error)
 	GetShowtimesByMovieID(movieID uint) ([]model.Showtime, error)
 	GetShowtimesByMovieIDTx(tx *gorm.DB, movieID uint) ([]model.Showtime, error)
 	GetAllShowtimes() ([]model.Showtime, error)
 }
 
+var (
+	ErrInvalidShowtime = errors.New("showtime needs a start time and a capacity that isn't negative")
+	ErrMovieNotFound   = errors.New("movie not found")
+)
+
 type showtimeService struct {
-	db   *gorm.DB
-	repo repository.ShowtimeRepo
+	db        *gorm.DB
+	cache     *cache.RedisCache
+	repo      repository.ShowtimeRepo
+	movieRepo repository.MovieRepo
+	orderRepo repository.OrderRepo
+	priceRepo repository.ShowtimePriceRepo
+	// standard price a new showtime is created with
+	defaultPrice int
 }
 
 var _ ShowtimeService = (*showtimeService)(nil)
 
-func NewShowtimeService(db *gorm.DB, showtimeRepo repository.ShowtimeRepo) *showtimeService {
+func NewShowtimeService(db *gorm.DB, cache *cache.RedisCache, showtimeRepo repository.ShowtimeRepo,
+	movieRepo repository.MovieRepo, orderRepo repository.OrderRepo, priceRepo repository.ShowtimePriceRepo,
+	defaultPrice int) *showtimeService {
 	return &showtimeService{
-		db:   db,
-		repo: showtimeRepo,
+		db:           db,
+		cache:        cache,
+		repo:         showtimeRepo,
+		movieRepo:    movieRepo,
+		orderRepo:    orderRepo,
+		priceRepo:    priceRepo,
+		defaultPrice: defaultPrice,
 	}
 }
 
-func (s *showtimeService) CreateShowtime(movieID uint, startTime time.Time) error {
+func (s *showtimeService) CreateShowtime(showtime *model.Showtime) error {
+	if err := validateShowtime(showtime); err != nil {
+		return err
+	}
+
+	// redis is written last in the transaction, and taken back if the transaction doesn't commit
+	var undo func() error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkMovie(tx, showtime.MovieID); err != nil {
+			return err
+		}
+		if err := s.repo.WithTx(tx).Create(showtime); err != nil {
+			return err
+		}
+		// admins change it or add other categories afterwards
+		price := &model.ShowtimePrice{
+			ShowtimeID: showtime.ID,
+			Category:   model.TicketCategoryStandard,
+			Amount:     s.defaultPrice,
+			Currency:   model.DefaultCurrency,
+		}
+		if err := s.priceRepo.WithTx(tx).Upsert(price); err != nil {
+			return err
+		}
+		if err := cachePrice(s.cache, price); err != nil {
+			return err
+		}
+		if err := s.cache.SetRemainingTickets(showtime.ID, showtime.Capacity); err != nil {
+			return err
+		}
+		undo = func() error { return s.cache.DeleteRemainingTickets(showtime.ID) }
+		return nil
+	})
+	undoTickets(showtime.ID, err, undo)
+	return err
+}
+
+func (s *showtimeService) UpdateShowtime(showtime *model.Showtime) error {
+	if err := validateShowtime(showtime); err != nil {
+		return err
+	}
+
+	// the row stays locked until the commit, so concurrent updates adjust the tickets one after another.
+	// Redis is changed last in the transaction, and changed back if the transaction doesn't commit
+	var undo func() error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		current, err := s.repo.WithTx(tx).GetByIDForUpdate(showtime.ID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrNotFound
+			}
+			return err
+		}
+		if err := s.checkNoOrders(tx, showtime.ID); err != nil {
+			return err
+		}
+
+		showtime.MovieID = current.MovieID
+		if err := s.repo.WithTx(tx).Update(showtime); err != nil {
+			return err
+		}
+
+		delta := showtime.Capacity - current.Capacity
+		if delta == 0 {
+			return nil
+		}
+		// held tickets stay held, only the tickets left move with the capacity
+		_, err = s.cache.AdjustRemainingTickets(showtime.ID, delta)
+		if errors.Is(err, cache.ErrCacheMiss) {
+			if err := s.cache.SetRemainingTickets(showtime.ID, showtime.Capacity); err != nil {
+				return err
+			}
+			undo = func() error { return s.cache.DeleteRemainingTickets(showtime.ID) }
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		undo = func() error {
+			_, err := s.cache.AdjustRemainingTickets(showtime.ID, -delta)
+			return err
+		}
+		return nil
+	})
+	undoTickets(showtime.ID, err, undo)
+	return err
+}
+
+// undoTickets takes back the change of a showtime's tickets in redis if its transaction failed with err
+func undoTickets(showtimeID uint, err error, undo func() error) {
+	if err == nil || undo == nil {
+		return
+	}
+	if undoErr := undo(); undoErr != nil {
+		log.Printf("Failed to undo the tickets of showtime %d: %v", showtimeID, undoErr)
+	}
+}
+
+func (s *showtimeService) DeleteShowtime(showtimeID uint) error {
 	return s.db.Transaction(func(tx *gorm.DB) error {
-		showtime := &model.Showtime{
-			MovieID: uint(movieID),
-			StartAt: startTime,
+		if _, err := s.repo.WithTx(tx).GetByID(showtimeID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrNotFound
+			}
+			return err
+		}
+		if err := s.checkNoOrders(tx, showtimeID); err != nil {
+			return err
+		}
+		// a reservation being paid would become an order of a showtime that doesn't exist
+		reservations, err := s.cache.ScanReservations(showtimeID)
+		if err != nil {
+			return err
 		}
-		return s.repo.WithTx(tx).Create(showtime)
+		for _, reservation := range reservations {
+			if reservation.Status == cache.ReservationStatusReserved || reservation.Status == cache.ReservationStatusPaid {
+				return ErrRelatedResourceExists
+			}
+		}
+
+		if err := s.priceRepo.WithTx(tx).DeleteByShowtimeID(showtimeID); err != nil {
+			return err
+		}
+		if err := s.repo.WithTx(tx).Delete(showtimeID); err != nil {
+			return err
+		}
+		return s.cache.DeleteRemainingTickets(showtimeID)
 	})
 }
 
@@ -64,3 +212,34 @@ func (s *showtimeService) GetShowtimesByMovieIDTx(tx *gorm.DB, movieID uint) ([]
 func (s *showtimeService) GetAllShowtimes() ([]model.Showtime, error) {
 	return s.repo.ListAll()
 }
+
+func (s *showtimeService) checkMovie(tx *gorm.DB, movieID uint) error {
+	if _, err := s.movieRepo.WithTx(tx).GetByID(movieID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMovieNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *showtimeService) checkNoOrders(tx *gorm.DB, showtimeID uint) error {
+	count, err := s.orderRepo.WithTx(tx).CountByShowtimeIDs([]uint{showtimeID})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrRelatedResourceExists
+	}
+	return nil
+}
+
+func validateShowtime(showtime *model.Showtime) error {
+	if showtime.StartAt.IsZero() || showtime.Capacity < 0 {
+		return ErrInvalidShowtime
+	}
+	if showtime.Capacity == 0 {
+		showtime.Capacity = model.DefaultShowtimeCapacity
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+func TestShowtimeService_ConcurrentCapacityUpdates(t *testing.T) {
+	db := testutil.Postgres(t)
+	redisCache := testutil.Redis(t)
+	showtimeService := NewShowtimeService(db, redisCache, repository.NewShowtimeRepoGorm(db), repository.NewMovieRepoGorm(db),
+		repository.NewOrderRepoGorm(db), repository.NewShowtimePriceRepoGorm(db), testDefaultPrice)
+
+	movie := &model.Movie{Title: fmt.Sprintf("Capacity test %d", testutil.ID())}
+	if err := db.Create(movie).Error; err != nil {
+		t.Fatalf("Failed to create movie: %v", err)
+	}
+	startAt := time.Now().Add(time.Hour)
+	showtime := &model.Showtime{MovieID: movie.ID, StartAt: startAt, Capacity: 10}
+	if err := showtimeService.CreateShowtime(showtime); err != nil {
+		t.Fatalf("Failed to create showtime: %v", err)
+	}
+
+	// every update reads the capacity the one before it wrote
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = showtimeService.UpdateShowtime(&model.Showtime{ID: showtime.ID, StartAt: startAt, Capacity: 20 + i})
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to update showtime: %v", err)
+		}
+	}
+
+	updated, err := showtimeService.GetShowtimeByID(showtime.ID)
+	if err != nil {
+		t.Fatalf("Failed to get showtime: %v", err)
+	}
+	if remain := remainingTickets(t, redisCache, showtime.ID); remain != updated.Capacity {
+		t.Errorf("Expected the %d tickets of the capacity left, got %d", updated.Capacity, remain)
+	}
+}
@@ -0,0 +1,205 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/auth"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+)
+
+type UserService interface {
+	// Register creates a user with the user role, it returns service.ErrAlreadyExists if the name is taken
+	Register(name, password string) (*model.User, error)
+	// Login checks the password and issues tokens, it returns service.ErrInvalidCredential if they don't match
+	Login(name, password string) (*AuthTokens, error)
+	// Refresh trades a refresh token for new tokens, the old refresh token can't be used again.
+	// It returns service.ErrInvalidCredential if the refresh token is unknown, expired or used.
+	Refresh(refreshToken string) (*AuthTokens, error)
+	GetUserByID(id uint) (*model.User, error)
+}
+
+// AuthTokens are the tokens a user authenticates with
+type AuthTokens struct {
+	UserID                uint
+	AccessToken           string
+	AccessTokenExpiresAt  time.Time
+	RefreshToken          string
+	RefreshTokenExpiresAt time.Time
+}
+
+var (
+	ErrInvalidUserName = errors.New("invalid user name")
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+const (
+	maxUserNameLength = 64
+	minPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes
+	maxPasswordBytes = 72
+)
+
+type userService struct {
+	db               *gorm.DB
+	repo             repository.UserRepo
+	refreshTokenRepo repository.RefreshTokenRepo
+	tokens           *auth.TokenManager
+	refreshTokenTTL  time.Duration
+	// compared against when the user doesn't exist, so a login takes as long either way
+	dummyHash []byte
+}
+
+var _ UserService = (*userService)(nil)
+
+func NewUserService(db *gorm.DB, userRepo repository.UserRepo, refreshTokenRepo repository.RefreshTokenRepo,
+	tokens *auth.TokenManager, refreshTokenTTL time.Duration) *userService {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return &userService{
+		db:               db,
+		repo:             userRepo,
+		refreshTokenRepo: refreshTokenRepo,
+		tokens:           tokens,
+		refreshTokenTTL:  refreshTokenTTL,
+		dummyHash:        dummyHash,
+	}
+}
+
+func (s *userService) Register(name, password string) (*model.User, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxUserNameLength {
+		return nil, ErrInvalidUserName
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordBytes {
+		return nil, ErrInvalidPassword
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{
+		Name:           name,
+		HashedPassword: string(hashed),
+		Role:           model.RoleUser,
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		repo := s.repo.WithTx(tx)
+		if _, err := repo.GetByName(name); err == nil {
+			return service.ErrAlreadyExists
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		// a user registering the same name at once gets past the check
+		if err := repo.Create(user); err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return service.ErrAlreadyExists
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *userService) Login(name, password string) (*AuthTokens, error) {
+	user, err := s.repo.GetByName(strings.TrimSpace(name))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+			return nil, service.ErrInvalidCredential
+		}
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password)); err != nil {
+		return nil, service.ErrInvalidCredential
+	}
+	return s.issueTokens(s.refreshTokenRepo, user)
+}
+
+// the old token is used and the new one issued in one transaction,
+// so a failure leaves the old token usable and two concurrent uses get one pair of tokens
+func (s *userService) Refresh(refreshToken string) (*AuthTokens, error) {
+	if refreshToken == "" {
+		return nil, service.ErrInvalidCredential
+	}
+
+	var tokens *AuthTokens
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		refreshTokenRepo := s.refreshTokenRepo.WithTx(tx)
+		used, err := refreshTokenRepo.Use(auth.HashRefreshToken(refreshToken), time.Now())
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrInvalidCredential
+			}
+			return err
+		}
+
+		// the role may have changed since the last token
+		user, err := s.repo.WithTx(tx).GetByID(used.UserID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return service.ErrInvalidCredential
+			}
+			return err
+		}
+		tokens, err = s.issueTokens(refreshTokenRepo, user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *userService) GetUserByID(id uint) (*model.User, error) {
+	user, err := s.repo.GetByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, service.ErrNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// issueTokens signs an access token and stores a new refresh token with refreshTokenRepo
+func (s *userService) issueTokens(refreshTokenRepo repository.RefreshTokenRepo, user *model.User) (*AuthTokens, error) {
+	accessToken, accessExpiresAt, err := s.tokens.IssueAccessToken(user.ID, user.Role)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiresAt := time.Now().Add(s.refreshTokenTTL)
+	if err := refreshTokenRepo.Create(&model.RefreshToken{
+		UserID:    user.ID,
+		TokenHash: auth.HashRefreshToken(refreshToken),
+		ExpiresAt: refreshExpiresAt,
+	}); err != nil {
+		return nil, err
+	}
+	return &AuthTokens{
+		UserID:                user.ID,
+		AccessToken:           accessToken,
+		AccessTokenExpiresAt:  accessExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: refreshExpiresAt,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/qs-lzh/flash-sale/internal/auth"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/repository"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+const testPassword = "password"
+
+// loginTestUser registers a user and logs in, the refresh tokens are valid for refreshTokenTTL
+func loginTestUser(t *testing.T, refreshTokenTTL time.Duration) (*userService, *AuthTokens) {
+	t.Helper()
+
+	db := testutil.Postgres(t)
+	s := NewUserService(db, repository.NewUserRepoGorm(db), repository.NewRefreshTokenRepoGorm(db),
+		auth.NewTokenManager("secret", time.Minute), refreshTokenTTL)
+	name := fmt.Sprintf("refresh-test-%d", testutil.ID())
+	if _, err := s.Register(name, testPassword); err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	tokens, err := s.Login(name, testPassword)
+	if err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	return s, tokens
+}
+
+func TestUserService_RefreshRotatesOnce(t *testing.T) {
+	s, tokens := loginTestUser(t, time.Hour)
+
+	refreshed, err := s.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Failed to refresh: %v", err)
+	}
+	if refreshed.UserID != tokens.UserID || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("Expected new tokens of user %d, got %+v", tokens.UserID, refreshed)
+	}
+	if _, err := s.Refresh(tokens.RefreshToken); !errors.Is(err, service.ErrInvalidCredential) {
+		t.Errorf("Expected the used token to be rejected, got %v", err)
+	}
+	if _, err := s.Refresh(refreshed.RefreshToken); err != nil {
+		t.Errorf("Expected the new token to work, got %v", err)
+	}
+
+	var stored model.RefreshToken
+	if err := s.db.Where("token_hash = ?", auth.HashRefreshToken(tokens.RefreshToken)).First(&stored).Error; err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+	if stored.UserID != tokens.UserID || stored.UsedAt == nil {
+		t.Errorf("Expected a used token of user %d, got %+v", tokens.UserID, stored)
+	}
+}
+
+func TestUserService_RefreshRejectsUnknownAndExpired(t *testing.T) {
+	s, tokens := loginTestUser(t, -time.Second)
+
+	if _, err := s.Refresh(tokens.RefreshToken); !errors.Is(err, service.ErrInvalidCredential) {
+		t.Errorf("Expected the expired token to be rejected, got %v", err)
+	}
+	if _, err := s.Refresh("unknown"); !errors.Is(err, service.ErrInvalidCredential) {
+		t.Errorf("Expected an unknown token to be rejected, got %v", err)
+	}
+	if _, err := s.Refresh(""); !errors.Is(err, service.ErrInvalidCredential) {
+		t.Errorf("Expected an empty token to be rejected, got %v", err)
+	}
+}
+
+func TestUserService_ConcurrentRefresh(t *testing.T) {
+	s, tokens := loginTestUser(t, time.Hour)
+
+	const n = 5
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = s.Refresh(tokens.RefreshToken)
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, service.ErrInvalidCredential) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected one refresh to succeed, got %d", succeeded)
+	}
+}
+
+func TestUserService_ConcurrentRegister(t *testing.T) {
+	db := testutil.Postgres(t)
+	s := NewUserService(db, repository.NewUserRepoGorm(db), repository.NewRefreshTokenRepoGorm(db),
+		auth.NewTokenManager("secret", time.Minute), time.Hour)
+	name := fmt.Sprintf("register-test-%d", testutil.ID())
+
+	const n = 5
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = s.Register(name, testPassword)
+		}()
+	}
+	wg.Wait()
+
+	registered := 0
+	for _, err := range errs {
+		if err == nil {
+			registered++
+		} else if !errors.Is(err, service.ErrAlreadyExists) {
+			t.Errorf("Expected the name to be taken, got %v", err)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("Expected one user to register, got %d", registered)
+	}
+
+	// what a registration that got past the name check runs into
+	err := repository.NewUserRepoGorm(db).Create(&model.User{Name: name, HashedPassword: "hashed", Role: model.RoleUser})
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("Expected a duplicated key, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package workflow
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+)
+
+// how long a processed message id is remembered,
+// redeliveries are expected within minutes, so a day is plenty
+const DefaultProcessedMessageTTL = 24 * time.Hour
+
+// MessageDeduplicator makes consumers idempotent under at-least-once delivery.
+// A message id is recorded after the message has been handled successfully,
+// and a later delivery with the same id is acked without being processed again.
+type MessageDeduplicator struct {
+	cache *cache.RedisCache
+	ttl   time.Duration
+
+	duplicates atomic.Int64
+}
+
+func NewMessageDeduplicator(cache *cache.RedisCache, ttl time.Duration) *MessageDeduplicator {
+	return &MessageDeduplicator{
+		cache: cache,
+		ttl:   ttl,
+	}
+}
+
+// IsDuplicate reports whether the message was already processed by a consumer of the queue.
+// If the store can't be reached the message is treated as new, the handlers are safe to re-run.
+func (d *MessageDeduplicator) IsDuplicate(queueName string, messageID string) bool {
+	if messageID == "" {
+		return false
+	}
+	processed, err := d.cache.IsMessageProcessed(queueName, messageID)
+	if err != nil {
+		log.Printf("Failed to check processed message %s on %s: %v", messageID, queueName, err)
+		return false
+	}
+	if processed {
+		count := d.duplicates.Add(1)
+		log.Printf("Skip duplicate message %s on %s (%d duplicates so far)", messageID, queueName, count)
+	}
+	return processed
+}
+
+func (d *MessageDeduplicator) MarkProcessed(queueName string, messageID string) {
+	if messageID == "" {
+		return
+	}
+	if err := d.cache.MarkMessageProcessed(queueName, messageID, d.ttl); err != nil {
+		log.Printf("Failed to mark message %s on %s as processed: %v", messageID, queueName, err)
+	}
+}
+
+// Duplicates returns the number of duplicate messages skipped since start
+func (d *MessageDeduplicator) Duplicates() int64 {
+	return d.duplicates.Load()
+}
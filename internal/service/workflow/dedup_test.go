@@ -0,0 +1,90 @@
+package workflow
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+// countingPaymentService counts the payments started and does nothing else
+type countingPaymentService struct {
+	started atomic.Int64
+}
+
+var _ domain.PaymentService = (*countingPaymentService)(nil)
+
+func (s *countingPaymentService) StartPayment(reservationID uint, amount int) (*domain.PaymentIntent, error) {
+	s.started.Add(1)
+	return &domain.PaymentIntent{ID: "intent", ReservationID: reservationID, Amount: amount}, nil
+}
+
+func (s *countingPaymentService) ConfirmPayment(domain.PaymentEvent) (*domain.PaymentConfirmation, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *countingPaymentService) FailPayment(domain.PaymentEvent) (uint, bool, error) {
+	return 0, false, fmt.Errorf("not implemented")
+}
+
+func (s *countingPaymentService) MarkTimeout(uint) (uint, bool, error) {
+	return 0, false, fmt.Errorf("not implemented")
+}
+
+func TestMessageDeduplicator(t *testing.T) {
+	dedup := NewMessageDeduplicator(testutil.Redis(t), time.Minute)
+	messageID := fmt.Sprintf("dedup-test-%d", testutil.ID())
+
+	if dedup.IsDuplicate("queue", messageID) {
+		t.Fatalf("Expected a new message not to be a duplicate")
+	}
+	dedup.MarkProcessed("queue", messageID)
+	if !dedup.IsDuplicate("queue", messageID) {
+		t.Errorf("Expected a processed message to be a duplicate")
+	}
+	if dedup.IsDuplicate("other-queue", messageID) {
+		t.Errorf("Expected the message to be new on another queue")
+	}
+
+	// messages without an id can't be told apart
+	dedup.MarkProcessed("queue", "")
+	if dedup.IsDuplicate("queue", "") {
+		t.Errorf("Expected a message without id never to be a duplicate")
+	}
+	if n := dedup.Duplicates(); n != 1 {
+		t.Errorf("Expected 1 duplicate, got %d", n)
+	}
+}
+
+func TestPaymentWorkflow_AcksRedeliveryWithoutHandling(t *testing.T) {
+	dedup := NewMessageDeduplicator(testutil.Redis(t), time.Minute)
+	broker := newFakeBroker()
+	payments := &countingPaymentService{}
+	w := NewPaymentWorkflow(payments, broker, dedup, &fakeNotifier{}, fakePublisher{})
+	if err := w.Start(); err != nil {
+		t.Fatalf("Failed to start workflow: %v", err)
+	}
+	t.Cleanup(func() { broker.StopConsuming() })
+
+	messageID := fmt.Sprintf("dedup-test-%d", testutil.ID())
+	message := mq.ReservationToPaymentImmediateMessage{ReservationID: 1, Price: 4500}
+
+	if o := waitOutcome(t, broker.deliver(t, mq.ReservationToPaymentImmediateQueue, messageID, message)); o != outcomeAck {
+		t.Fatalf("Expected the first delivery to be acked, got %s", o)
+	}
+	// e.g. the ack of the first delivery was lost
+	if o := waitOutcome(t, broker.deliver(t, mq.ReservationToPaymentImmediateQueue, messageID, message)); o != outcomeAck {
+		t.Fatalf("Expected the redelivery to be acked, got %s", o)
+	}
+
+	if n := payments.started.Load(); n != 1 {
+		t.Errorf("Expected the payment to be started once, got %d", n)
+	}
+	if n := dedup.Duplicates(); n != 1 {
+		t.Errorf("Expected 1 duplicate, got %d", n)
+	}
+}
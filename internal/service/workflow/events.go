@@ -0,0 +1,27 @@
+package workflow
+
+import (
+	"log"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+)
+
+// publishEvent pushes a state change which already happened to the customer's open streams,
+// an event that can't be published is logged, the customer can still query the reservation
+func publishEvent(publisher realtime.Publisher, event realtime.Event) {
+	if err := publisher.Publish(event); err != nil {
+		log.Printf("Failed to publish %s event of reservation %d: %v", event.State, event.ReservationID, err)
+	}
+}
+
+// publishOrderEvent pushes the current status of an order
+func publishOrderEvent(publisher realtime.Publisher, order *model.Order) {
+	publishEvent(publisher, realtime.Event{
+		ReservationID: order.ID,
+		UserID:        order.UserID,
+		State:         domain.ReservationStatePersisted,
+		OrderStatus:   order.Status,
+	})
+}
@@ -0,0 +1,141 @@
+package workflow
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
+)
+
+// what a handler did with a delivery
+const (
+	outcomeAck     = "ack"
+	outcomeRequeue = "requeue"
+	outcomeDrop    = "drop"
+)
+
+// fakeBroker hands the deliveries of the test to the consumers and records what's published
+type fakeBroker struct {
+	mu        sync.Mutex
+	queues    map[string]chan mq.Delivery
+	published map[string][][]byte
+}
+
+var _ mq.Broker = (*fakeBroker)(nil)
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues:    make(map[string]chan mq.Delivery),
+		published: make(map[string][][]byte),
+	}
+}
+
+func (b *fakeBroker) queue(queueName string) chan mq.Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[queueName]
+	if !ok {
+		q = make(chan mq.Delivery, 16)
+		b.queues[queueName] = q
+	}
+	return q
+}
+
+func (b *fakeBroker) Setup() error {
+	return nil
+}
+
+func (b *fakeBroker) Publish(queueName string, message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published[queueName] = append(b.published[queueName], body)
+	return nil
+}
+
+func (b *fakeBroker) Consume(queueName string) (<-chan mq.Delivery, error) {
+	return b.queue(queueName), nil
+}
+
+func (b *fakeBroker) StopConsuming() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		close(q)
+	}
+	return nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+// deliver hands the message to the consumer of the queue, the returned channel receives its outcome
+func (b *fakeBroker) deliver(t *testing.T, queueName string, messageID string, message any) <-chan string {
+	t.Helper()
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	outcome := make(chan string, 1)
+	b.queue(queueName) <- mq.NewDelivery(messageID, body,
+		func() error {
+			outcome <- outcomeAck
+			return nil
+		},
+		func(requeue bool) error {
+			if requeue {
+				outcome <- outcomeRequeue
+			} else {
+				outcome <- outcomeDrop
+			}
+			return nil
+		})
+	return outcome
+}
+
+func (b *fakeBroker) publishedTo(queueName string) [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published[queueName]
+}
+
+func waitOutcome(t *testing.T, outcome <-chan string) string {
+	t.Helper()
+
+	select {
+	case o := <-outcome:
+		return o
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The delivery wasn't acked or nacked")
+	}
+	return ""
+}
+
+// fakeNotifier records the notifications instead of publishing them
+type fakeNotifier struct {
+	mu            sync.Mutex
+	notifications []notification.Notification
+}
+
+func (n *fakeNotifier) Notify(notification notification.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+// fakePublisher drops the events
+type fakePublisher struct{}
+
+func (fakePublisher) Publish(realtime.Event) error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/util"
+)
+
+// NotificationWorkflow sends notifications in the background.
+// Every channel is sent on its own, a channel that fails is retried through the retry delay queue
+// without sending the channels that succeeded again.
+type NotificationWorkflow struct {
+	notificationService domain.NotificationService
+	broker              mq.Broker
+	dedup               *MessageDeduplicator
+	// a notification is dropped after failing this many times on a channel
+	maxAttempts int
+
+	wg sync.WaitGroup
+}
+
+var _ notification.Notifier = (*NotificationWorkflow)(nil)
+
+func NewNotificationWorkflow(notificationService domain.NotificationService, broker mq.Broker,
+	dedup *MessageDeduplicator, maxAttempts int) *NotificationWorkflow {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &NotificationWorkflow{
+		notificationService: notificationService,
+		broker:              broker,
+		dedup:               dedup,
+		maxAttempts:         maxAttempts,
+	}
+}
+
+func (w *NotificationWorkflow) Start() error {
+	return w.ConsumeNotification()
+}
+
+// Wait blocks until the consumer has stopped and the in-flight notifications are sent,
+// call it after the broker stopped consuming
+func (w *NotificationWorkflow) Wait(ctx context.Context) error {
+	return util.WaitContext(ctx, w.wg.Wait)
+}
+
+// Notify queues the notification, it's sent on every channel the user enabled
+func (w *NotificationWorkflow) Notify(n notification.Notification) error {
+	return w.broker.Publish(mq.NotificationImmediateQueue,
+		mq.NotificationImmediateMessage{
+			Kind:          string(n.Kind),
+			UserID:        n.UserID,
+			ReservationID: n.ReservationID,
+			Data:          n.Data,
+		})
+}
+
+func (w *NotificationWorkflow) ConsumeNotification() error {
+	msgs, err := w.broker.Consume(mq.NotificationImmediateQueue)
+	if err != nil {
+		return err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for msg := range msgs {
+			if err := w.handleNotification(msg); err != nil {
+				log.Printf("Failed to handle notification: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (w *NotificationWorkflow) handleNotification(msg mq.Delivery) error {
+	if w.dedup.IsDuplicate(mq.NotificationImmediateQueue, msg.MessageID) {
+		msg.Ack()
+		return nil
+	}
+
+	var message mq.NotificationImmediateMessage
+	if err := json.Unmarshal(msg.Body, &message); err != nil {
+		msg.Nack(false)
+		return err
+	}
+	n := notification.Notification{
+		Kind:          notification.Kind(message.Kind),
+		UserID:        message.UserID,
+		ReservationID: message.ReservationID,
+		Data:          message.Data,
+	}
+
+	channels := []string{message.Channel}
+	if message.Channel == "" {
+		var err error
+		channels, err = w.notificationService.Channels(message.UserID)
+		if err != nil {
+			msg.Nack(true)
+			return err
+		}
+	}
+
+	for _, channel := range channels {
+		err := w.notificationService.Send(n, channel)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, notification.ErrNoAddress) {
+			log.Printf("Skip %s notification %s of reservation %d: user %d has no address",
+				channel, n.Kind, n.ReservationID, n.UserID)
+			continue
+		}
+		if err := w.retryNotification(message, channel, err); err != nil {
+			msg.Nack(true)
+			return err
+		}
+	}
+
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.NotificationImmediateQueue, msg.MessageID)
+
+	return nil
+}
+
+// retryNotification queues the notification again for one channel, or drops it once it failed too often
+func (w *NotificationWorkflow) retryNotification(message mq.NotificationImmediateMessage, channel string, reason error) error {
+	attempt := message.Attempt + 1
+	if attempt >= w.maxAttempts {
+		log.Printf("Drop %s notification %s of reservation %d after %d attempts: %v",
+			channel, message.Kind, message.ReservationID, attempt, reason)
+		return nil
+	}
+
+	log.Printf("Failed to send %s notification %s of reservation %d, retrying: %v",
+		channel, message.Kind, message.ReservationID, reason)
+	message.Channel = channel
+	message.Attempt = attempt
+	return w.broker.Publish(mq.NotificationRetryDelayQueue, message)
+}
+
+// notify queues a notification for a change which already happened,
+// a notification that can't be queued is logged instead of failing the change
+func notify(notifier notification.Notifier, n notification.Notification) {
+	if err := notifier.Notify(n); err != nil {
+		log.Printf("Failed to notify user %d of %s on reservation %d: %v", n.UserID, n.Kind, n.ReservationID, err)
+	}
+}
@@ -0,0 +1,161 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+// channelNotificationService sends on the channels of every user, the errors of a channel are returned first
+type channelNotificationService struct {
+	mu       sync.Mutex
+	channels []string
+	errs     map[string][]error
+	sent     map[string]int
+}
+
+var _ domain.NotificationService = (*channelNotificationService)(nil)
+
+func (s *channelNotificationService) Channels(uint) ([]string, error) {
+	return s.channels, nil
+}
+
+func (s *channelNotificationService) Send(_ notification.Notification, channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errs := s.errs[channel]; len(errs) > 0 {
+		s.errs[channel] = errs[1:]
+		return errs[0]
+	}
+	s.sent[channel]++
+	return nil
+}
+
+func (s *channelNotificationService) GetPreference(uint) (*model.NotificationPreference, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *channelNotificationService) SetPreference(*model.NotificationPreference) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (s *channelNotificationService) sentOn(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent[channel]
+}
+
+func startNotificationWorkflow(t *testing.T, notifications *channelNotificationService, maxAttempts int) *fakeBroker {
+	t.Helper()
+
+	broker := newFakeBroker()
+	w := NewNotificationWorkflow(notifications, broker,
+		NewMessageDeduplicator(testutil.Redis(t), time.Minute), maxAttempts)
+	if err := w.Start(); err != nil {
+		t.Fatalf("Failed to start workflow: %v", err)
+	}
+	t.Cleanup(func() { broker.StopConsuming() })
+	return broker
+}
+
+// retries returns the retries published so far
+func retries(t *testing.T, broker *fakeBroker) []mq.NotificationImmediateMessage {
+	t.Helper()
+
+	var messages []mq.NotificationImmediateMessage
+	for _, body := range broker.publishedTo(mq.NotificationRetryDelayQueue) {
+		var message mq.NotificationImmediateMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Fatalf("Failed to unmarshal retry: %v", err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestNotificationWorkflow_RetriesFailedChannelOnly(t *testing.T) {
+	errSMS := errors.New("sms gateway down")
+	notifications := &channelNotificationService{
+		channels: []string{notification.ChannelEmail, notification.ChannelSMS},
+		errs:     map[string][]error{notification.ChannelSMS: {errSMS, errSMS}},
+		sent:     make(map[string]int),
+	}
+	broker := startNotificationWorkflow(t, notifications, 3)
+
+	message := mq.NotificationImmediateMessage{Kind: string(notification.KindPaid), UserID: testutil.ID(), ReservationID: 1}
+	if o := waitOutcome(t, broker.deliver(t, mq.NotificationImmediateQueue, fmt.Sprintf("notify-%d", testutil.ID()), message)); o != outcomeAck {
+		t.Fatalf("Expected the notification to be acked, got %s", o)
+	}
+	queued := retries(t, broker)
+	if len(queued) != 1 || queued[0].Channel != notification.ChannelSMS || queued[0].Attempt != 1 {
+		t.Fatalf("Expected one sms retry at attempt 1, got %+v", queued)
+	}
+
+	// the retry fails again and is queued once more, email isn't sent again
+	if o := waitOutcome(t, broker.deliver(t, mq.NotificationImmediateQueue, fmt.Sprintf("notify-%d", testutil.ID()), queued[0])); o != outcomeAck {
+		t.Fatalf("Expected the retry to be acked, got %s", o)
+	}
+	queued = retries(t, broker)
+	if len(queued) != 2 || queued[1].Channel != notification.ChannelSMS || queued[1].Attempt != 2 {
+		t.Fatalf("Expected a second sms retry at attempt 2, got %+v", queued)
+	}
+
+	if o := waitOutcome(t, broker.deliver(t, mq.NotificationImmediateQueue, fmt.Sprintf("notify-%d", testutil.ID()), queued[1])); o != outcomeAck {
+		t.Fatalf("Expected the last retry to be acked, got %s", o)
+	}
+	if n := notifications.sentOn(notification.ChannelEmail); n != 1 {
+		t.Errorf("Expected the email to be sent once, got %d", n)
+	}
+	if n := notifications.sentOn(notification.ChannelSMS); n != 1 {
+		t.Errorf("Expected the sms to be sent on the last attempt, got %d", n)
+	}
+}
+
+func TestNotificationWorkflow_DropsAfterMaxAttempts(t *testing.T) {
+	errSMS := errors.New("sms gateway down")
+	notifications := &channelNotificationService{
+		channels: []string{notification.ChannelSMS},
+		errs:     map[string][]error{notification.ChannelSMS: {errSMS}},
+		sent:     make(map[string]int),
+	}
+	broker := startNotificationWorkflow(t, notifications, 2)
+
+	// the last attempt the workflow allows
+	message := mq.NotificationImmediateMessage{Kind: string(notification.KindPaid), UserID: testutil.ID(), ReservationID: 1,
+		Channel: notification.ChannelSMS, Attempt: 1}
+	if o := waitOutcome(t, broker.deliver(t, mq.NotificationImmediateQueue, "", message)); o != outcomeAck {
+		t.Fatalf("Expected the notification to be acked, got %s", o)
+	}
+	if queued := retries(t, broker); len(queued) != 0 {
+		t.Errorf("Expected the notification to be dropped, got retries %+v", queued)
+	}
+}
+
+func TestNotificationWorkflow_SkipsChannelWithoutAddress(t *testing.T) {
+	notifications := &channelNotificationService{
+		channels: []string{notification.ChannelEmail, notification.ChannelSMS},
+		errs:     map[string][]error{notification.ChannelSMS: {notification.ErrNoAddress}},
+		sent:     make(map[string]int),
+	}
+	broker := startNotificationWorkflow(t, notifications, 3)
+
+	message := mq.NotificationImmediateMessage{Kind: string(notification.KindPaid), UserID: testutil.ID(), ReservationID: 1}
+	if o := waitOutcome(t, broker.deliver(t, mq.NotificationImmediateQueue, "", message)); o != outcomeAck {
+		t.Fatalf("Expected the notification to be acked, got %s", o)
+	}
+	if queued := retries(t, broker); len(queued) != 0 {
+		t.Errorf("Expected no retry for a missing address, got %+v", queued)
+	}
+	if n := notifications.sentOn(notification.ChannelEmail); n != 1 {
+		t.Errorf("Expected the email to be sent, got %d", n)
+	}
+}
@@ -1,50 +1,248 @@
 package workflow
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
+	"github.com/qs-lzh/flash-sale/internal/service"
 	"github.com/qs-lzh/flash-sale/internal/service/domain"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/qs-lzh/flash-sale/internal/util"
 )
 
 type OrderWorkflow struct {
 	cache        *cache.RedisCache
 	orderService domain.OrderService
+	broker       mq.Broker
+	dedup        *MessageDeduplicator
+	batch        OrderBatchOptions
+	notifier     notification.Notifier
+	events       realtime.Publisher
+
+	wg sync.WaitGroup
+}
+
+// OrderBatchOptions controls how order creation messages are buffered before they are written
+type OrderBatchOptions struct {
+	// most messages written at once
+	Size int
+	// longest time the first message of a batch waits for more
+	Interval time.Duration
 }
 
-func NewOrderWorkflow(cache *cache.RedisCache, orderService domain.OrderService) *OrderWorkflow {
+func NewOrderWorkflow(cache *cache.RedisCache, orderService domain.OrderService, broker mq.Broker,
+	dedup *MessageDeduplicator, batch OrderBatchOptions, notifier notification.Notifier, events realtime.Publisher) *OrderWorkflow {
+	if batch.Size < 1 {
+		batch.Size = 1
+	}
 	return &OrderWorkflow{
 		cache:        cache,
 		orderService: orderService,
+		broker:       broker,
+		dedup:        dedup,
+		batch:        batch,
+		notifier:     notifier,
+		events:       events,
+	}
+}
+
+func (w *OrderWorkflow) Start() error {
+	if err := w.ConsumeOrderCreation(); err != nil {
+		return err
+	}
+	if err := w.ConsumeOrderRefund(); err != nil {
+		return err
 	}
+	return nil
 }
 
-func (w *OrderWorkflow) Start(mqConn *amqp.Connection) error {
-	if err := w.ConsumeOrderCreation(mqConn); err != nil {
+// Wait blocks until the consumers have stopped and the in-flight messages are handled,
+// call it after the broker stopped consuming
+func (w *OrderWorkflow) Wait(ctx context.Context) error {
+	return util.WaitContext(ctx, w.wg.Wait)
+}
+
+func (w *OrderWorkflow) ConsumeOrderCreation() error {
+	msgs, err := w.broker.Consume(mq.PaymentToOrderImmediateQueue)
+	if err != nil {
 		return err
 	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		batch := make([]mq.Delivery, 0, w.batch.Size)
+		timer := time.NewTimer(w.batch.Interval)
+		timer.Stop()
+		flush := func() {
+			timer.Stop()
+			w.handleOrderCreations(batch)
+			batch = batch[:0]
+		}
+
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					// the consumer is stopped, write what's left
+					flush()
+					return
+				}
+				batch = append(batch, msg)
+				if len(batch) == 1 {
+					timer.Reset(w.batch.Interval)
+				}
+				if len(batch) >= w.batch.Size {
+					flush()
+				}
+			case <-timer.C:
+				flush()
+			}
+		}
+	}()
+
 	return nil
 }
 
-func (w *OrderWorkflow) ConsumeOrderCreation(conn *amqp.Connection) error {
-	ch, err := mq.NewChannel(conn)
+// handleOrderCreations writes the orders of a batch of messages with one insert and acks them together,
+// if the batch fails each message is handled on its own
+func (w *OrderWorkflow) handleOrderCreations(batch []mq.Delivery) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var (
+		// the messages to ack, in the order they were delivered
+		acks           []mq.Delivery
+		duplicates     []mq.Delivery
+		pending        []mq.Delivery
+		reservationIDs []uint
+	)
+	for _, msg := range batch {
+		if w.dedup.IsDuplicate(mq.PaymentToOrderImmediateQueue, msg.MessageID) {
+			acks = append(acks, msg)
+			duplicates = append(duplicates, msg)
+			continue
+		}
+
+		var message mq.PaymentToOrderImmediateMessage
+		if err := json.Unmarshal(msg.Body, &message); err != nil {
+			log.Printf("Failed to handle order creation: %v", err)
+			msg.Nack(false)
+			continue
+		}
+		acks = append(acks, msg)
+		pending = append(pending, msg)
+		reservationIDs = append(reservationIDs, message.ReservationID)
+	}
+
+	var orders []model.Order
+	if len(pending) > 0 {
+		var err error
+		orders, err = w.orderService.CreateOrdersFromReservations(reservationIDs)
+		if err != nil {
+			log.Printf("Failed to write a batch of %d orders, handling them one by one: %v", len(pending), err)
+			// one by one, a multiple ack would ack the pending messages as well
+			for _, msg := range duplicates {
+				msg.Ack()
+			}
+			for i, msg := range pending {
+				if err := w.handleOrderCreation(msg, reservationIDs[i]); err != nil {
+					log.Printf("Failed to handle order creation: %v", err)
+				}
+			}
+			return
+		}
+	}
+
+	if err := mq.AckAll(acks); err != nil {
+		log.Printf("Failed to ack a batch of %d orders: %v", len(acks), err)
+		return
+	}
+	for _, msg := range pending {
+		w.dedup.MarkProcessed(mq.PaymentToOrderImmediateQueue, msg.MessageID)
+	}
+	for i := range orders {
+		publishOrderEvent(w.events, &orders[i])
+	}
+}
+
+func (w *OrderWorkflow) handleOrderCreation(msg mq.Delivery, reservationID uint) error {
+	order, err := w.orderService.CreateOrderFromReservation(reservationID)
 	if err != nil {
+		// retrying can't fix these, park the reservation instead of dropping a paid order
+		if errors.Is(err, cache.ErrReservationNotFound) ||
+			errors.Is(err, cache.ErrInvalidReservationStatus) ||
+			errors.Is(err, domain.ErrIncompleteReservation) {
+			return w.parkOrderCreation(msg, reservationID, err)
+		}
+		msg.Nack(true)
+		return err
+	}
+
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.PaymentToOrderImmediateQueue, msg.MessageID)
+	publishOrderEvent(w.events, order)
+
+	return nil
+}
+
+// parkOrderCreation moves a reservation which can't be persisted to the parked queue
+func (w *OrderWorkflow) parkOrderCreation(msg mq.Delivery, reservationID uint, reason error) error {
+	if err := w.broker.Publish(mq.OrderCreationParkedQueue,
+		mq.OrderCreationParkedMessage{
+			ReservationID: reservationID,
+			Reason:        reason.Error(),
+			ParkedAt:      time.Now().Unix(),
+		}); err != nil {
+		msg.Nack(true)
 		return err
 	}
 
-	msgs, err := ch.Consume(mq.PaymentToOrderImmediateQueue, "", false, false, false, false, nil)
+	log.Printf("Parked order creation of reservation %d: %v", reservationID, reason)
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.PaymentToOrderImmediateQueue, msg.MessageID)
+
+	return nil
+}
+
+// RequestRefund checks the user's order can be refunded and queues the refund
+func (w *OrderWorkflow) RequestRefund(orderID uint, userID uint) (*model.Order, error) {
+	order, err := w.orderService.GetRefundableOrder(orderID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.broker.Publish(mq.OrderRefundImmediateQueue,
+		mq.OrderRefundImmediateMessage{
+			OrderID: order.ID,
+		}); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (w *OrderWorkflow) ConsumeOrderRefund() error {
+	msgs, err := w.broker.Consume(mq.OrderRefundImmediateQueue)
 	if err != nil {
 		return err
 	}
 
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 		for msg := range msgs {
-			if err := w.handleOrderCreation(msg); err != nil {
-				log.Printf("Failed to handle order creation: %v", err)
+			if err := w.handleOrderRefund(msg); err != nil {
+				log.Printf("Failed to handle order refund: %v", err)
 			}
 		}
 	}()
@@ -52,19 +250,44 @@ func (w *OrderWorkflow) ConsumeOrderCreation(conn *amqp.Connection) error {
 	return nil
 }
 
-func (w *OrderWorkflow) handleOrderCreation(msg amqp.Delivery) error {
-	var message mq.PaymentToOrderImmediateMessage
+func (w *OrderWorkflow) handleOrderRefund(msg mq.Delivery) error {
+	if w.dedup.IsDuplicate(mq.OrderRefundImmediateQueue, msg.MessageID) {
+		msg.Ack()
+		return nil
+	}
+
+	var message mq.OrderRefundImmediateMessage
 	if err := json.Unmarshal(msg.Body, &message); err != nil {
-		msg.Nack(false, false)
+		msg.Nack(false)
 		return err
 	}
 
-	if err := w.orderService.CreateOrderFromReservation(message.ReservationID); err != nil {
-		msg.Nack(false, true)
+	order, err := w.orderService.RefundOrder(message.OrderID)
+	if err != nil {
+		// retrying can't fix these
+		if errors.Is(err, service.ErrNotFound) ||
+			errors.Is(err, domain.ErrInvalidOrderStatus) ||
+			errors.Is(err, domain.ErrPaymentIntentNotFound) {
+			msg.Nack(false)
+			return err
+		}
+		msg.Nack(true)
 		return err
 	}
 
-	msg.Ack(false)
+	notify(w.notifier, notification.Notification{
+		Kind:          notification.KindRefunded,
+		UserID:        order.UserID,
+		ReservationID: order.ID,
+		Data: map[string]string{
+			"amount":   notification.FormatAmount(order.Amount),
+			"currency": order.Currency,
+		},
+	})
+	publishOrderEvent(w.events, order)
+
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.OrderRefundImmediateQueue, msg.MessageID)
 
 	return nil
 }
@@ -0,0 +1,145 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/service"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+// refundingOrderService refunds the orders it holds, the next refundErrs are returned first
+type refundingOrderService struct {
+	mu         sync.Mutex
+	orders     map[uint]*model.Order
+	refundErrs []error
+	refunds    int
+}
+
+var _ domain.OrderService = (*refundingOrderService)(nil)
+
+func (s *refundingOrderService) CreateOrderFromReservation(uint) (*model.Order, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *refundingOrderService) CreateOrdersFromReservations([]uint) ([]model.Order, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *refundingOrderService) GetRefundableOrder(orderID uint, userID uint) (*model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order, ok := s.orders[orderID]
+	if !ok || order.UserID != userID {
+		return nil, service.ErrNotFound
+	}
+	if order.Status != model.OrderStatusPaid {
+		return nil, domain.ErrInvalidOrderStatus
+	}
+	return order, nil
+}
+
+func (s *refundingOrderService) RefundOrder(orderID uint) (*model.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.refundErrs) > 0 {
+		err := s.refundErrs[0]
+		s.refundErrs = s.refundErrs[1:]
+		return nil, err
+	}
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, service.ErrNotFound
+	}
+	s.refunds++
+	order.Status = model.OrderStatusRefunded
+	return order, nil
+}
+
+func startOrderWorkflow(t *testing.T, orders *refundingOrderService) (*OrderWorkflow, *fakeBroker, *fakeNotifier) {
+	t.Helper()
+
+	redisCache := testutil.Redis(t)
+	broker := newFakeBroker()
+	notifier := &fakeNotifier{}
+	w := NewOrderWorkflow(redisCache, orders, broker, NewMessageDeduplicator(redisCache, time.Minute),
+		OrderBatchOptions{}, notifier, fakePublisher{})
+	if err := w.Start(); err != nil {
+		t.Fatalf("Failed to start workflow: %v", err)
+	}
+	t.Cleanup(func() { broker.StopConsuming() })
+	return w, broker, notifier
+}
+
+func TestOrderWorkflow_RequestRefund(t *testing.T) {
+	orderID, userID := testutil.ID(), testutil.ID()
+	orders := &refundingOrderService{orders: map[uint]*model.Order{
+		orderID: {ID: orderID, UserID: userID, Status: model.OrderStatusPaid},
+	}}
+	w, broker, _ := startOrderWorkflow(t, orders)
+
+	if _, err := w.RequestRefund(orderID, userID+1); !errors.Is(err, service.ErrNotFound) {
+		t.Errorf("Expected the order of another user not to be found, got %v", err)
+	}
+	if n := len(broker.publishedTo(mq.OrderRefundImmediateQueue)); n != 0 {
+		t.Fatalf("Expected nothing to be queued, got %d messages", n)
+	}
+
+	if _, err := w.RequestRefund(orderID, userID); err != nil {
+		t.Fatalf("Failed to request refund: %v", err)
+	}
+	if n := len(broker.publishedTo(mq.OrderRefundImmediateQueue)); n != 1 {
+		t.Errorf("Expected the refund to be queued, got %d messages", n)
+	}
+}
+
+func TestOrderWorkflow_RedeliveredRefund(t *testing.T) {
+	orderID := testutil.ID()
+	orders := &refundingOrderService{
+		orders: map[uint]*model.Order{
+			orderID: {ID: orderID, UserID: testutil.ID(), Status: model.OrderStatusPaid, Amount: 4500, Currency: "CNY"},
+		},
+		refundErrs: []error{errors.New("provider unavailable")},
+	}
+	_, broker, notifier := startOrderWorkflow(t, orders)
+
+	messageID := fmt.Sprintf("refund-test-%d", testutil.ID())
+	message := mq.OrderRefundImmediateMessage{OrderID: orderID}
+
+	if o := waitOutcome(t, broker.deliver(t, mq.OrderRefundImmediateQueue, messageID, message)); o != outcomeRequeue {
+		t.Fatalf("Expected the failed refund to be requeued, got %s", o)
+	}
+	if o := waitOutcome(t, broker.deliver(t, mq.OrderRefundImmediateQueue, messageID, message)); o != outcomeAck {
+		t.Fatalf("Expected the redelivered refund to be acked, got %s", o)
+	}
+	// e.g. the ack was lost
+	if o := waitOutcome(t, broker.deliver(t, mq.OrderRefundImmediateQueue, messageID, message)); o != outcomeAck {
+		t.Fatalf("Expected the duplicate to be acked, got %s", o)
+	}
+
+	if orders.refunds != 1 {
+		t.Errorf("Expected the order to be refunded once, got %d", orders.refunds)
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if len(notifier.notifications) != 1 || notifier.notifications[0].Kind != notification.KindRefunded {
+		t.Errorf("Expected one refund notification, got %+v", notifier.notifications)
+	}
+}
+
+func TestOrderWorkflow_DropsRefundOfMissingOrder(t *testing.T) {
+	orders := &refundingOrderService{orders: map[uint]*model.Order{}}
+	_, broker, _ := startOrderWorkflow(t, orders)
+
+	message := mq.OrderRefundImmediateMessage{OrderID: testutil.ID()}
+	if o := waitOutcome(t, broker.deliver(t, mq.OrderRefundImmediateQueue, "", message)); o != outcomeDrop {
+		t.Errorf("Expected the refund of a missing order to be dropped, got %s", o)
+	}
+}
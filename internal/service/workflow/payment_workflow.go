@@ -1,64 +1,78 @@
 package workflow
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"sync"
 
+	"github.com/qs-lzh/flash-sale/internal/cache"
 	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
+	"github.com/qs-lzh/flash-sale/internal/realtime"
 	"github.com/qs-lzh/flash-sale/internal/service/domain"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/qs-lzh/flash-sale/internal/util"
 )
 
 type PaymentWorkflow struct {
 	paymentService domain.PaymentService
-	mqConn         *amqp.Connection
+	broker         mq.Broker
+	dedup          *MessageDeduplicator
+	notifier       notification.Notifier
+	events         realtime.Publisher
+
+	// consumer loops and in-flight handlers
+	wg sync.WaitGroup
 }
 
-func NewPaymentWorkflow(paymentService domain.PaymentService, mqConn *amqp.Connection) *PaymentWorkflow {
+func NewPaymentWorkflow(paymentService domain.PaymentService, broker mq.Broker, dedup *MessageDeduplicator,
+	notifier notification.Notifier, events realtime.Publisher) *PaymentWorkflow {
 	return &PaymentWorkflow{
 		paymentService: paymentService,
-		mqConn:         mqConn,
+		broker:         broker,
+		dedup:          dedup,
+		notifier:       notifier,
+		events:         events,
 	}
 }
 
-func (w *PaymentWorkflow) Start(mqConn *amqp.Connection) error {
-	if err := w.ConsumePaymentCreate(mqConn); err != nil {
+func (w *PaymentWorkflow) Start() error {
+	if err := w.ConsumePaymentCreate(); err != nil {
 		return err
 	}
-	if err := w.ConsumePaymentTimeout(mqConn); err != nil {
+	if err := w.ConsumePaymentTimeout(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (w *PaymentWorkflow) ConsumePaymentCreate(conn *amqp.Connection) error {
-	ch, err := mq.NewChannel(conn)
-	if err != nil {
-		return err
-	}
+// Wait blocks until the consumers have stopped and every in-flight payment is handled,
+// call it after the broker stopped consuming
+func (w *PaymentWorkflow) Wait(ctx context.Context) error {
+	return util.WaitContext(ctx, w.wg.Wait)
+}
 
-	msgs, err := ch.Consume(mq.ReservationToPaymentImmediateQueue, "", false, false, false, false, nil)
+func (w *PaymentWorkflow) ConsumePaymentCreate() error {
+	msgs, err := w.broker.Consume(mq.ReservationToPaymentImmediateQueue)
 	if err != nil {
 		return err
 	}
 
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 		for msg := range msgs {
+			if w.dedup.IsDuplicate(mq.ReservationToPaymentImmediateQueue, msg.MessageID) {
+				msg.Ack()
+				continue
+			}
+			w.wg.Add(1)
 			go func() {
-				reservationID, err := w.handlePaymentMessage(msg)
-				if err != nil {
+				defer w.wg.Done()
+				if err := w.handlePaymentMessage(msg); err != nil {
 					log.Printf("Failed to handle payment message: %v", err)
-				} else {
-					// no error means payment success,
-					// so send message to tell db to create order
-					if err := mq.SendImmediateMessage(ch, mq.PaymentToOrderImmediateQueue,
-						mq.PaymentToOrderImmediateMessage{
-							ReservationID: reservationID,
-						}); err != nil {
-						log.Printf("Failed to send message: %v", err)
-					}
 				}
 			}()
 		}
@@ -67,35 +81,121 @@ func (w *PaymentWorkflow) ConsumePaymentCreate(conn *amqp.Connection) error {
 	return nil
 }
 
-func (w *PaymentWorkflow) handlePaymentMessage(msg amqp.Delivery) (reservationID uint, err error) {
+// start the payment at the provider, the result arrives later through HandlePaymentEvent
+func (w *PaymentWorkflow) handlePaymentMessage(msg mq.Delivery) error {
 	var message mq.ReservationToPaymentImmediateMessage
 	if err := json.Unmarshal(msg.Body, &message); err != nil {
-		msg.Nack(false, false)
-		return 0, err
+		msg.Nack(false)
+		return err
 	}
 
-	if err := w.paymentService.StartMockPay(message.ReservationID); err != nil {
-		msg.Nack(false, true)
-		return 0, err
+	if _, err := w.paymentService.StartPayment(message.ReservationID, message.Price); err != nil {
+		// another delivery is creating the intent and is requeued itself if that fails
+		if errors.Is(err, domain.ErrPaymentInProgress) {
+			msg.Ack()
+			return nil
+		}
+		// retrying can't fix these
+		if errors.Is(err, domain.ErrPaymentAmountMismatch) ||
+			errors.Is(err, cache.ErrReservationNotFound) ||
+			errors.Is(err, cache.ErrInvalidReservationStatus) {
+			msg.Nack(false)
+			return err
+		}
+		msg.Nack(true)
+		return err
 	}
 
-	msg.Ack(false)
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.ReservationToPaymentImmediateQueue, msg.MessageID)
 
-	return message.ReservationID, nil
+	return nil
 }
 
-func (w *PaymentWorkflow) ConsumePaymentTimeout(mqConn *amqp.Connection) error {
-	ch, err := mq.NewChannel(mqConn)
-	if err != nil {
-		return err
+// HandlePaymentEvent handles a payment result reported by the provider.
+// A verified successful payment marks the reservation PAID and tells db to create the order,
+// a verified declined payment releases the ticket at once.
+// A payment which succeeded after the hold expired is honored or refunded, and the customer is told which.
+func (w *PaymentWorkflow) HandlePaymentEvent(event domain.PaymentEvent) error {
+	switch event.Status {
+	case domain.PaymentIntentStatusSucceeded:
+		confirmation, err := w.paymentService.ConfirmPayment(event)
+		if err != nil {
+			return err
+		}
+		if !confirmation.Duplicate {
+			w.notifyPayment(confirmation)
+			state := domain.ReservationStatePaid
+			if confirmation.Outcome == domain.PaymentOutcomeLateRefunded {
+				state = domain.ReservationStateRefunded
+			}
+			publishEvent(w.events, realtime.Event{
+				ReservationID: confirmation.ReservationID,
+				UserID:        confirmation.UserID,
+				State:         state,
+			})
+		}
+		if confirmation.Outcome == domain.PaymentOutcomeLateRefunded {
+			return nil
+		}
+		return w.broker.Publish(mq.PaymentToOrderImmediateQueue,
+			mq.PaymentToOrderImmediateMessage{
+				ReservationID: event.ReservationID,
+			})
+	case domain.PaymentIntentStatusFailed:
+		userID, released, err := w.paymentService.FailPayment(event)
+		if err != nil {
+			return err
+		}
+		if released {
+			notify(w.notifier, notification.Notification{
+				Kind:          notification.KindPaymentFailed,
+				UserID:        userID,
+				ReservationID: event.ReservationID,
+			})
+			publishEvent(w.events, realtime.Event{
+				ReservationID: event.ReservationID,
+				UserID:        userID,
+				State:         domain.ReservationStateFailed,
+			})
+		}
+		return nil
+	default:
+		log.Printf("Ignore payment event %s of reservation %d with status %s", event.EventID, event.ReservationID, event.Status)
+		return nil
+	}
+}
+
+func (w *PaymentWorkflow) notifyPayment(confirmation *domain.PaymentConfirmation) {
+	var kind notification.Kind
+	switch confirmation.Outcome {
+	case domain.PaymentOutcomePaid:
+		kind = notification.KindPaid
+	case domain.PaymentOutcomeLateHonored:
+		kind = notification.KindLatePaymentHonored
+	case domain.PaymentOutcomeLateRefunded:
+		kind = notification.KindLatePaymentRefunded
+	}
+	if confirmation.Outcome != domain.PaymentOutcomePaid {
+		log.Printf("Payment of reservation %d arrived after the hold expired: %s", confirmation.ReservationID, confirmation.Outcome)
 	}
 
-	msgs, err := ch.Consume(mq.ReservationToPaymentTimeoutQueue, "", false, false, false, false, nil)
+	notify(w.notifier, notification.Notification{
+		Kind:          kind,
+		UserID:        confirmation.UserID,
+		ReservationID: confirmation.ReservationID,
+	})
+}
+
+func (w *PaymentWorkflow) ConsumePaymentTimeout() error {
+	msgs, err := w.broker.Consume(mq.ReservationToPaymentTimeoutQueue)
 	if err != nil {
 		return err
 	}
 
+	w.wg.Add(1)
 	go func() {
+		defer w.wg.Done()
 		for msg := range msgs {
 			w.handlePaymentTimeout(msg)
 		}
@@ -104,16 +204,41 @@ func (w *PaymentWorkflow) ConsumePaymentTimeout(mqConn *amqp.Connection) error {
 	return nil
 }
 
-func (w *PaymentWorkflow) handlePaymentTimeout(msg amqp.Delivery) {
+func (w *PaymentWorkflow) handlePaymentTimeout(msg mq.Delivery) {
+	if w.dedup.IsDuplicate(mq.ReservationToPaymentTimeoutQueue, msg.MessageID) {
+		msg.Ack()
+		return
+	}
+
 	var message mq.ReservationToPaymentDelayMessage
 	if err := json.Unmarshal(msg.Body, &message); err != nil {
-		msg.Nack(false, false)
+		msg.Nack(false)
 		return
 	}
-	if err := w.paymentService.MarkTimeout(message.ReservationID); err != nil {
-		msg.Nack(false, true)
+	userID, timedOut, err := w.paymentService.MarkTimeout(message.ReservationID)
+	if err != nil {
+		// retrying can't fix these
+		if errors.Is(err, cache.ErrReservationNotFound) ||
+			errors.Is(err, cache.ErrInvalidReservationStatus) {
+			msg.Nack(false)
+			return
+		}
+		msg.Nack(true)
 		return
 	}
+	if timedOut {
+		notify(w.notifier, notification.Notification{
+			Kind:          notification.KindTimedOut,
+			UserID:        userID,
+			ReservationID: message.ReservationID,
+		})
+		publishEvent(w.events, realtime.Event{
+			ReservationID: message.ReservationID,
+			UserID:        userID,
+			State:         domain.ReservationStateTimeout,
+		})
+	}
 
-	msg.Ack(false)
+	msg.Ack()
+	w.dedup.MarkProcessed(mq.ReservationToPaymentTimeoutQueue, msg.MessageID)
 }
@@ -1,49 +1,90 @@
 package workflow
 
 import (
+	"log"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/model"
 	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/notification"
 	"github.com/qs-lzh/flash-sale/internal/service/domain"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type ReservationWorkflow struct {
 	ReservationService domain.ReservationService
-	MQConn             *amqp.Connection
+	Broker             mq.Broker
+	Notifier           notification.Notifier
 }
 
-func NewReservationWorkflow(reservationService domain.ReservationService, mqConn *amqp.Connection) *ReservationWorkflow {
+func NewReservationWorkflow(reservationService domain.ReservationService, broker mq.Broker,
+	notifier notification.Notifier) *ReservationWorkflow {
 	return &ReservationWorkflow{
 		ReservationService: reservationService,
-		MQConn:             mqConn,
+		Broker:             broker,
+		Notifier:           notifier,
 	}
 }
 
-func (w *ReservationWorkflow) Reserve(userID, showtimeID uint) error {
-	reservationID, err := w.ReservationService.Reserve(userID, showtimeID)
+// Reserve holds a ticket for the user, the hold times out unless the customer pays for it in time
+func (w *ReservationWorkflow) Reserve(userID, showtimeID uint, category model.TicketCategory, promoCode string) (*domain.Reservation, error) {
+	reservation, err := w.ReservationService.Reserve(userID, showtimeID, category, promoCode)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := w.Broker.Publish(mq.ReservationToPaymentDelayQueue,
+		mq.ReservationToPaymentDelayMessage{
+			ReservationID: reservation.ID,
+		}); err != nil {
+		return nil, err
 	}
 
-	ch, err := mq.NewChannel(w.MQConn)
+	notify(w.Notifier, notification.Notification{
+		Kind:          notification.KindReserved,
+		UserID:        reservation.UserID,
+		ReservationID: reservation.ID,
+		Data: map[string]string{
+			"amount":     notification.FormatAmount(reservation.Amount),
+			"currency":   reservation.Currency,
+			"expires_at": reservation.ExpiresAt.Format(time.RFC3339),
+		},
+	})
+
+	return reservation, nil
+}
+
+// Pay starts the payment of a reservation on the customer's request
+func (w *ReservationWorkflow) Pay(reservationID uint, token string) (*domain.Reservation, error) {
+	reservation, requested, err := w.ReservationService.RequestPayment(reservationID, token)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// the payment was started by an earlier request
+	if !requested {
+		return reservation, nil
 	}
 
-	if err := mq.SendImmediateMessage(ch, mq.ReservationToPaymentImmediateQueue,
+	if err := w.Broker.Publish(mq.ReservationToPaymentImmediateQueue,
 		mq.ReservationToPaymentImmediateMessage{
-			ReservationID: reservationID,
-			Price:         1,
+			ReservationID: reservation.ID,
+			Price:         reservation.Amount,
 		}); err != nil {
-		return err
+		// nothing will start the payment, let the customer ask again
+		if withdrawErr := w.ReservationService.WithdrawPaymentRequest(reservation.ID); withdrawErr != nil {
+			log.Printf("Failed to withdraw the payment request of reservation %d: %v", reservation.ID, withdrawErr)
+		}
+		return nil, err
 	}
 
-	if err := mq.SendTimeoutMessage(ch, mq.ReservationToPaymentDelayQueue,
-		mq.ReservationToPaymentDelayMessage{
-			ReservationID: reservationID,
-		}); err != nil {
-		return err
-	}
+	return reservation, nil
+}
+
+// Cancel releases a reservation on the customer's request, the timeout message finds it cancelled and does nothing
+func (w *ReservationWorkflow) Cancel(reservationID uint, token string) (*domain.Reservation, error) {
+	return w.ReservationService.Cancel(reservationID, token)
+}
 
-	return nil
+// Status tells the owner of a reservation what happened to it
+func (w *ReservationWorkflow) Status(reservationID, userID uint) (*domain.ReservationStatus, error) {
+	return w.ReservationService.GetStatus(reservationID, userID)
 }
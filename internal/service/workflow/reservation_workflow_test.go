@@ -0,0 +1,37 @@
+package workflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+	"github.com/qs-lzh/flash-sale/internal/mq"
+	"github.com/qs-lzh/flash-sale/internal/service/domain"
+	"github.com/qs-lzh/flash-sale/internal/testutil"
+)
+
+func TestReservationWorkflow_PayPublishesOnce(t *testing.T) {
+	redisCache := testutil.Redis(t)
+	broker := newFakeBroker()
+	w := NewReservationWorkflow(domain.NewReservationService(redisCache, nil, nil, nil, time.Minute), broker, &fakeNotifier{})
+
+	showtimeID := testutil.ID()
+	if err := redisCache.SetRemainingTickets(showtimeID, 1); err != nil {
+		t.Fatalf("Failed to set tickets: %v", err)
+	}
+	reservationID, err := redisCache.ReserveTicket(showtimeID, testutil.ID(), "token", time.Now().Add(time.Minute),
+		string(model.TicketCategoryStandard), cache.ShowtimePriceCacheValue{Amount: 4500, Currency: model.DefaultCurrency}, nil)
+	if err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+
+	for range 3 {
+		if _, err := w.Pay(reservationID, "token"); err != nil {
+			t.Fatalf("Failed to pay: %v", err)
+		}
+	}
+	if published := broker.publishedTo(mq.ReservationToPaymentImmediateQueue); len(published) != 1 {
+		t.Errorf("Expected one payment message, got %d", len(published))
+	}
+}
@@ -0,0 +1,106 @@
+// Package testutil connects tests to the redis and postgres configured for the environment
+// (CACHE_URL and DATABASE_DSN), tests needing one that can't be reached are skipped.
+// Tests share the stores with each other and with a running server, so they use fresh ids instead of flushing.
+package testutil
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/cache"
+	"github.com/qs-lzh/flash-sale/internal/model"
+)
+
+// lock held while migrating, packages are tested in parallel
+const migrateLockID = 4242
+
+// tables the tests need
+var migrateModels = []any{
+	&model.User{},
+	&model.RefreshToken{},
+	&model.Movie{},
+	&model.Showtime{},
+	&model.ShowtimePrice{},
+	&model.PromoCode{},
+	&model.Order{},
+	&model.NotificationPreference{},
+	&model.AuditLog{},
+}
+
+// Redis returns a cache on the environment's redis, or skips the test if it can't be reached
+func Redis(t testing.TB) *cache.RedisCache {
+	t.Helper()
+
+	cfg := loadConfig(t)
+	c, err := cache.NewRedisCache(cfg.CacheURL)
+	if err != nil {
+		t.Fatalf("Failed to create redis cache: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Client.Ping(ctx).Err(); err != nil {
+		c.Client.Close()
+		t.Skipf("redis at %q can't be reached: %v", cfg.CacheURL, err)
+	}
+	t.Cleanup(func() { c.Client.Close() })
+	return c
+}
+
+// Postgres returns a migrated database of the environment, or skips the test if there's none
+func Postgres(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	cfg := loadConfig(t)
+	if cfg.DatabaseDSN == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(cfg.DatabaseDSN), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Skipf("postgres can't be reached: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Failed to get sql.DB: %v", err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		t.Skipf("postgres can't be reached: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrateLockID).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", migrateLockID)
+		return conn.AutoMigrate(migrateModels...)
+	})
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	return db
+}
+
+// ID returns an id no other test uses, for showtimes and the like that only live in redis
+func ID() uint {
+	return uint(rand.Uint32()>>1) + 1_000_000
+}
+
+func loadConfig(t testing.TB) *config.Config {
+	t.Helper()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return cfg
+}
@@ -0,0 +1,14 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RandomHex returns n random bytes hex encoded, for ids and tokens nobody may guess
+func RandomHex(n int) string {
+	b := make([]byte, n)
+	// never fails, crypto/rand crashes the program if the system can't give randomness
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,20 @@
+package util
+
+import "context"
+
+// WaitContext runs wait, e.g. a sync.WaitGroup's Wait, giving up when ctx is done.
+// wait keeps running in the background after ctx is done
+func WaitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
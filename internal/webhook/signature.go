@@ -0,0 +1,80 @@
+// Package webhook signs and verifies payment webhook requests.
+// The signature header looks like "t=1700000000,v1=<hex>", where v1 is the
+// hex encoded HMAC-SHA256 of "<t>.<body>" keyed by the provider's secret.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Payment-Signature"
+	ProviderHeader  = "X-Payment-Provider"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing webhook signature")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp outside tolerance")
+)
+
+// Sign returns the signature header value of body sent at timestamp
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := timestamp.Unix()
+	return fmt.Sprintf("t=%d,v1=%s", t, computeSignature(secret, t, body))
+}
+
+// Verify checks the signature header of body, and that it was signed within tolerance of now
+func Verify(secret string, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	if header == "" {
+		return ErrMissingSignature
+	}
+
+	var t int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrInvalidSignature
+		}
+		switch key {
+		case "t":
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return ErrInvalidSignature
+			}
+			t = parsed
+		case "v1":
+			signature = value
+		}
+	}
+	if t == 0 || signature == "" {
+		return ErrInvalidSignature
+	}
+
+	expected := computeSignature(secret, t, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(t, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+func computeSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
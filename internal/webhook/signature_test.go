@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	const secret = "secret"
+	const tolerance = 5 * time.Minute
+	now := time.Now()
+	body := []byte(`{"event_id":"evt_1","status":"SUCCEEDED"}`)
+	valid := Sign(secret, now, body)
+	signature := computeSignature(secret, now.Unix(), body)
+
+	for _, tc := range []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		want   error
+	}{
+		{"valid", secret, valid, body, nil},
+		{"extra spaces and fields", secret, fmt.Sprintf(" t=%d , v0=old, v1=%s", now.Unix(), signature), body, nil},
+		{"tampered body", secret, valid, []byte(`{"event_id":"evt_1","status":"FAILED"}`), ErrInvalidSignature},
+		{"wrong secret", "other", valid, body, ErrInvalidSignature},
+		{"missing header", secret, "", body, ErrMissingSignature},
+		{"missing t", secret, "v1=" + signature, body, ErrInvalidSignature},
+		{"missing v1", secret, fmt.Sprintf("t=%d", now.Unix()), body, ErrInvalidSignature},
+		{"bad t", secret, "t=yesterday,v1=" + signature, body, ErrInvalidSignature},
+		{"no key value", secret, valid + ",garbage", body, ErrInvalidSignature},
+		{"signature of another time", secret, fmt.Sprintf("t=%d,v1=%s", now.Unix()+1, signature), body, ErrInvalidSignature},
+		{"stale", secret, Sign(secret, now.Add(-tolerance-time.Second), body), body, ErrStaleTimestamp},
+		{"future", secret, Sign(secret, now.Add(tolerance+time.Second), body), body, ErrStaleTimestamp},
+		{"within tolerance", secret, Sign(secret, now.Add(-tolerance+time.Second), body), body, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify(tc.secret, tc.header, tc.body, tolerance, now)
+			if !errors.Is(err, tc.want) || (tc.want == nil && err != nil) {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
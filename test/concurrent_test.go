@@ -2,6 +2,7 @@ package test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,18 +17,32 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/qs-lzh/flash-sale/config"
+	"github.com/qs-lzh/flash-sale/internal/auth"
 	"github.com/qs-lzh/flash-sale/internal/cache"
 	"github.com/qs-lzh/flash-sale/internal/model"
 )
 
 const baseURL = "http://127.0.0.1:4000"
 
+// standard ticket price of every showtime, in fen
+const ticketPrice = 4500
+
 type ReserveRequest struct {
-	UserID     uint `json:"user_id"`
 	ShowtimeID uint `json:"showtime_id"`
 }
 
+type ReserveResponse struct {
+	UserID           uint   `json:"-"`
+	ReservationID    uint   `json:"reservation_id"`
+	ReservationToken string `json:"reservation_token"`
+}
+
+type PayRequest struct {
+	ReservationToken string `json:"reservation_token"`
+}
+
 type TestResult struct {
+	Reservations    []ReserveResponse
 	SuccessCount    int64
 	SoldOutCount    int64
 	AlreadyOrdered  int64
@@ -49,8 +64,8 @@ func setupTestDB(t *testing.T, userCount, showtimeCount, ticketCount int) *gorm.
 	}
 
 	// clear and rebuild tables
-	db.Migrator().DropTable(&model.Order{}, &model.Showtime{}, &model.Movie{}, &model.User{})
-	db.Migrator().AutoMigrate(&model.User{}, &model.Movie{}, &model.Showtime{}, &model.Order{})
+	db.Migrator().DropTable(&model.Order{}, &model.ShowtimePrice{}, &model.Showtime{}, &model.Movie{}, &model.User{})
+	db.Migrator().AutoMigrate(&model.User{}, &model.RefreshToken{}, &model.Movie{}, &model.Showtime{}, &model.ShowtimePrice{}, &model.Order{}, &model.NotificationPreference{}, &model.AuditLog{})
 
 	for i := 1; i <= userCount; i++ {
 		user := model.User{
@@ -69,10 +84,17 @@ func setupTestDB(t *testing.T, userCount, showtimeCount, ticketCount int) *gorm.
 
 	for i := 1; i <= showtimeCount; i++ {
 		showtime := model.Showtime{
-			MovieID: 1,
-			StartAt: time.Now().Add(time.Duration(i*2) * time.Hour),
+			MovieID:  1,
+			StartAt:  time.Now().Add(time.Duration(i*2) * time.Hour),
+			Capacity: ticketCount,
 		}
 		db.Create(&showtime)
+		db.Create(&model.ShowtimePrice{
+			ShowtimeID: showtime.ID,
+			Category:   model.TicketCategoryStandard,
+			Amount:     ticketPrice,
+			Currency:   model.DefaultCurrency,
+		})
 	}
 
 	redisCache, err := cache.NewRedisCache(cfg.CacheURL)
@@ -105,11 +127,36 @@ var httpClient = &http.Client{
 	Timeout: 5 * time.Second,
 }
 
+var (
+	tokenManager     *auth.TokenManager
+	tokenManagerOnce sync.Once
+)
+
+// mintAccessToken signs an access token for the user with the server's secret,
+// logging 7000 users in through bcrypt would take longer than the test itself
+func mintAccessToken(userID uint) (string, error) {
+	tokenManagerOnce.Do(func() {
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			return
+		}
+		tokenManager = auth.NewTokenManager(cfg.AuthJWTSecret, cfg.AuthAccessTokenTTL)
+	})
+	if tokenManager == nil {
+		return "", fmt.Errorf("failed to load config")
+	}
+	token, _, err := tokenManager.IssueAccessToken(userID, model.RoleUser)
+	return token, err
+}
+
 func sendReserveRequest(userID, showtimeID uint) (statusCode int, responseBody string, duration time.Duration, err error) {
 	reqBody := ReserveRequest{
-		UserID:     userID,
 		ShowtimeID: showtimeID,
 	}
+	accessToken, err := mintAccessToken(userID)
+	if err != nil {
+		return 0, "", 0, err
+	}
 
 	jsonData, _ := json.Marshal(reqBody)
 
@@ -123,6 +170,7 @@ func sendReserveRequest(userID, showtimeID uint) (statusCode int, responseBody s
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	start := time.Now()
 	resp, err := httpClient.Do(req)
@@ -168,6 +216,13 @@ func concurrentTest(t *testing.T, concurrency int, showtimeID uint, userIDGenera
 			switch statusCode {
 			case 200:
 				atomic.AddInt64(&result.SuccessCount, 1)
+				var reservation ReserveResponse
+				if err := json.Unmarshal([]byte(body), &reservation); err != nil {
+					t.Logf("⚠️  无法解析预订响应 [用户%d]: %s", userID, body)
+					return
+				}
+				reservation.UserID = userID
+				result.Reservations = append(result.Reservations, reservation)
 			case 409:
 				if contains(body, "sold out") {
 					atomic.AddInt64(&result.SoldOutCount, 1)
@@ -177,6 +232,9 @@ func concurrentTest(t *testing.T, concurrency int, showtimeID uint, userIDGenera
 					atomic.AddInt64(&result.OtherErrorCount, 1)
 					t.Logf("⚠️  409但非预期错误 [用户%d]: %s", userID, body)
 				}
+			case 429:
+				atomic.AddInt64(&result.OtherErrorCount, 1)
+				t.Logf("⚠️  被限流 [用户%d]，服务需要用 make run-concurrency 启动: %s", userID, body)
 			default:
 				atomic.AddInt64(&result.OtherErrorCount, 1)
 				t.Logf("⚠️  未预期状态码 [用户%d]: %d, 响应: %s", userID, statusCode, body)
@@ -191,6 +249,75 @@ func concurrentTest(t *testing.T, concurrency int, showtimeID uint, userIDGenera
 	return result
 }
 
+func sendPayRequest(reservation ReserveResponse) (statusCode int, responseBody string, err error) {
+	jsonData, _ := json.Marshal(PayRequest{ReservationToken: reservation.ReservationToken})
+
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("%s/reservations/%d/pay", baseURL, reservation.ReservationID),
+		bytes.NewBuffer(jsonData),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), nil
+}
+
+// 为预订发起支付，返回成功发起支付的数量
+func payReservations(t *testing.T, reservations []ReserveResponse) int64 {
+	var wg sync.WaitGroup
+	var paid int64
+
+	for _, reservation := range reservations {
+		wg.Add(1)
+		go func(reservation ReserveResponse) {
+			defer wg.Done()
+
+			statusCode, body, err := sendPayRequest(reservation)
+			if err != nil {
+				t.Logf("❌ 支付请求错误 [预订%d]: %v", reservation.ReservationID, err)
+				return
+			}
+			if statusCode != 202 {
+				t.Logf("⚠️  支付未预期状态码 [预订%d]: %d, 响应: %s", reservation.ReservationID, statusCode, body)
+				return
+			}
+			atomic.AddInt64(&paid, 1)
+		}(reservation)
+	}
+
+	wg.Wait()
+	return paid
+}
+
+func getRemainingTickets(t *testing.T, showtimeID uint) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	redisCache, err := cache.NewRedisCache(cfg.CacheURL)
+	if err != nil {
+		t.Fatalf("Failed to create redis cache: %v", err)
+	}
+	defer redisCache.Client.Close()
+
+	remain, err := redisCache.Client.Get(context.Background(), cache.MakeShowtimeRemainingTicketsKey(showtimeID)).Int()
+	if err != nil {
+		t.Fatalf("Failed to get remaining tickets: %v", err)
+	}
+	return remain
+}
+
 func contains(s, substr string) bool {
 	if s == substr {
 		return true
@@ -223,6 +350,13 @@ func verifyOrderCount(t *testing.T, db *gorm.DB, showtimeID uint, expectedCount
 	} else {
 		t.Logf("✅ 数据库验证通过: %d 条订单", actualCount)
 	}
+
+	// every order is charged the price locked at reserve time
+	var wrongPriceCount int64
+	db.Model(&model.Order{}).Where("showtime_id = ? AND amount <> ?", showtimeID, ticketPrice).Count(&wrongPriceCount)
+	if wrongPriceCount != 0 {
+		t.Errorf("❌ %d 条订单金额不是 %d", wrongPriceCount, ticketPrice)
+	}
 }
 
 // 场景1: 极限抢票测试（超卖验证）
@@ -258,6 +392,8 @@ func TestConcurrent_OversellPrevention(t *testing.T) {
 		t.Errorf("❌ 失败数不符！期望: %d, 实际: %d", expectedFailed, actualFailed)
 	}
 
+	payReservations(t, result.Reservations)
+
 	fmt.Printf("订票已完成，等待3秒保证数据库写入完成\n")
 	time.Sleep(3 * time.Second)
 	verifyOrderCount(t, db, showtimeID, ticketCount)
@@ -294,6 +430,8 @@ func TestConcurrent_IdempotencyCheck(t *testing.T) {
 		t.Errorf("❌ 重复预订错误数不符！期望: %d, 实际: %d", concurrency-1, result.AlreadyOrdered)
 	}
 
+	payReservations(t, result.Reservations)
+
 	fmt.Printf("订票已完成，等待3秒保证数据库写入完成\n")
 	time.Sleep(3 * time.Second)
 
@@ -334,6 +472,10 @@ func TestConcurrent_MultipleShowtimes(t *testing.T) {
 
 	wg.Wait()
 
+	for _, result := range results {
+		payReservations(t, result.Reservations)
+	}
+
 	fmt.Printf("订票已完成，等待3秒保证数据库写入完成\n")
 	time.Sleep(3 * time.Second)
 
@@ -351,6 +493,121 @@ func TestConcurrent_MultipleShowtimes(t *testing.T) {
 	t.Logf("\n📊 多场次总结: 总成功预订 %d 笔", totalSuccess)
 }
 
+// 场景4: 放弃支付测试
+// 需要服务端和测试使用相同的较短 RESERVATION_HOLD_TIMEOUT，例如 5s
+func TestConcurrent_AbandonedReservations(t *testing.T) {
+	const (
+		ticketCount = 100
+		concurrency = 300
+		showtimeID  = 1
+	)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.ReservationHoldTimeout > 30*time.Second {
+		t.Skipf("RESERVATION_HOLD_TIMEOUT is %v, set it to 30s or less to run this test", cfg.ReservationHoldTimeout)
+	}
+
+	db := setupTestDB(t, concurrency, 1, ticketCount)
+
+	t.Logf("\n🎯 场景4: 放弃支付测试")
+	t.Logf("票数: %d, 并发用户: %d, 一半的预订不支付, 保留时间: %v", ticketCount, concurrency, cfg.ReservationHoldTimeout)
+
+	result := concurrentTest(t, concurrency, showtimeID, func(i int) uint {
+		return uint(i + 1)
+	})
+
+	printTestResult(t, "场景4: 放弃支付测试", result)
+
+	// 只为一半的预订支付，另一半放弃
+	paying := result.Reservations[:len(result.Reservations)/2]
+	paid := payReservations(t, paying)
+
+	fmt.Printf("等待预订超时 %v\n", cfg.ReservationHoldTimeout)
+	time.Sleep(cfg.ReservationHoldTimeout + 3*time.Second)
+
+	verifyOrderCount(t, db, showtimeID, paid)
+
+	// 放弃的预订应当全部返还库存
+	remain := getRemainingTickets(t, showtimeID)
+	if expected := ticketCount - int(paid); remain != expected {
+		t.Errorf("❌ 库存未正确返还！期望剩余: %d, 实际剩余: %d", expected, remain)
+	} else {
+		t.Logf("✅ 库存返还检测通过: 剩余 %d 张", remain)
+	}
+}
+
+// 场景5: 支付失败测试
+// 需要服务端配置 MOCK_PAYMENT_DECLINE_RATE > 0，测试使用相同的配置
+func TestConcurrent_DeclinedPayments(t *testing.T) {
+	const (
+		ticketCount = 100
+		concurrency = 300
+		showtimeID  = 1
+	)
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.MockPaymentDeclineRate <= 0 {
+		t.Skip("MOCK_PAYMENT_DECLINE_RATE is 0, set it to run this test")
+	}
+
+	db := setupTestDB(t, concurrency, 1, ticketCount)
+
+	t.Logf("\n🎯 场景5: 支付失败测试")
+	t.Logf("票数: %d, 并发用户: %d, 拒付率: %.2f", ticketCount, concurrency, cfg.MockPaymentDeclineRate)
+
+	result := concurrentTest(t, concurrency, showtimeID, func(i int) uint {
+		return uint(i + 1)
+	})
+
+	printTestResult(t, "场景5: 支付失败测试", result)
+
+	payReservations(t, result.Reservations)
+
+	fmt.Printf("等待支付结果和数据库写入\n")
+	time.Sleep(cfg.MockPaymentMaxLatency + 3*time.Second)
+
+	var paidUserIDs []uint
+	db.Model(&model.Order{}).Where("showtime_id = ?", showtimeID).Pluck("user_id", &paidUserIDs)
+	paid := make(map[uint]bool, len(paidUserIDs))
+	for _, userID := range paidUserIDs {
+		paid[userID] = true
+	}
+
+	// 失败的支付应当立即返还库存，不会一直占用到超时
+	remain := getRemainingTickets(t, showtimeID)
+	if remain+len(paidUserIDs) != ticketCount {
+		t.Errorf("❌ 库存不一致！订单: %d, 剩余: %d, 总票数: %d", len(paidUserIDs), remain, ticketCount)
+	} else {
+		t.Logf("✅ 库存返还检测通过: 订单 %d, 剩余 %d", len(paidUserIDs), remain)
+	}
+
+	// 支付失败的用户可以重新订票
+	retried, retryFailed := 0, 0
+	for _, reservation := range result.Reservations {
+		if paid[reservation.UserID] {
+			continue
+		}
+		statusCode, body, _, err := sendReserveRequest(reservation.UserID, showtimeID)
+		if err != nil || statusCode != 200 {
+			retryFailed++
+			t.Logf("⚠️  重新订票失败 [用户%d]: %d, 响应: %s", reservation.UserID, statusCode, body)
+			continue
+		}
+		retried++
+	}
+	if retryFailed > 0 {
+		t.Errorf("❌ %d 个支付失败的用户无法重新订票", retryFailed)
+	} else {
+		t.Logf("✅ 重新订票检测通过: %d 个支付失败的用户重新订票成功", retried)
+	}
+}
+
 // 修复string扩展方法
 type stringHelper string
 